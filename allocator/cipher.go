@@ -0,0 +1,285 @@
+package allocator
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	"github.com/hashicorp/vault/api"
+)
+
+// FieldCipher encrypts the sensitive fields of peer records before they are
+// written to etcd. Ciphertexts carry the key version they were written with,
+// so older versions stay readable after a rotation until Rewrap moves them to
+// the latest one.
+//
+// aad binds a ciphertext to where it is stored: decrypting needs the same
+// aad, so a ciphertext copied to another record does not decrypt. A nil aad
+// binds nothing and only reads ciphertexts written before they were bound.
+type FieldCipher interface {
+	Encrypt(ctx context.Context, plaintext, aad []byte) (string, error)
+	Decrypt(ctx context.Context, ciphertexts []string, aads [][]byte) ([][]byte, error)
+	Rewrap(ctx context.Context, ciphertexts []string, aads [][]byte) ([]string, error)
+}
+
+// ErrWrongRecord is returned when a ciphertext was bound to other aad, e.g.
+// because it was copied from another record.
+var ErrWrongRecord = errors.New("sealed fields do not belong to this record")
+
+// fieldCipher is nil when encryption at rest is disabled.
+var fieldCipher FieldCipher
+
+// sealedFields are the JSON names of the record fields fieldCipher encrypts.
+var sealedFields = []string{"owner"}
+
+// SetCipher makes c encrypt the given fields of peer records, which must be
+// among SealableFields.
+func SetCipher(c FieldCipher, fields []string) {
+	fieldCipher = c
+	sealedFields = fields
+}
+
+// CipherConfig selects how peer records are encrypted at rest. Mode is
+// "transit", "local" or empty to store records in plain text. Fields are the
+// JSON names of the record fields that are encrypted.
+type CipherConfig struct {
+	Mode         string
+	TransitMount string
+	TransitKey   string
+	KeysFile     string
+	Fields       []string
+}
+
+func CipherConfigFrom(s *settings.Source) CipherConfig {
+	cfg := CipherConfig{
+		Mode:         s.String("PEER_ENCRYPTION", ""),
+		TransitMount: s.String("PEER_ENCRYPTION_TRANSIT_MOUNT", "transit"),
+		TransitKey:   s.String("PEER_ENCRYPTION_TRANSIT_KEY", "wireable-peers"),
+		KeysFile:     s.String("PEER_ENCRYPTION_KEYS_FILE", ""),
+		Fields:       s.List("PEER_ENCRYPTED_FIELDS"),
+	}
+	if len(cfg.Fields) == 0 {
+		cfg.Fields = []string{"owner"}
+	}
+	sealable := SealableFields()
+	for _, field := range cfg.Fields {
+		if !slices.Contains(sealable, field) {
+			s.Invalid("PEER_ENCRYPTED_FIELDS", field, fmt.Errorf("expected one of %s", strings.Join(sealable, ", ")))
+		}
+	}
+	switch cfg.Mode {
+	case "", "transit":
+	case "local":
+		if cfg.KeysFile == "" {
+			s.Invalid("PEER_ENCRYPTION_KEYS_FILE", "", errors.New("required with PEER_ENCRYPTION=local"))
+		}
+	default:
+		s.Invalid("PEER_ENCRYPTION", cfg.Mode, errors.New("expected transit, local or nothing"))
+	}
+	return cfg
+}
+
+// NewCipher builds the cipher selected by cfg. vc is only used in transit
+// mode.
+func NewCipher(cfg CipherConfig, vc *api.Client) (FieldCipher, error) {
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case "transit":
+		return &transitCipher{vc: vc, mount: cfg.TransitMount, key: cfg.TransitKey}, nil
+	case "local":
+		return loadLocalCipher(cfg.KeysFile)
+	default:
+		return nil, fmt.Errorf("unsupported PEER_ENCRYPTION %q", cfg.Mode)
+	}
+}
+
+type transitCipher struct {
+	vc    *api.Client
+	mount string
+	key   string
+}
+
+// boundPlaintext is what the transit cipher encrypts for bound ciphertexts.
+// Transit only derives keys from a context for keys created with derivation,
+// and cannot rewrap ciphertexts with associated data, so the aad is sealed
+// along with the plaintext and compared after decrypting.
+type boundPlaintext struct {
+	AAD  []byte `json:"aad"`
+	Data []byte `json:"data"`
+}
+
+func (t *transitCipher) Encrypt(ctx context.Context, plaintext, aad []byte) (string, error) {
+	if aad != nil {
+		var err error
+		if plaintext, err = json.Marshal(boundPlaintext{AAD: aad, Data: plaintext}); err != nil {
+			return "", err
+		}
+	}
+	return vaultclient.TransitEncrypt(ctx, t.vc, t.mount, t.key, plaintext)
+}
+
+func (t *transitCipher) Decrypt(ctx context.Context, ciphertexts []string, aads [][]byte) ([][]byte, error) {
+	plaintexts, err := vaultclient.TransitDecrypt(ctx, t.vc, t.mount, t.key, ciphertexts)
+	if err != nil {
+		return nil, err
+	}
+	for i, aad := range aads {
+		if aad == nil {
+			continue
+		}
+		var bound boundPlaintext
+		if err := json.Unmarshal(plaintexts[i], &bound); err != nil {
+			return nil, ErrWrongRecord
+		}
+		if subtle.ConstantTimeCompare(bound.AAD, aad) != 1 {
+			return nil, ErrWrongRecord
+		}
+		plaintexts[i] = bound.Data
+	}
+	return plaintexts, nil
+}
+
+// Rewrap keeps the aad, which is part of the plaintext.
+func (t *transitCipher) Rewrap(ctx context.Context, ciphertexts []string, _ [][]byte) ([]string, error) {
+	return vaultclient.TransitRewrap(ctx, t.vc, t.mount, t.key, ciphertexts)
+}
+
+const localPrefix = "local:v"
+
+// localCipher uses AES-256-GCM keys read from a file with one
+// "<version>:<base64 key>" pair per line. The highest version encrypts.
+type localCipher struct {
+	keys   map[int]cipher.AEAD
+	latest int
+}
+
+func loadLocalCipher(path string) (*localCipher, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PEER_ENCRYPTION_KEYS_FILE: %w", err)
+	}
+	defer file.Close()
+
+	c := &localCipher{keys: make(map[int]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v, encoded, ok := strings.Cut(line, ":")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid key on line %d, expected <version>:<base64 key>", lineNo)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("key version %d must be 32 bytes of base64", version)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[version] = aead
+		c.latest = max(c.latest, version)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(c.keys) == 0 {
+		return nil, errors.New("PEER_ENCRYPTION_KEYS_FILE holds no keys")
+	}
+	return c, nil
+}
+
+func (l *localCipher) Encrypt(_ context.Context, plaintext, aad []byte) (string, error) {
+	aead := l.keys[l.latest]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, aad)
+	return localPrefix + strconv.Itoa(l.latest) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (l *localCipher) Decrypt(_ context.Context, ciphertexts []string, aads [][]byte) ([][]byte, error) {
+	plaintexts := make([][]byte, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		plaintext, err := l.decrypt(ciphertext, aads[i])
+		if err != nil {
+			return nil, err
+		}
+		plaintexts[i] = plaintext
+	}
+	return plaintexts, nil
+}
+
+func (l *localCipher) decrypt(ciphertext string, aad []byte) ([]byte, error) {
+	version, err := l.version(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := l.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("key version %d is not loaded", version)
+	}
+
+	_, encoded, _ := strings.Cut(strings.TrimPrefix(ciphertext, localPrefix), ":")
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+	nonce, sealed := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil && aad != nil {
+		// Open fails alike for a tampered ciphertext and for wrong aad
+		return nil, ErrWrongRecord
+	}
+	return plaintext, err
+}
+
+func (l *localCipher) version(ciphertext string) (int, error) {
+	if !strings.HasPrefix(ciphertext, localPrefix) {
+		return 0, errors.New("ciphertext was not written by the local cipher")
+	}
+	v, _, _ := strings.Cut(strings.TrimPrefix(ciphertext, localPrefix), ":")
+	return strconv.Atoi(v)
+}
+
+// Rewrap re-encrypts every ciphertext that was not written with the latest
+// key version.
+func (l *localCipher) Rewrap(ctx context.Context, ciphertexts []string, aads [][]byte) ([]string, error) {
+	rewrapped := make([]string, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		if version, err := l.version(ciphertext); err == nil && version == l.latest {
+			rewrapped[i] = ciphertext
+			continue
+		}
+		plaintext, err := l.decrypt(ciphertext, aads[i])
+		if err != nil {
+			return nil, err
+		}
+		if rewrapped[i], err = l.Encrypt(ctx, plaintext, aads[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rewrapped, nil
+}
@@ -3,65 +3,152 @@ package allocator
 import (
 	"container/heap"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"github.com/Zacky3181V/wireable/audit"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// IPHeap implements a min-heap for IP addresses (net.IP)
-type IPHeap []net.IP
+var tracer = otel.Tracer("wireable/allocator")
 
-func (h IPHeap) Len() int { return len(h) }
-func (h IPHeap) Less(i, j int) bool {
-	return bytesCompare(h[i], h[j]) < 0
+// IPHeap is a min-heap of available IP addresses that is safe for
+// concurrent use. A position index keeps membership checks O(1) and removal
+// of arbitrary addresses O(log n).
+type IPHeap struct {
+	mu    sync.Mutex
+	items ipHeapItems
 }
-func (h IPHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-func (h *IPHeap) Push(x interface{}) {
-	*h = append(*h, x.(net.IP))
+
+// ipHeapItems implements heap.Interface and keeps index in sync with the
+// position of every IP.
+type ipHeapItems struct {
+	ips   []net.IP
+	index map[string]int
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+func (h ipHeapItems) Len() int { return len(h.ips) }
+func (h ipHeapItems) Less(i, j int) bool {
+	return bytesCompare(h.ips[i], h.ips[j]) < 0
+}
+func (h ipHeapItems) Swap(i, j int) {
+	h.ips[i], h.ips[j] = h.ips[j], h.ips[i]
+	h.index[ipKey(h.ips[i])] = i
+	h.index[ipKey(h.ips[j])] = j
 }
-func (h *IPHeap) Pop() interface{} {
-	old := *h
+func (h *ipHeapItems) Push(x interface{}) {
+	ip := x.(net.IP)
+	h.index[ipKey(ip)] = len(h.ips)
+	h.ips = append(h.ips, ip)
+}
+func (h *ipHeapItems) Pop() interface{} {
+	old := h.ips
 	n := len(old)
 	x := old[n-1]
-	*h = old[0 : n-1]
+	h.ips = old[0 : n-1]
+	delete(h.index, ipKey(x))
 	return x
 }
 
-func bytesCompare(a, b net.IP) int {
-	a4 := a.To16()
-	b4 := b.To16()
-	return strings.Compare(string(a4), string(b4))
+// NewIPHeap builds a heap holding ips. Duplicates are dropped.
+func NewIPHeap(ips []net.IP) *IPHeap {
+	h := &IPHeap{}
+	h.Reset(ips)
+	return h
 }
 
+// Reset replaces the content of the heap with ips.
+func (h *IPHeap) Reset(ips []net.IP) {
+	items := ipHeapItems{
+		ips:   make([]net.IP, 0, len(ips)),
+		index: make(map[string]int, len(ips)),
+	}
+	for _, ip := range ips {
+		if _, ok := items.index[ipKey(ip)]; ok {
+			continue
+		}
+		items.index[ipKey(ip)] = len(items.ips)
+		items.ips = append(items.ips, ip)
+	}
+	heap.Init(&items)
+
+	h.mu.Lock()
+	h.items = items
+	h.mu.Unlock()
+}
 
-func ipToKey(ip net.IP) string {
-	return "/ip-pool/available/" + ip.String()
+func (h *IPHeap) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.items.Len()
 }
 
-func takenKey(ip net.IP) string {
-	return "/ip-pool/taken/" + ip.String()
+// Contains reports whether ip is in the heap.
+func (h *IPHeap) Contains(ip net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.items.index[ipKey(ip)]
+	return ok
 }
 
-func LoadAvailableIPs(ctx context.Context, cli *clientv3.Client) ([]net.IP, error) {
-	resp, err := cli.Get(ctx, "/ip-pool/available/", clientv3.WithPrefix())
-	if err != nil {
-		return nil, err
+// Push adds ip and reports false if it was already in the heap.
+func (h *IPHeap) Push(ip net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.items.index[ipKey(ip)]; ok {
+		return false
 	}
+	heap.Push(&h.items, ip)
+	return true
+}
 
-	var ips []net.IP
-	for _, kv := range resp.Kvs {
-		key := string(kv.Key)
-		ipStr := strings.TrimPrefix(key, "/ip-pool/available/")
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			log.Printf("invalid IP in etcd key: %s", key)
-			continue
-		}
-		ips = append(ips, ip)
+// Pop removes and returns the lowest IP, or nil if the heap is empty.
+func (h *IPHeap) Pop() net.IP {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.items.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&h.items).(net.IP)
+}
+
+// Remove drops ip and reports whether it was in the heap.
+func (h *IPHeap) Remove(ip net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, ok := h.items.index[ipKey(ip)]
+	if !ok {
+		return false
+	}
+	heap.Remove(&h.items, i)
+	return true
+}
+
+func bytesCompare(a, b net.IP) int {
+	a4 := a.To16()
+	b4 := b.To16()
+	return strings.Compare(string(a4), string(b4))
+}
+
+// LoadAvailableIPs returns the available IPs of store in ascending order and
+// the revision they were read at.
+func LoadAvailableIPs(ctx context.Context, store PoolStore) ([]net.IP, int64, error) {
+	ips, revision, err := store.Available(ctx)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Sort for deterministic heap build (not required, but good)
@@ -69,85 +156,271 @@ func LoadAvailableIPs(ctx context.Context, cli *clientv3.Client) ([]net.IP, erro
 		return bytesCompare(ips[i], ips[j]) < 0
 	})
 
-	return ips, nil
+	return ips, revision, nil
 }
 
-func WatchAvailableIPs(ctx context.Context, cli *clientv3.Client, ipHeap *IPHeap) {
-	rch := cli.Watch(ctx, "/ip-pool/available/", clientv3.WithPrefix())
-	for wresp := range rch {
-		for _, ev := range wresp.Events {
-			ipStr := strings.TrimPrefix(string(ev.Kv.Key), "/ip-pool/available/")
-			ip := net.ParseIP(ipStr)
-			if ip == nil {
-				continue
+const maxWatchBackoff = 30 * time.Second
+
+// WatchAvailableIPs keeps ipHeap in sync with the pool until ctx is done. It
+// reads the pool and then applies every change made after that read. A
+// broken watch is resumed from the last revision it saw; when the store can
+// no longer replay changes from there, the heap is rebuilt from a fresh read.
+func WatchAvailableIPs(ctx context.Context, store PoolStore, ipHeap *IPHeap) {
+	var revision int64
+	synced := false
+	backoff := time.Second
+
+	updateWatcher(func(s *WatcherStatus) { s.Running = true })
+	defer updateWatcher(func(s *WatcherStatus) { s.Running, s.Watching = false, false })
+
+	for ctx.Err() == nil {
+		if !synced {
+			ips, rev, err := LoadAvailableIPs(ctx, store)
+			if err != nil {
+				updateWatcher(func(s *WatcherStatus) { s.LastError = err.Error() })
+				logger.ErrorContext(ctx, "Failed to read the pool, retrying", "backoff", backoff, "error", err)
+			} else {
+				ipHeap.Reset(ips)
+				revision, synced = rev, true
+				now := time.Now().UTC()
+				updateWatcher(func(s *WatcherStatus) { s.Revision, s.LastSync, s.LastError = rev, &now, "" })
+				watchResyncs.Add(ctx, 1)
+				logger.InfoContext(ctx, "Synced available IPs", "count", len(ips), "revision", revision)
 			}
+		}
 
-			switch ev.Type {
-			case clientv3.EventTypePut:
-				// Add new available IP to heap
-				heap.Push(ipHeap, ip)
-				log.Printf("IP available: %s", ip)
-			case clientv3.EventTypeDelete:
-				// Remove IP from heap if deleted (allocation)
-				RemoveIPFromHeap(ipHeap, ip)
-				log.Printf("IP allocated or removed: %s", ip)
+		if synced {
+			updateWatcher(func(s *WatcherStatus) { s.Watching = true })
+			progressed, err := applyPoolEvents(ctx, store, ipHeap, &revision)
+			updateWatcher(func(s *WatcherStatus) { s.Watching, s.LastError = false, err.Error() })
+			if ctx.Err() != nil {
+				return
+			}
+			if progressed {
+				backoff = time.Second
 			}
+			if errors.Is(err, ErrCompacted) {
+				synced = false
+				watchRestarts.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", "compacted")))
+				continue
+			}
+			watchRestarts.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", "error")))
+			logger.WarnContext(ctx, "Pool watch ended, resuming", "revision", revision, "backoff", backoff, "error", err)
 		}
-	}
-}
 
-func RemoveIPFromHeap(ipHeap *IPHeap, ip net.IP) {
-	for i, val := range *ipHeap {
-		if val.Equal(ip) {
-			heap.Remove(ipHeap, i)
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(backoff):
 		}
+		backoff = min(backoff*2, maxWatchBackoff)
 	}
 }
 
-func AllocateIP(ctx context.Context, cli *clientv3.Client, ipHeap *IPHeap, publicKey string) (net.IP, error) {
-	if ipHeap.Len() == 0 {
-		return nil, fmt.Errorf("no available IPs")
+// applyPoolEvents applies the changes after *revision to ipHeap until the
+// watch breaks, advancing *revision as it goes. It reports whether any event
+// was received.
+func applyPoolEvents(ctx context.Context, store PoolStore, ipHeap *IPHeap, revision *int64) (bool, error) {
+	progressed := false
+	for ev := range store.Watch(ctx, *revision) {
+		switch ev.Type {
+		case EventError:
+			if errors.Is(ev.Err, ErrCompacted) {
+				// Changes between our revision and the compaction are lost
+				gap := max(ev.Revision-*revision, 0)
+				watchGapRevisions.Add(ctx, gap)
+				logger.WarnContext(ctx, "Pool watch missed revisions, reloading the pool", "from", *revision+1, "to", ev.Revision)
+			}
+			return progressed, ev.Err
+		case EventAvailable:
+			evCtx, span := startEventSpan(ctx, "available", ev)
+			// Add new available IP to heap
+			ipHeap.Push(ev.IP)
+			watchEvents.Add(evCtx, 1, metric.WithAttributes(attribute.String("type", "available")))
+			logger.DebugContext(evCtx, "IP available", "ip", ev.IP)
+			// Every replica sees this event, the revision keeps it to one entry
+			entry := audit.Entry{
+				Action:  audit.ActionPoolChange,
+				Actor:   "pool",
+				Target:  ev.IP.String(),
+				Result:  audit.ResultSuccess,
+				Details: map[string]string{"op": "add"},
+			}
+			audit.Submit(evCtx, entry, fmt.Sprintf("pool-%d-%s", ev.Revision, ev.IP))
+			span.End()
+		case EventRemoved:
+			evCtx, span := startEventSpan(ctx, "removed", ev)
+			// Remove IP from heap if deleted (allocation)
+			ipHeap.Remove(ev.IP)
+			watchEvents.Add(evCtx, 1, metric.WithAttributes(attribute.String("type", "removed")))
+			logger.DebugContext(evCtx, "IP allocated or removed", "ip", ev.IP)
+			span.End()
+		}
+		*revision = max(*revision, ev.Revision)
+		progressed = true
+		now := time.Now().UTC()
+		updateWatcher(func(s *WatcherStatus) { s.Revision, s.LastEvent = *revision, &now })
 	}
+	return progressed, errors.New("watch channel closed")
+}
 
-	ip := heap.Pop(ipHeap).(net.IP)
-	availKey := ipToKey(ip)
-	takeKey := takenKey(ip)
+// startEventSpan starts a span for a pool change received from the watch.
+func startEventSpan(ctx context.Context, eventType string, ev PoolEvent) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "PoolEvent", trace.WithAttributes(
+		attribute.String("pool.event", eventType),
+		attribute.String("pool.ip", ev.IP.String()),
+		attribute.Int64("pool.revision", ev.Revision),
+	))
+}
+
+const (
+	// maxAllocAttempts bounds the claims a single allocation tries.
+	maxAllocAttempts = 10
+	// refreshAfterLosses is how many races in a row make the allocation
+	// reload the heap from the store instead of trusting it.
+	refreshAfterLosses = 3
+)
 
-	txn := cli.Txn(ctx)
-	// Transaction condition: available key must exist
-	txnResp, err := txn.If(clientv3.Compare(clientv3.Version(availKey), ">", 0)).
-		Then(
-			clientv3.OpDelete(availKey),
-			clientv3.OpPut(takeKey, publicKey),
-		).
-		Commit()
+// AllocateIP claims the lowest available IP for record. When quota is above
+// zero the claim only succeeds if record.Owner holds fewer than quota peers.
+//
+// IPs that another replica claimed first are dropped from the heap and the
+// next one is tried after a short random delay. When the heap runs empty or
+// keeps losing races it is reloaded from the store, so ErrPoolExhausted is
+// only returned when the store has no available IP left.
+func AllocateIP(ctx context.Context, store PoolStore, ipHeap *IPHeap, record *PeerRecord, quota int) (net.IP, error) {
+	ctx, span := tracer.Start(ctx, "AllocateIP", trace.WithAttributes(attribute.String("peer.id", record.ID)))
+	defer span.End()
 
+	ip, err := allocateIP(ctx, store, ipHeap, record, quota)
 	if err != nil {
-		// On error, push IP back to heap to keep local state consistent
-		heap.Push(ipHeap, ip)
+		span.RecordError(err)
 		return nil, err
 	}
+	span.SetAttributes(attribute.String("peer.ip", ip.String()))
+	return ip, nil
+}
 
-	if !txnResp.Succeeded {
-		// If the available key doesn't exist (race condition), reload heap and retry or return error
-		heap.Push(ipHeap, ip)
-		return nil, fmt.Errorf("ip %s is already taken", ip.String())
+func allocateIP(ctx context.Context, store PoolStore, ipHeap *IPHeap, record *PeerRecord, quota int) (net.IP, error) {
+	owner, err := ownerCount(ctx, store, record.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if quota > 0 && owner != nil && owner.Count >= quota {
+		return nil, ErrQuotaExceeded
 	}
 
-	return ip, nil
+	losses := 0
+	refreshed := false
+	for attempt := 0; attempt < maxAllocAttempts; attempt++ {
+		if ipHeap.Len() == 0 || losses >= refreshAfterLosses {
+			if ipHeap.Len() == 0 && refreshed {
+				return nil, ErrPoolExhausted
+			}
+			ips, _, err := LoadAvailableIPs(ctx, store)
+			if err != nil {
+				return nil, err
+			}
+			ipHeap.Reset(ips)
+			logger.InfoContext(ctx, "Reloaded available IPs from the pool store", "count", len(ips))
+			refreshed = true
+			losses = 0
+		}
+
+		ip := ipHeap.Pop()
+		if ip == nil {
+			continue
+		}
+
+		record.IP = ip.String()
+		value, err := encodeRecord(ctx, record)
+		if err != nil {
+			ipHeap.Push(ip)
+			return nil, err
+		}
+
+		result, err := claim(ctx, store, ip, record.ID, value, owner)
+		if err != nil {
+			// On error, push IP back to heap to keep local state consistent
+			ipHeap.Push(ip)
+			return nil, err
+		}
+
+		switch result {
+		case ClaimOK:
+			return ip, nil
+		case ClaimTaken:
+			// Another replica got it first, the IP stays out of the heap
+			losses++
+			claimConflicts.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", "taken")))
+			logger.DebugContext(ctx, "IP was taken concurrently, trying the next one", "ip", ip)
+		case ClaimConflict:
+			// The IP is still free but the owner took or released a peer
+			// since the count was read, so read it again
+			ipHeap.Push(ip)
+			claimConflicts.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", "quota")))
+			if owner, err = ownerCount(ctx, store, record.Owner); err != nil {
+				return nil, err
+			}
+			if quota > 0 && owner.Count >= quota {
+				return nil, ErrQuotaExceeded
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(rand.Intn(10*(attempt+1))+1) * time.Millisecond):
+		}
+	}
+	return nil, fmt.Errorf("could not claim an IP after %d attempts", maxAllocAttempts)
+}
+
+// claim wraps store.Claim in a span, one per attempt.
+func claim(ctx context.Context, store PoolStore, ip net.IP, id string, value []byte, owner *OwnerCount) (ClaimResult, error) {
+	ctx, span := tracer.Start(ctx, "PoolStore.Claim", trace.WithAttributes(attribute.String("pool.ip", ip.String())))
+	defer span.End()
+	if owner != nil {
+		span.SetAttributes(attribute.Int("pool.owner_count", owner.Count), attribute.Int64("pool.owner_revision", owner.Revision))
+	}
+
+	result, err := store.Claim(ctx, ip, id, value, owner)
+	if err != nil {
+		span.RecordError(err)
+		return result, err
+	}
+	span.SetAttributes(attribute.String("pool.claim", result.String()))
+	return result, nil
 }
 
-func ReleaseIP(ctx context.Context, cli *clientv3.Client, ip net.IP) error {
-	availKey := ipToKey(ip)
-	takeKey := takenKey(ip)
+// ReleaseIP returns a taken IP to the pool and drops its peer record.
+func ReleaseIP(ctx context.Context, store PoolStore, ip net.IP) error {
+	ctx, span := tracer.Start(ctx, "ReleaseIP", trace.WithAttributes(attribute.String("pool.ip", ip.String())))
+	defer span.End()
 
-	txn := cli.Txn(ctx)
-	_, err := txn.If(clientv3.Compare(clientv3.Version(takeKey), ">", 0)).
-		Then(
-			clientv3.OpDelete(takeKey),
-			clientv3.OpPut(availKey, ""),
-		).
-		Commit()
-	return err
-}
\ No newline at end of file
+	entry, err := store.Get(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return ErrPeerNotFound
+	}
+	// The owner may be sealed, the peer is uncounted from it
+	record, err := decodeRecord(ctx, ip.String(), entry.Value)
+	if err != nil {
+		return err
+	}
+	key := ""
+	if record.Owner != "" {
+		key = ownerKey(record.Owner)
+	}
+
+	released, err := store.Release(ctx, ip, record.ID, key, entry.Revision)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return fmt.Errorf("peer %s changed concurrently", ip.String())
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package allocator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// poolSize is the size of a /16, the largest pool the benchmarks cover.
+const poolSize = 1 << 16
+
+// poolIPs returns n consecutive addresses from 10.0.0.0.
+func poolIPs(n int) []net.IP {
+	ips := make([]net.IP, n)
+	for i := range ips {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, 10<<24|uint32(i))
+		ips[i] = ip
+	}
+	return ips
+}
+
+func TestIPHeapPopsInOrder(t *testing.T) {
+	ips := poolIPs(poolSize)
+	// Build from the reverse order, with duplicates
+	shuffled := make([]net.IP, 0, len(ips)+1)
+	for i := len(ips) - 1; i >= 0; i-- {
+		shuffled = append(shuffled, ips[i])
+	}
+	shuffled = append(shuffled, ips[0])
+	h := NewIPHeap(shuffled)
+	if h.Len() != poolSize {
+		t.Fatalf("Len() = %d, want %d", h.Len(), poolSize)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		if !h.Remove(ips[i]) {
+			t.Fatalf("Remove(%s) = false, want true", ips[i])
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if got, want := h.Contains(ips[i]), i%2 == 1; got != want {
+			t.Fatalf("Contains(%s) = %v, want %v", ips[i], got, want)
+		}
+	}
+	if h.Push(ips[1]) {
+		t.Fatalf("Push(%s) of a member = true, want false", ips[1])
+	}
+
+	var prev net.IP
+	for n := 0; ; n++ {
+		ip := h.Pop()
+		if ip == nil {
+			if n != poolSize-50 {
+				t.Fatalf("popped %d IPs, want %d", n, poolSize-50)
+			}
+			break
+		}
+		if prev != nil && bytes.Compare(prev, ip) >= 0 {
+			t.Fatalf("popped %s after %s", ip, prev)
+		}
+		prev = ip
+	}
+	if h.Contains(ips[1]) {
+		t.Fatalf("Contains(%s) after draining = true", ips[1])
+	}
+}
+
+// TestIPHeapConcurrent changes the heap from several goroutines, the way the
+// handlers and the pool watcher do. Run it with -race.
+func TestIPHeapConcurrent(t *testing.T) {
+	// The heap starts with the first half; the second half is pushed
+	ips := poolIPs(2 * poolSize)
+	h := NewIPHeap(ips[:poolSize])
+
+	const workers = 8
+	popped := make([][]net.IP, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < poolSize; i += workers {
+				switch i % 4 {
+				case 0:
+					if ip := h.Pop(); ip != nil {
+						popped[w] = append(popped[w], ip)
+					}
+				case 1:
+					h.Remove(ips[i])
+				case 2:
+					h.Contains(ips[i])
+				case 3:
+					h.Push(ips[poolSize+i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, poolSize)
+	for _, list := range popped {
+		for _, ip := range list {
+			if seen[ip.String()] {
+				t.Fatalf("%s was popped twice", ip)
+			}
+			seen[ip.String()] = true
+		}
+	}
+	inHeap := 0
+	for i, ip := range ips {
+		switch {
+		case h.Contains(ip) && seen[ip.String()]:
+			t.Fatalf("%s is in the heap after it was popped", ip)
+		case i < poolSize && i%4 == 1 && h.Contains(ip):
+			t.Fatalf("%s is in the heap after Remove", ip)
+		case i >= poolSize && i%4 == 3 && !h.Contains(ip) && !seen[ip.String()]:
+			t.Fatalf("pushed %s is neither in the heap nor popped", ip)
+		case i >= poolSize && i%4 != 3 && h.Contains(ip):
+			t.Fatalf("%s is in the heap but was never pushed", ip)
+		}
+		if h.Contains(ip) {
+			inHeap++
+		}
+	}
+	if h.Len() != inHeap {
+		t.Fatalf("Len() = %d, but %d addresses are in the heap", h.Len(), inHeap)
+	}
+}
+
+func BenchmarkIPHeapPush(b *testing.B) {
+	ips := poolIPs(poolSize)
+	h := NewIPHeap(nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%poolSize == 0 && i > 0 {
+			b.StopTimer()
+			h.Reset(nil)
+			b.StartTimer()
+		}
+		h.Push(ips[poolSize-1-i%poolSize])
+	}
+}
+
+func BenchmarkIPHeapPop(b *testing.B) {
+	ips := poolIPs(poolSize)
+	h := NewIPHeap(ips)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if h.Pop() == nil {
+			b.StopTimer()
+			h.Reset(ips)
+			b.StartTimer()
+		}
+	}
+}
+
+func BenchmarkIPHeapRemove(b *testing.B) {
+	ips := poolIPs(poolSize)
+	h := NewIPHeap(ips)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Remove from the middle of the pool, where it is not a Pop
+		ip := ips[(i*7919)%poolSize]
+		if !h.Remove(ip) {
+			b.StopTimer()
+			h.Reset(ips)
+			b.StartTimer()
+		}
+	}
+}
+
+func BenchmarkIPHeapContains(b *testing.B) {
+	ips := poolIPs(poolSize)
+	h := NewIPHeap(ips)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Contains(ips[(i*7919)%poolSize])
+	}
+}
@@ -0,0 +1,10 @@
+package allocator
+
+import "log/slog"
+
+var logger = slog.Default()
+
+// SetLogger sets the logger the package writes to.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
@@ -0,0 +1,37 @@
+package allocator
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("wireable/allocator")
+
+var (
+	watchRestarts, _ = meter.Int64Counter("wireable.pool.watch.restarts",
+		metric.WithDescription("Pool watches that ended and were restarted, by reason"))
+	watchResyncs, _ = meter.Int64Counter("wireable.pool.watch.resyncs",
+		metric.WithDescription("Full reads of the pool done by the watcher"))
+	watchGapRevisions, _ = meter.Int64Counter("wireable.pool.watch.gap_revisions",
+		metric.WithDescription("Store revisions the watcher missed because they were compacted"))
+	watchEvents, _ = meter.Int64Counter("wireable.pool.watch.events",
+		metric.WithDescription("Pool changes applied by the watcher, by type"))
+	claimConflicts, _ = meter.Int64Counter("wireable.allocate.conflicts",
+		metric.WithDescription("Failed IP claims in AllocateIP, by reason"))
+)
+
+// RegisterHeapMetrics exports the number of IPs in ipHeap.
+func RegisterHeapMetrics(ipHeap *IPHeap) error {
+	size, err := meter.Int64ObservableGauge("wireable.pool.heap.size",
+		metric.WithDescription("Available IPs in the local heap"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(size, int64(ipHeap.Len()))
+		return nil
+	}, size)
+	return err
+}
@@ -0,0 +1,499 @@
+package allocator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+)
+
+const maxCASRetries = 5
+
+var (
+	ErrPeerNotFound  = errors.New("peer not found")
+	ErrQuotaExceeded = errors.New("peer quota exceeded")
+	ErrPoolExhausted = errors.New("no available IPs")
+)
+
+// PeerRecord is the value stored under /ip-pool/taken/<ip>.
+type PeerRecord = api.Peer
+
+func NewPeerRecord(publicKey, owner string) (*PeerRecord, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &PeerRecord{
+		ID:        hex.EncodeToString(id),
+		PublicKey: publicKey,
+		Owner:     owner,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// unsealedFields are never encrypted: the ID, IP and public key are needed to
+// allocate and look peers up, and expires_at to find expired peers, without
+// decrypting anything. status and last_heartbeat are not stored.
+var unsealedFields = []string{"id", "ip", "public_key", "expires_at", "status", "last_heartbeat"}
+
+// SealableFields returns the JSON names of the record fields that can be
+// encrypted at rest.
+func SealableFields() []string {
+	var fields []string
+	t := reflect.TypeOf(PeerRecord{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && !slices.Contains(unsealedFields, name) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// hasSealedValues reports whether any of the sealedFields of record is set.
+func hasSealedValues(record *PeerRecord) bool {
+	v := reflect.ValueOf(record).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if slices.Contains(sealedFields, name) && !v.Field(i).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// storedRecord is the layout of a taken value. Sealed holds the encrypted
+// sealedFields, which are then left out of the plain text.
+type storedRecord struct {
+	PeerRecord
+	Sealed string `json:"sealed,omitempty"`
+	// Bound is set when Sealed was encrypted with recordAAD. Records sealed
+	// before are read without it until RewrapRecords binds them.
+	Bound bool `json:"bound,omitempty"`
+}
+
+// recordAAD binds the sealed fields of a record to its ID and its IP, which
+// is the key the record is stored under.
+func recordAAD(id, ip string) []byte {
+	return []byte("peer/" + id + "/" + ip)
+}
+
+// aad returns the aad Sealed was encrypted with, nil when it is not bound.
+func (r *storedRecord) aad() []byte {
+	if !r.Bound {
+		return nil
+	}
+	return recordAAD(r.ID, r.IP)
+}
+
+// encodeRecord serializes record for etcd, sealing its sensitive fields when
+// encryption at rest is enabled.
+func encodeRecord(ctx context.Context, record *PeerRecord) ([]byte, error) {
+	stored := storedRecord{PeerRecord: *record}
+	stored.Status = nil
+	stored.LastHeartbeat = nil
+	if fieldCipher == nil {
+		return json.Marshal(stored)
+	}
+
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, err
+	}
+	sealed := make(map[string]json.RawMessage)
+	for _, name := range sealedFields {
+		if v, ok := fields[name]; ok {
+			sealed[name] = v
+			delete(fields, name)
+		}
+	}
+	plaintext, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := fieldCipher.Encrypt(ctx, plaintext, recordAAD(record.ID, record.IP))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt peer record: %w", err)
+	}
+	if fields["sealed"], err = json.Marshal(ciphertext); err != nil {
+		return nil, err
+	}
+	fields["bound"] = json.RawMessage("true")
+	return json.Marshal(fields)
+}
+
+// parseRecord parses a taken value without decrypting it. Values written
+// before records were introduced only hold the public key; those peers have
+// no owner and use their IP as ID.
+func parseRecord(ip string, value []byte) storedRecord {
+	var stored storedRecord
+	if err := json.Unmarshal(value, &stored); err != nil || stored.PublicKey == "" {
+		return storedRecord{PeerRecord: PeerRecord{ID: ip, IP: ip, PublicKey: string(value)}}
+	}
+	stored.IP = ip
+	return stored
+}
+
+// decodeRecords parses taken values and decrypts their sealed fields in a
+// single batch.
+func decodeRecords(ctx context.Context, ips []string, values [][]byte) ([]PeerRecord, error) {
+	stored := make([]storedRecord, len(values))
+	var ciphertexts []string
+	var aads [][]byte
+	var sealed []int
+	for i, value := range values {
+		stored[i] = parseRecord(ips[i], value)
+		if stored[i].Sealed != "" {
+			ciphertexts = append(ciphertexts, stored[i].Sealed)
+			aads = append(aads, stored[i].aad())
+			sealed = append(sealed, i)
+		}
+	}
+
+	if len(ciphertexts) > 0 {
+		if fieldCipher == nil {
+			return nil, errors.New("peer records are encrypted but PEER_ENCRYPTION is not set")
+		}
+		plaintexts, err := fieldCipher.Decrypt(ctx, ciphertexts, aads)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt peer records: %w", err)
+		}
+		for j, plaintext := range plaintexts {
+			// The fields sealed when the record was written, which need not
+			// be the ones configured now
+			if err := json.Unmarshal(plaintext, &stored[sealed[j]].PeerRecord); err != nil {
+				return nil, fmt.Errorf("corrupt sealed fields of peer %s: %w", stored[sealed[j]].ID, err)
+			}
+		}
+	}
+
+	records := make([]PeerRecord, len(stored))
+	for i := range stored {
+		records[i] = stored[i].PeerRecord
+	}
+	return records, nil
+}
+
+func decodeRecord(ctx context.Context, ip string, value []byte) (PeerRecord, error) {
+	records, err := decodeRecords(ctx, []string{ip}, [][]byte{value})
+	if err != nil {
+		return PeerRecord{}, err
+	}
+	return records[0], nil
+}
+
+// ListPeers returns every taken record.
+func ListPeers(ctx context.Context, store PoolStore) ([]PeerRecord, error) {
+	records, _, err := listPeers(ctx, store)
+	return records, err
+}
+
+func listPeers(ctx context.Context, store PoolStore) ([]PeerRecord, int64, error) {
+	entries, revision, err := store.Taken(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips := make([]string, len(entries))
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		ips[i] = entry.IP.String()
+		values[i] = entry.Value
+	}
+	records, err := decodeRecords(ctx, ips, values)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return bytesCompare(net.ParseIP(records[i].IP), net.ParseIP(records[j].IP)) < 0
+	})
+	return records, revision, nil
+}
+
+// ExpiredPeers returns the records whose ExpiresAt is before now. Only the
+// expired records are decrypted.
+func ExpiredPeers(ctx context.Context, store PoolStore, now time.Time) ([]PeerRecord, error) {
+	entries, _, err := store.Taken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	var values [][]byte
+	for _, entry := range entries {
+		record := parseRecord(entry.IP.String(), entry.Value)
+		if record.ExpiresAt != nil && record.ExpiresAt.Before(now) {
+			ips = append(ips, entry.IP.String())
+			values = append(values, entry.Value)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	return decodeRecords(ctx, ips, values)
+}
+
+// ownerKey is the key the peers of owner are counted under in the store. It
+// is a hash, so the count does not store the owner in plain text.
+func ownerKey(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ownerCount returns how many peers owner holds, or nil for peers without
+// an owner. The store keeps the count once the owner took a peer; until
+// then it is counted from the records.
+func ownerCount(ctx context.Context, store PoolStore, owner string) (*OwnerCount, error) {
+	if owner == "" {
+		return nil, nil
+	}
+	count, err := store.Owned(ctx, ownerKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	if count.Revision == 0 {
+		count.Count, count.TakenRevision, err = countOwned(ctx, store, owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &count, nil
+}
+
+// countOwned returns how many peers owner holds by reading every record, and
+// the revision the records were read at.
+func countOwned(ctx context.Context, store PoolStore, owner string) (int, int64, error) {
+	records, revision, err := listPeers(ctx, store)
+	if err != nil {
+		return 0, 0, err
+	}
+	owned := 0
+	for _, record := range records {
+		if record.Owner == owner {
+			owned++
+		}
+	}
+	return owned, revision, nil
+}
+
+// GetPeer looks a peer up by ID. Legacy peers are found by their IP.
+func GetPeer(ctx context.Context, store PoolStore, id string) (*PeerRecord, error) {
+	record, _, err := getPeer(ctx, store, id)
+	return record, err
+}
+
+func getPeer(ctx context.Context, store PoolStore, id string) (*PeerRecord, int64, error) {
+	ip, err := store.LookupID(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ip == nil {
+		ip = net.ParseIP(id)
+	}
+	if ip == nil {
+		return nil, 0, ErrPeerNotFound
+	}
+
+	entry, err := store.Get(ctx, ip)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry == nil {
+		return nil, 0, ErrPeerNotFound
+	}
+
+	record, err := decodeRecord(ctx, ip.String(), entry.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if record.ID != id {
+		return nil, 0, ErrPeerNotFound
+	}
+	return &record, entry.Revision, nil
+}
+
+// UpdatePeerKey replaces the public key of a peer, failing if the record
+// changed since it was read.
+func UpdatePeerKey(ctx context.Context, store PoolStore, id, publicKey string) (*PeerRecord, error) {
+	return UpdatePeer(ctx, store, id, func(record *PeerRecord) {
+		record.PublicKey = publicKey
+		now := time.Now().UTC()
+		record.RotatedAt = &now
+	})
+}
+
+// UpdatePeer applies update to the record of a peer and stores it, retrying
+// with the latest record when it changed concurrently.
+func UpdatePeer(ctx context.Context, store PoolStore, id string, update func(*PeerRecord)) (*PeerRecord, error) {
+	for attempt := 0; attempt < maxCASRetries; attempt++ {
+		record, revision, err := getPeer(ctx, store, id)
+		if err != nil {
+			return nil, err
+		}
+
+		update(record)
+		value, err := encodeRecord(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+
+		updated, err := store.Update(ctx, net.ParseIP(record.IP), value, revision)
+		if err != nil {
+			return nil, err
+		}
+		if updated {
+			return record, nil
+		}
+	}
+	return nil, fmt.Errorf("peer %s changed concurrently", id)
+}
+
+// Usage counts the addresses of a pool. Records are not decrypted.
+type Usage struct {
+	Available int
+	Taken     int
+	// Reserved counts reserved addresses that are neither available nor
+	// taken.
+	Reserved int
+	// Expiring counts taken addresses whose peer expires before the given
+	// time.
+	Expiring int
+}
+
+func PoolUsage(ctx context.Context, store PoolStore, reserved []net.IP, expiringBefore time.Time) (Usage, error) {
+	available, _, err := store.Available(ctx)
+	if err != nil {
+		return Usage{}, err
+	}
+	entries, _, err := store.Taken(ctx)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{Available: len(available), Taken: len(entries)}
+	seen := make(map[string]bool, len(available)+len(entries))
+	for _, ip := range available {
+		seen[ipKey(ip)] = true
+	}
+	for _, entry := range entries {
+		seen[ipKey(entry.IP)] = true
+		record := parseRecord(entry.IP.String(), entry.Value)
+		if record.ExpiresAt != nil && record.ExpiresAt.Before(expiringBefore) {
+			usage.Expiring++
+		}
+	}
+	for _, ip := range reserved {
+		if !seen[ipKey(ip)] {
+			usage.Reserved++
+		}
+	}
+	return usage, nil
+}
+
+// RewrapRecords moves the sealed fields of every peer record to the latest
+// key version and seals the fields of records that are stored in plain text,
+// e.g. written before encryption was enabled or before the field was added to
+// PEER_ENCRYPTED_FIELDS. It returns how many records were rewritten. Records
+// that change while it runs are skipped and picked up by the next run.
+func RewrapRecords(ctx context.Context, store PoolStore) (int, error) {
+	if fieldCipher == nil {
+		return 0, errors.New("PEER_ENCRYPTION is not set")
+	}
+
+	entries, _, err := store.Taken(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		entry TakenEntry
+		id    string
+		value []byte
+	}
+	var sealed, plain []TakenEntry
+	var ciphertexts, plainIPs []string
+	var aads, plainValues [][]byte
+	for _, entry := range entries {
+		stored := parseRecord(entry.IP.String(), entry.Value)
+		switch {
+		case hasSealedValues(&stored.PeerRecord), stored.Sealed != "" && !stored.Bound:
+			plain = append(plain, entry)
+			plainIPs = append(plainIPs, entry.IP.String())
+			plainValues = append(plainValues, entry.Value)
+		case stored.Sealed != "":
+			sealed = append(sealed, entry)
+			ciphertexts = append(ciphertexts, stored.Sealed)
+			aads = append(aads, stored.aad())
+		}
+	}
+
+	var updates []pending
+	if len(ciphertexts) > 0 {
+		rewrapped, err := fieldCipher.Rewrap(ctx, ciphertexts, aads)
+		if err != nil {
+			return 0, fmt.Errorf("failed to rewrap peer records: %w", err)
+		}
+		for i, entry := range sealed {
+			if rewrapped[i] == ciphertexts[i] {
+				continue
+			}
+			fields := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(entry.Value, &fields); err != nil {
+				return 0, err
+			}
+			if fields["sealed"], err = json.Marshal(rewrapped[i]); err != nil {
+				return 0, err
+			}
+			value, err := json.Marshal(fields)
+			if err != nil {
+				return 0, err
+			}
+			updates = append(updates, pending{entry: entry, id: parseRecord(entry.IP.String(), entry.Value).ID, value: value})
+		}
+	}
+	if len(plain) > 0 {
+		// Records that are already partly sealed, or sealed without being
+		// bound, are decrypted first, so every field ends up in the new
+		// ciphertext
+		records, err := decodeRecords(ctx, plainIPs, plainValues)
+		if err != nil {
+			return 0, err
+		}
+		for i := range records {
+			value, err := encodeRecord(ctx, &records[i])
+			if err != nil {
+				return 0, err
+			}
+			updates = append(updates, pending{entry: plain[i], id: records[i].ID, value: value})
+		}
+	}
+
+	rewritten := 0
+	for _, p := range updates {
+		updated, err := store.Update(ctx, p.entry.IP, p.value, p.entry.Revision)
+		if err != nil {
+			return rewritten, err
+		}
+		if !updated {
+			logger.WarnContext(ctx, "Peer changed while rewrapping, skipping it", "peer", p.id)
+			continue
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
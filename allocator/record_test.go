@@ -0,0 +1,179 @@
+package allocator
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useLocalCipher seals the owner of records with a local cipher holding the
+// given key versions, until the test ends.
+func useLocalCipher(t *testing.T, versions ...int) *localCipher {
+	t.Helper()
+	var lines []string
+	for _, v := range versions {
+		key := bytes.Repeat([]byte{byte(v)}, 32)
+		lines = append(lines, fmt.Sprintf("%d:%s", v, base64.StdEncoding.EncodeToString(key)))
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadLocalCipher(path)
+	if err != nil {
+		t.Fatalf("loadLocalCipher: %v", err)
+	}
+	SetCipher(c, []string{"owner"})
+	t.Cleanup(func() { SetCipher(nil, []string{"owner"}) })
+	return c
+}
+
+func testRecord(id, ip, owner string) *PeerRecord {
+	return &PeerRecord{ID: id, IP: ip, PublicKey: "key-" + id, Owner: owner}
+}
+
+func storedFields(t *testing.T, value []byte) storedRecord {
+	t.Helper()
+	var stored storedRecord
+	if err := json.Unmarshal(value, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestSealedRecordRoundTrip(t *testing.T) {
+	useLocalCipher(t, 1)
+	ctx := context.Background()
+
+	value, err := encodeRecord(ctx, testRecord("peer-a", "10.0.0.2", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(value, []byte("alice")) {
+		t.Fatalf("encoded record %s holds the owner in plain text", value)
+	}
+	if stored := storedFields(t, value); !stored.Bound || stored.Owner != "" || stored.Sealed == "" {
+		t.Fatalf("encoded record %s, want the owner sealed and bound", value)
+	}
+
+	record, err := decodeRecord(ctx, "10.0.0.2", value)
+	if err != nil {
+		t.Fatalf("decodeRecord: %v", err)
+	}
+	if record.ID != "peer-a" || record.Owner != "alice" || record.PublicKey != "key-peer-a" {
+		t.Fatalf("decodeRecord() = %+v, want peer-a of alice", record)
+	}
+
+	// The same value read at another IP, or with the sealed fields of
+	// another peer, does not decrypt
+	if _, err := decodeRecord(ctx, "10.0.0.3", value); !errors.Is(err, ErrWrongRecord) {
+		t.Fatalf("decodeRecord at another IP = %v, want ErrWrongRecord", err)
+	}
+	other, err := encodeRecord(ctx, testRecord("peer-b", "10.0.0.3", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(other, &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields["sealed"], _ = json.Marshal(storedFields(t, value).Sealed)
+	moved, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeRecord(ctx, "10.0.0.3", moved); !errors.Is(err, ErrWrongRecord) {
+		t.Fatalf("decodeRecord with moved sealed fields = %v, want ErrWrongRecord", err)
+	}
+
+	SetCipher(nil, []string{"owner"})
+	if _, err := decodeRecord(ctx, "10.0.0.2", value); err == nil {
+		t.Fatal("decodeRecord without a cipher succeeded, want an error")
+	}
+}
+
+func TestRewrapRecords(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	ips := poolIPs(3)
+	if err := store.AddAvailable(ctx, ips...); err != nil {
+		t.Fatal(err)
+	}
+	claim := func(record *PeerRecord, value []byte) {
+		t.Helper()
+		if res, err := store.Claim(ctx, net.ParseIP(record.IP), record.ID, value, nil); err != nil || res != ClaimOK {
+			t.Fatalf("Claim(%s) = %v, %v, want ok", record.ID, res, err)
+		}
+	}
+
+	// A record written before encryption at rest was enabled
+	plain := testRecord("peer-a", ips[0].String(), "alice")
+	value, err := encodeRecord(ctx, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim(plain, value)
+
+	old := useLocalCipher(t, 1)
+	// A record sealed with the old key
+	current := testRecord("peer-b", ips[1].String(), "bob")
+	if value, err = encodeRecord(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	claim(current, value)
+	// A record sealed with the old key before sealed fields were bound
+	unbound := testRecord("peer-c", ips[2].String(), "carol")
+	sealed, err := old.Encrypt(ctx, []byte(`{"owner":"carol"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err = json.Marshal(storedRecord{PeerRecord: PeerRecord{ID: unbound.ID, PublicKey: unbound.PublicKey}, Sealed: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	claim(unbound, value)
+
+	useLocalCipher(t, 1, 2)
+	rewritten, err := RewrapRecords(ctx, store)
+	if err != nil {
+		t.Fatalf("RewrapRecords: %v", err)
+	}
+	if rewritten != 3 {
+		t.Fatalf("RewrapRecords() = %d, want 3 records rewritten", rewritten)
+	}
+
+	entries, _, err := store.Taken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		stored := storedFields(t, entry.Value)
+		if !stored.Bound || stored.Owner != "" || !strings.HasPrefix(stored.Sealed, localPrefix+"2:") {
+			t.Fatalf("record at %s = %s, want it sealed with key 2 and bound", entry.IP, entry.Value)
+		}
+	}
+	records, err := ListPeers(ctx, store)
+	if err != nil {
+		t.Fatalf("ListPeers: %v", err)
+	}
+	owners := make(map[string]string)
+	for _, record := range records {
+		owners[record.ID] = record.Owner
+	}
+	for _, want := range []*PeerRecord{plain, current, unbound} {
+		if owners[want.ID] != want.Owner {
+			t.Fatalf("owner of %s = %q, want %q", want.ID, owners[want.ID], want.Owner)
+		}
+	}
+
+	if rewritten, err = RewrapRecords(ctx, store); err != nil || rewritten != 0 {
+		t.Fatalf("second RewrapRecords() = %d, %v, want nothing rewritten", rewritten, err)
+	}
+}
@@ -0,0 +1,282 @@
+package allocator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Zacky3181V/wireable/settings"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// PoolStore persists the IP pool and the peer records. Record values are
+// opaque to the store. Revisions increase with every write to the store, like
+// etcd revisions, and make conditional writes possible.
+type PoolStore interface {
+	// Available returns every IP that can be allocated and the revision
+	// they were read at.
+	Available(ctx context.Context) ([]net.IP, int64, error)
+	// AddAvailable adds ips to the pool, skipping the ones already available
+	// or taken.
+	AddAvailable(ctx context.Context, ips ...net.IP) error
+	// Taken returns every taken entry and the revision they were read at.
+	Taken(ctx context.Context) ([]TakenEntry, int64, error)
+	// Get returns the taken entry of ip, or nil if ip is not taken.
+	Get(ctx context.Context, ip net.IP) (*TakenEntry, error)
+	// LookupID returns the IP of the peer with the given ID, or nil.
+	LookupID(ctx context.Context, id string) (net.IP, error)
+	// Owned returns how many peers are counted against the owner key.
+	Owned(ctx context.Context, key string) (OwnerCount, error)
+	// Claim moves ip from the available to the taken set with value and
+	// indexes it under id. It fails with ClaimTaken if ip is not available.
+	// When owner is not nil the peer is counted against owner.Key, and the
+	// claim fails with ClaimConflict if the count changed since it was read.
+	Claim(ctx context.Context, ip net.IP, id string, value []byte, owner *OwnerCount) (ClaimResult, error)
+	// Update replaces the value of a taken entry if its revision still
+	// matches.
+	Update(ctx context.Context, ip net.IP, value []byte, revision int64) (bool, error)
+	// Release returns ip to the available set, drops the index of id and
+	// uncounts the peer from ownerKey, if set, when the taken entry's
+	// revision still matches.
+	Release(ctx context.Context, ip net.IP, id, ownerKey string, revision int64) (bool, error)
+	// Watch reports changes to the available set made after revision until
+	// ctx is done. The channel is closed when the watch ends, after an
+	// EventError whose Err is ErrCompacted if the changes since revision can
+	// no longer be replayed.
+	Watch(ctx context.Context, revision int64) <-chan PoolEvent
+	Close() error
+}
+
+// TakenEntry is a raw taken value and the revision it was last written at.
+type TakenEntry struct {
+	IP       net.IP
+	Value    []byte
+	Revision int64
+}
+
+// OwnerCount is the number of peers counted against an owner key. Revision
+// is the store revision the count was written at, or 0 when the store keeps
+// no count for the key yet. Count is then taken from the peer records, and
+// TakenRevision is the revision they were read at.
+type OwnerCount struct {
+	Key           string
+	Count         int
+	Revision      int64
+	TakenRevision int64
+}
+
+type ClaimResult int
+
+const (
+	ClaimOK ClaimResult = iota
+	// ClaimTaken means the IP is no longer available.
+	ClaimTaken
+	// ClaimConflict means the IP is still available but the count of the
+	// owner changed since it was read.
+	ClaimConflict
+)
+
+func (r ClaimResult) String() string {
+	switch r {
+	case ClaimOK:
+		return "ok"
+	case ClaimTaken:
+		return "taken"
+	case ClaimConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("ClaimResult(%d)", int(r))
+}
+
+type PoolEventType int
+
+const (
+	// EventAvailable means an IP was added or returned to the pool.
+	EventAvailable PoolEventType = iota
+	// EventRemoved means an IP was allocated or removed from the pool.
+	EventRemoved
+	// EventProgress means the store reached Revision without changes to
+	// the pool.
+	EventProgress
+	// EventError means the watch broke with Err.
+	EventError
+)
+
+type PoolEvent struct {
+	Type     PoolEventType
+	IP       net.IP
+	Revision int64
+	Err      error
+}
+
+// ErrCompacted is reported by a watch that cannot resume from the requested
+// revision. The pool has to be read again.
+var ErrCompacted = errors.New("watch revision is no longer available")
+
+// StoreConfig selects the PoolStore backend.
+type StoreConfig struct {
+	// Backend is "etcd" (default), "memory" or "bolt".
+	Backend string
+	// BoltPath is the database file of the bolt backend.
+	BoltPath string
+	// Reserved addresses are never handed out to peers.
+	Reserved []net.IP
+}
+
+func StoreConfigFrom(s *settings.Source) StoreConfig {
+	cfg := StoreConfig{
+		Backend:  s.String("POOL_STORE", "etcd"),
+		BoltPath: s.String("POOL_BOLT_PATH", "wireable.db"),
+	}
+	switch cfg.Backend {
+	case "etcd", "memory", "bolt":
+	default:
+		s.Invalid("POOL_STORE", cfg.Backend, errors.New("expected etcd, memory or bolt"))
+	}
+	for _, entry := range s.List("POOL_RESERVED") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			s.Invalid("POOL_RESERVED", entry, errors.New("not an IP address"))
+			continue
+		}
+		cfg.Reserved = append(cfg.Reserved, ip)
+	}
+	return cfg
+}
+
+// NeedsEtcd reports whether the backend keeps its data in etcd.
+func (cfg StoreConfig) NeedsEtcd() bool {
+	return cfg.Backend == "etcd"
+}
+
+// OpenStore opens the backend selected by cfg. cli is only used by the etcd
+// backend.
+func OpenStore(cfg StoreConfig, cli *clientv3.Client) (PoolStore, error) {
+	switch cfg.Backend {
+	case "etcd":
+		if cli == nil {
+			return nil, fmt.Errorf("etcd pool store needs an etcd client")
+		}
+		return NewEtcdStore(cli), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		return NewBoltStore(cfg.BoltPath)
+	default:
+		return nil, fmt.Errorf("unsupported POOL_STORE %q", cfg.Backend)
+	}
+}
+
+// SeedCIDR adds every host address of cidr to the pool except the first one,
+// which is kept for the server, and the reserved ones.
+func SeedCIDR(ctx context.Context, store PoolStore, cidr string, reserved []net.IP) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return fmt.Errorf("%s must be an IPv4 network of at most /30", cidr)
+	}
+
+	skip := make(map[string]bool, len(reserved))
+	for _, ip := range reserved {
+		skip[ipKey(ip)] = true
+	}
+
+	var ips []net.IP
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	size := uint32(1) << (bits - ones)
+	// Skip the network address, the server address and the broadcast address
+	for offset := uint32(2); offset < size-1; offset++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+offset)
+		if !skip[ipKey(ip)] {
+			ips = append(ips, ip)
+		}
+	}
+	return store.AddAvailable(ctx, ips...)
+}
+
+// watchHub fans events of the in-process stores out to their watchers. Every
+// watcher gets its own unbounded queue so a slow watcher never blocks writes.
+type watchHub struct {
+	mu   sync.Mutex
+	subs map[*watchQueue]struct{}
+}
+
+type watchQueue struct {
+	mu     sync.Mutex
+	events []PoolEvent
+	signal chan struct{}
+}
+
+// subscribe starts a watch from revision. The in-process stores keep no
+// history, so a watch that starts behind the store revision current gets
+// ErrCompacted. The caller must hold the store's write lock.
+func (h *watchHub) subscribe(ctx context.Context, revision, current int64) <-chan PoolEvent {
+	if revision < current {
+		out := make(chan PoolEvent, 1)
+		out <- PoolEvent{Type: EventError, Revision: current, Err: ErrCompacted}
+		close(out)
+		return out
+	}
+
+	q := &watchQueue{signal: make(chan struct{}, 1)}
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*watchQueue]struct{})
+	}
+	h.subs[q] = struct{}{}
+	h.mu.Unlock()
+
+	out := make(chan PoolEvent)
+	go func() {
+		defer close(out)
+		defer func() {
+			h.mu.Lock()
+			delete(h.subs, q)
+			h.mu.Unlock()
+		}()
+		for {
+			q.mu.Lock()
+			pending := q.events
+			q.events = nil
+			q.mu.Unlock()
+
+			for _, ev := range pending {
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-q.signal:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (h *watchHub) publish(events ...PoolEvent) {
+	if len(events) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for q := range h.subs {
+		q.mu.Lock()
+		q.events = append(q.events, events...)
+		q.mu.Unlock()
+		select {
+		case q.signal <- struct{}{}:
+		default:
+		}
+	}
+}
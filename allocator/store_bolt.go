@@ -0,0 +1,343 @@
+package allocator
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltAvailable = []byte("available")
+	boltTaken     = []byte("taken")
+	boltPeers     = []byte("peers")
+	boltMeta      = []byte("meta")
+	boltOwners    = []byte("owners")
+
+	boltRevisionKey  = []byte("revision")
+	boltLastTakenKey = []byte("last_taken")
+)
+
+// BoltStore keeps the pool in an embedded bbolt database for single node
+// deployments that do not run etcd. Taken values are prefixed with the
+// revision they were written at.
+type BoltStore struct {
+	db *bolt.DB
+	// mu orders publishing with commits so watchers see events in commit
+	// order.
+	mu  sync.Mutex
+	hub watchHub
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltAvailable, boltTaken, boltPeers, boltMeta, boltOwners} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func boltUint(value []byte) int64 {
+	if len(value) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func boltPutUint(b *bolt.Bucket, key []byte, n int64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(n))
+	return b.Put(key, buf)
+}
+
+// nextRevision increments the store revision within tx.
+func nextRevision(tx *bolt.Tx) (int64, error) {
+	meta := tx.Bucket(boltMeta)
+	revision := boltUint(meta.Get(boltRevisionKey)) + 1
+	return revision, boltPutUint(meta, boltRevisionKey, revision)
+}
+
+func putTaken(tx *bolt.Tx, ip net.IP, value []byte, revision int64) error {
+	buf := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf, uint64(revision))
+	copy(buf[8:], value)
+	if err := tx.Bucket(boltTaken).Put([]byte(ip.String()), buf); err != nil {
+		return err
+	}
+	return boltPutUint(tx.Bucket(boltMeta), boltLastTakenKey, revision)
+}
+
+// boltOwnerCount reads the count of key, stored as the count followed by the
+// revision it was written at.
+func boltOwnerCount(tx *bolt.Tx, key string) OwnerCount {
+	raw := tx.Bucket(boltOwners).Get([]byte(key))
+	if len(raw) < 16 {
+		return OwnerCount{Key: key}
+	}
+	return OwnerCount{Key: key, Count: int(boltUint(raw[:8])), Revision: boltUint(raw[8:])}
+}
+
+func boltPutOwnerCount(tx *bolt.Tx, key string, count int, revision int64) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	binary.BigEndian.PutUint64(buf[8:], uint64(revision))
+	return tx.Bucket(boltOwners).Put([]byte(key), buf)
+}
+
+func takenEntry(ip net.IP, raw []byte) *TakenEntry {
+	if len(raw) < 8 {
+		return nil
+	}
+	return &TakenEntry{IP: ip, Value: append([]byte(nil), raw[8:]...), Revision: boltUint(raw)}
+}
+
+func (s *BoltStore) Available(_ context.Context) ([]net.IP, int64, error) {
+	var ips []net.IP
+	var revision int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revision = boltUint(tx.Bucket(boltMeta).Get(boltRevisionKey))
+		return tx.Bucket(boltAvailable).ForEach(func(k, _ []byte) error {
+			if ip := net.ParseIP(string(k)); ip != nil {
+				ips = append(ips, ip)
+			}
+			return nil
+		})
+	})
+	return ips, revision, err
+}
+
+func (s *BoltStore) AddAvailable(_ context.Context, ips ...net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []PoolEvent
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		available, taken := tx.Bucket(boltAvailable), tx.Bucket(boltTaken)
+		for _, ip := range ips {
+			key := []byte(ip.String())
+			if available.Get(key) != nil || taken.Get(key) != nil {
+				continue
+			}
+			revision, err := nextRevision(tx)
+			if err != nil {
+				return err
+			}
+			if err := available.Put(key, []byte{}); err != nil {
+				return err
+			}
+			events = append(events, PoolEvent{Type: EventAvailable, IP: ip, Revision: revision})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.hub.publish(events...)
+	return nil
+}
+
+func (s *BoltStore) Taken(_ context.Context) ([]TakenEntry, int64, error) {
+	var entries []TakenEntry
+	var revision int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revision = boltUint(tx.Bucket(boltMeta).Get(boltRevisionKey))
+		return tx.Bucket(boltTaken).ForEach(func(k, v []byte) error {
+			ip := net.ParseIP(string(k))
+			if entry := takenEntry(ip, v); ip != nil && entry != nil {
+				entries = append(entries, *entry)
+			}
+			return nil
+		})
+	})
+	return entries, revision, err
+}
+
+func (s *BoltStore) Get(_ context.Context, ip net.IP) (*TakenEntry, error) {
+	var entry *TakenEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		entry = takenEntry(ip, tx.Bucket(boltTaken).Get([]byte(ip.String())))
+		return nil
+	})
+	return entry, err
+}
+
+func (s *BoltStore) LookupID(_ context.Context, id string) (net.IP, error) {
+	var ip net.IP
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltPeers).Get([]byte(id)); value != nil {
+			ip = net.ParseIP(string(value))
+		}
+		return nil
+	})
+	return ip, err
+}
+
+func (s *BoltStore) Owned(_ context.Context, key string) (OwnerCount, error) {
+	var count OwnerCount
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = boltOwnerCount(tx, key)
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltStore) Claim(_ context.Context, ip net.IP, id string, value []byte, owner *OwnerCount) (ClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := ClaimOK
+	var revision int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(ip.String())
+		available := tx.Bucket(boltAvailable)
+		if available.Get(key) == nil {
+			result = ClaimTaken
+			return nil
+		}
+		if owner != nil {
+			current := boltOwnerCount(tx, owner.Key)
+			changed := current.Revision != owner.Revision
+			if owner.Revision == 0 {
+				// The count was taken from the records, which must not have changed
+				changed = current.Revision != 0 || boltUint(tx.Bucket(boltMeta).Get(boltLastTakenKey)) > owner.TakenRevision
+			}
+			if changed {
+				result = ClaimConflict
+				return nil
+			}
+		}
+
+		var err error
+		if revision, err = nextRevision(tx); err != nil {
+			return err
+		}
+		if err := available.Delete(key); err != nil {
+			return err
+		}
+		if err := putTaken(tx, ip, value, revision); err != nil {
+			return err
+		}
+		if owner != nil {
+			if err := boltPutOwnerCount(tx, owner.Key, owner.Count+1, revision); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(boltPeers).Put([]byte(id), key)
+	})
+	if err != nil {
+		return ClaimTaken, err
+	}
+	if result == ClaimOK {
+		s.hub.publish(PoolEvent{Type: EventRemoved, IP: ip, Revision: revision})
+	}
+	return result, nil
+}
+
+func (s *BoltStore) Update(_ context.Context, ip net.IP, value []byte, revision int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		entry := takenEntry(ip, tx.Bucket(boltTaken).Get([]byte(ip.String())))
+		if entry == nil || entry.Revision != revision {
+			return nil
+		}
+		next, err := nextRevision(tx)
+		if err != nil {
+			return err
+		}
+		if err := putTaken(tx, ip, value, next); err != nil {
+			return err
+		}
+		updated = true
+		return nil
+	})
+	return updated, err
+}
+
+func (s *BoltStore) Release(_ context.Context, ip net.IP, id, ownerKey string, revision int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := false
+	var next int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(ip.String())
+		entry := takenEntry(ip, tx.Bucket(boltTaken).Get(key))
+		if entry == nil || entry.Revision != revision {
+			return nil
+		}
+
+		var err error
+		if next, err = nextRevision(tx); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltTaken).Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltPeers).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltAvailable).Put(key, []byte{}); err != nil {
+			return err
+		}
+		if err := boltPutUint(tx.Bucket(boltMeta), boltLastTakenKey, next); err != nil {
+			return err
+		}
+		// Without a count the peer is counted from the records later
+		if ownerKey != "" {
+			if count := boltOwnerCount(tx, ownerKey); count.Revision != 0 {
+				if err := boltPutOwnerCount(tx, ownerKey, max(count.Count-1, 0), next); err != nil {
+					return err
+				}
+			}
+		}
+		released = true
+		return nil
+	})
+	if err != nil || !released {
+		return false, err
+	}
+	s.hub.publish(PoolEvent{Type: EventAvailable, IP: ip, Revision: next})
+	return true, nil
+}
+
+// Watch only sees changes made through this process, which holds the only
+// handle on the database file.
+func (s *BoltStore) Watch(ctx context.Context, revision int64) <-chan PoolEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		current = boltUint(tx.Bucket(boltMeta).Get(boltRevisionKey))
+		return nil
+	})
+	if err != nil {
+		out := make(chan PoolEvent, 1)
+		out <- PoolEvent{Type: EventError, Err: err}
+		close(out)
+		return out
+	}
+	return s.hub.subscribe(ctx, revision, current)
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
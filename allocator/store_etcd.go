@@ -0,0 +1,292 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	availablePrefix = "/ip-pool/available/"
+	takenPrefix     = "/ip-pool/taken/"
+	peerIDPrefix    = "/ip-pool/peers/"
+	ownersPrefix    = "/ip-pool/owners/"
+	// lastReleaseKey is written by releases that find no count to update,
+	// since deleted taken keys do not show in prefix comparisons.
+	lastReleaseKey = "/ip-pool/last-release"
+)
+
+// EtcdStore keeps the pool in etcd, which lets several replicas share it.
+type EtcdStore struct {
+	cli *clientv3.Client
+}
+
+func NewEtcdStore(cli *clientv3.Client) *EtcdStore {
+	return &EtcdStore{cli: cli}
+}
+
+func availableKey(ip net.IP) string {
+	return availablePrefix + ip.String()
+}
+
+func takenKey(ip net.IP) string {
+	return takenPrefix + ip.String()
+}
+
+func peerIDKey(id string) string {
+	return peerIDPrefix + id
+}
+
+func ownerCountKey(key string) string {
+	return ownersPrefix + key
+}
+
+func (s *EtcdStore) Available(ctx context.Context) ([]net.IP, int64, error) {
+	resp, err := s.cli.Get(ctx, availablePrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips := make([]net.IP, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		ip := net.ParseIP(strings.TrimPrefix(key, availablePrefix))
+		if ip == nil {
+			logger.WarnContext(ctx, "Invalid IP in etcd key", "key", key)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips, resp.Header.Revision, nil
+}
+
+func (s *EtcdStore) AddAvailable(ctx context.Context, ips ...net.IP) error {
+	for _, ip := range ips {
+		_, err := s.cli.Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.CreateRevision(availableKey(ip)), "=", 0),
+				clientv3.Compare(clientv3.CreateRevision(takenKey(ip)), "=", 0),
+			).
+			Then(clientv3.OpPut(availableKey(ip), "")).
+			Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EtcdStore) Taken(ctx context.Context) ([]TakenEntry, int64, error) {
+	resp, err := s.cli.Get(ctx, takenPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]TakenEntry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ip := net.ParseIP(strings.TrimPrefix(string(kv.Key), takenPrefix))
+		if ip == nil {
+			continue
+		}
+		entries = append(entries, TakenEntry{IP: ip, Value: kv.Value, Revision: kv.ModRevision})
+	}
+	return entries, resp.Header.Revision, nil
+}
+
+func (s *EtcdStore) Get(ctx context.Context, ip net.IP) (*TakenEntry, error) {
+	resp, err := s.cli.Get(ctx, takenKey(ip))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return &TakenEntry{IP: ip, Value: resp.Kvs[0].Value, Revision: resp.Kvs[0].ModRevision}, nil
+}
+
+func (s *EtcdStore) LookupID(ctx context.Context, id string) (net.IP, error) {
+	resp, err := s.cli.Get(ctx, peerIDKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return net.ParseIP(string(resp.Kvs[0].Value)), nil
+}
+
+func (s *EtcdStore) Owned(ctx context.Context, key string) (OwnerCount, error) {
+	resp, err := s.cli.Get(ctx, ownerCountKey(key))
+	if err != nil {
+		return OwnerCount{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return OwnerCount{Key: key}, nil
+	}
+	count, err := strconv.Atoi(string(resp.Kvs[0].Value))
+	if err != nil {
+		return OwnerCount{}, fmt.Errorf("invalid peer count for owner %s: %w", key, err)
+	}
+	return OwnerCount{Key: key, Count: count, Revision: resp.Kvs[0].ModRevision}, nil
+}
+
+// ownerCmp returns the comparisons that hold while the count of owner is as
+// it was read. A count that is not kept yet was taken from the records, so no
+// peer may have been taken or released since.
+func ownerCmp(owner *OwnerCount) []clientv3.Cmp {
+	key := ownerCountKey(owner.Key)
+	if owner.Revision == 0 {
+		return []clientv3.Cmp{
+			clientv3.Compare(clientv3.Version(key), "=", 0),
+			clientv3.Compare(clientv3.ModRevision(takenPrefix), "<", owner.TakenRevision+1).WithPrefix(),
+			clientv3.Compare(clientv3.ModRevision(lastReleaseKey), "<", owner.TakenRevision+1),
+		}
+	}
+	return []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", owner.Revision)}
+}
+
+func (s *EtcdStore) Claim(ctx context.Context, ip net.IP, id string, value []byte, owner *OwnerCount) (ClaimResult, error) {
+	// The available key must still exist
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.Version(availableKey(ip)), ">", 0)}
+	ops := []clientv3.Op{
+		clientv3.OpDelete(availableKey(ip)),
+		clientv3.OpPut(takenKey(ip), string(value)),
+		clientv3.OpPut(peerIDKey(id), ip.String()),
+	}
+	if owner != nil {
+		cmps = append(cmps, ownerCmp(owner)...)
+		ops = append(ops, clientv3.OpPut(ownerCountKey(owner.Key), strconv.Itoa(owner.Count+1)))
+	}
+
+	resp, err := s.cli.Txn(ctx).If(cmps...).Then(ops...).
+		// Tells which comparison failed
+		Else(clientv3.OpGet(availableKey(ip), clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return ClaimTaken, err
+	}
+	if resp.Succeeded {
+		return ClaimOK, nil
+	}
+	if resp.Responses[0].GetResponseRange().Count == 0 {
+		return ClaimTaken, nil
+	}
+	return ClaimConflict, nil
+}
+
+func (s *EtcdStore) Update(ctx context.Context, ip net.IP, value []byte, revision int64) (bool, error) {
+	key := takenKey(ip)
+	resp, err := s.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *EtcdStore) Release(ctx context.Context, ip net.IP, id, ownerKey string, revision int64) (bool, error) {
+	key := takenKey(ip)
+	for attempt := 0; attempt < maxCASRetries; attempt++ {
+		cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", revision)}
+		ops := []clientv3.Op{
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(peerIDKey(id)),
+			clientv3.OpPut(availableKey(ip), ""),
+		}
+		if ownerKey != "" {
+			owner, err := s.Owned(ctx, ownerKey)
+			if err != nil {
+				return false, err
+			}
+			// Without a count the peer is counted from the records later
+			if owner.Revision > 0 {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(ownerCountKey(ownerKey)), "=", owner.Revision))
+				ops = append(ops, clientv3.OpPut(ownerCountKey(ownerKey), strconv.Itoa(max(owner.Count-1, 0))))
+			} else {
+				cmps = append(cmps, clientv3.Compare(clientv3.Version(ownerCountKey(ownerKey)), "=", 0))
+				ops = append(ops, clientv3.OpPut(lastReleaseKey, ""))
+			}
+		}
+
+		resp, err := s.cli.Txn(ctx).If(cmps...).Then(ops...).
+			Else(clientv3.OpGet(key, clientv3.WithKeysOnly())).
+			Commit()
+		if err != nil {
+			return false, err
+		}
+		if resp.Succeeded {
+			return true, nil
+		}
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 || kvs[0].ModRevision != revision {
+			return false, nil
+		}
+		// Only the count changed, another peer of the owner came or went
+	}
+	return false, fmt.Errorf("peer count of owner %s changed concurrently", ownerKey)
+}
+
+func (s *EtcdStore) Watch(ctx context.Context, revision int64) <-chan PoolEvent {
+	out := make(chan PoolEvent)
+	go func() {
+		defer close(out)
+		send := func(event PoolEvent) bool {
+			select {
+			case out <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Without a leader the member may be partitioned and never deliver
+		// events, break the watch instead
+		rch := s.cli.Watch(clientv3.WithRequireLeader(ctx), availablePrefix,
+			clientv3.WithPrefix(),
+			clientv3.WithRev(revision+1),
+			clientv3.WithProgressNotify())
+		for wresp := range rch {
+			if wresp.CompactRevision != 0 {
+				send(PoolEvent{Type: EventError, Revision: wresp.CompactRevision, Err: ErrCompacted})
+				return
+			}
+			if err := wresp.Err(); err != nil {
+				send(PoolEvent{Type: EventError, Err: err})
+				return
+			}
+			if wresp.IsProgressNotify() {
+				if !send(PoolEvent{Type: EventProgress, Revision: wresp.Header.Revision}) {
+					return
+				}
+				continue
+			}
+
+			for _, ev := range wresp.Events {
+				ip := net.ParseIP(strings.TrimPrefix(string(ev.Kv.Key), availablePrefix))
+				if ip == nil {
+					continue
+				}
+				event := PoolEvent{Type: EventAvailable, IP: ip, Revision: ev.Kv.ModRevision}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = EventRemoved
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Close leaves the etcd client open, it is shared with the rest of the
+// service.
+func (s *EtcdStore) Close() error {
+	return nil
+}
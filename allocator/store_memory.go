@@ -0,0 +1,188 @@
+package allocator
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MemoryStore keeps the pool in process memory. It is meant for tests and
+// single node development; everything is lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	revision  int64
+	lastTaken int64
+	available map[string]struct{}
+	taken     map[string]TakenEntry
+	ids       map[string]string
+	owners    map[string]OwnerCount
+	hub       watchHub
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		available: make(map[string]struct{}),
+		taken:     make(map[string]TakenEntry),
+		ids:       make(map[string]string),
+		owners:    make(map[string]OwnerCount),
+	}
+}
+
+func (s *MemoryStore) Available(_ context.Context) ([]net.IP, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ips := make([]net.IP, 0, len(s.available))
+	for ip := range s.available {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, s.revision, nil
+}
+
+func (s *MemoryStore) AddAvailable(_ context.Context, ips ...net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []PoolEvent
+	for _, ip := range ips {
+		key := ip.String()
+		if _, ok := s.available[key]; ok {
+			continue
+		}
+		if _, ok := s.taken[key]; ok {
+			continue
+		}
+		s.revision++
+		s.available[key] = struct{}{}
+		events = append(events, PoolEvent{Type: EventAvailable, IP: ip, Revision: s.revision})
+	}
+	s.hub.publish(events...)
+	return nil
+}
+
+func (s *MemoryStore) Taken(_ context.Context) ([]TakenEntry, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]TakenEntry, 0, len(s.taken))
+	for _, entry := range s.taken {
+		entries = append(entries, entry)
+	}
+	return entries, s.revision, nil
+}
+
+func (s *MemoryStore) Get(_ context.Context, ip net.IP) (*TakenEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.taken[ip.String()]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (s *MemoryStore) LookupID(_ context.Context, id string) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ip, ok := s.ids[id]; ok {
+		return net.ParseIP(ip), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Owned(_ context.Context, key string) (OwnerCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if count, ok := s.owners[key]; ok {
+		return count, nil
+	}
+	return OwnerCount{Key: key}, nil
+}
+
+// ownerChanged reports whether the count of owner changed since it was read.
+// The caller must hold s.mu.
+func (s *MemoryStore) ownerChanged(owner *OwnerCount) bool {
+	current, kept := s.owners[owner.Key]
+	if owner.Revision == 0 {
+		return kept || s.lastTaken > owner.TakenRevision
+	}
+	return current.Revision != owner.Revision
+}
+
+func (s *MemoryStore) Claim(_ context.Context, ip net.IP, id string, value []byte, owner *OwnerCount) (ClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if _, ok := s.available[key]; !ok {
+		return ClaimTaken, nil
+	}
+	if owner != nil && s.ownerChanged(owner) {
+		return ClaimConflict, nil
+	}
+
+	s.revision++
+	delete(s.available, key)
+	s.taken[key] = TakenEntry{IP: ip, Value: append([]byte(nil), value...), Revision: s.revision}
+	s.ids[id] = key
+	s.lastTaken = s.revision
+	if owner != nil {
+		s.owners[owner.Key] = OwnerCount{Key: owner.Key, Count: owner.Count + 1, Revision: s.revision}
+	}
+	s.hub.publish(PoolEvent{Type: EventRemoved, IP: ip, Revision: s.revision})
+	return ClaimOK, nil
+}
+
+func (s *MemoryStore) Update(_ context.Context, ip net.IP, value []byte, revision int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	entry, ok := s.taken[key]
+	if !ok || entry.Revision != revision {
+		return false, nil
+	}
+
+	s.revision++
+	entry.Value = append([]byte(nil), value...)
+	entry.Revision = s.revision
+	s.taken[key] = entry
+	s.lastTaken = s.revision
+	return true, nil
+}
+
+func (s *MemoryStore) Release(_ context.Context, ip net.IP, id, ownerKey string, revision int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	entry, ok := s.taken[key]
+	if !ok || entry.Revision != revision {
+		return false, nil
+	}
+
+	s.revision++
+	delete(s.taken, key)
+	delete(s.ids, id)
+	s.available[key] = struct{}{}
+	s.lastTaken = s.revision
+	// Without a count the peer is counted from the records later
+	if count, ok := s.owners[ownerKey]; ok {
+		s.owners[ownerKey] = OwnerCount{Key: ownerKey, Count: max(count.Count-1, 0), Revision: s.revision}
+	}
+	s.hub.publish(PoolEvent{Type: EventAvailable, IP: ip, Revision: s.revision})
+	return true, nil
+}
+
+func (s *MemoryStore) Watch(ctx context.Context, revision int64) <-chan PoolEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hub.subscribe(ctx, revision, s.revision)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,339 @@
+package allocator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zacky3181V/wireable/internal/etcdtest"
+)
+
+// eachStore runs test against every PoolStore backend, so they all keep the
+// same contract.
+func eachStore(t *testing.T, test func(t *testing.T, store PoolStore)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) PoolStore
+	}{
+		{"memory", func(t *testing.T) PoolStore {
+			return NewMemoryStore()
+		}},
+		{"bolt", func(t *testing.T) PoolStore {
+			store, err := NewBoltStore(filepath.Join(t.TempDir(), "pool.db"))
+			if err != nil {
+				t.Fatalf("NewBoltStore: %v", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		}},
+		{"etcd", func(t *testing.T) PoolStore {
+			if testing.Short() {
+				t.Skip("starts an etcd server")
+			}
+			return NewEtcdStore(etcdtest.New(t))
+		}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+// nextEvent returns the next event of ch that is not a progress report, or
+// fails the test if none comes. ok is false when ch was closed.
+func nextEvent(t *testing.T, ch <-chan PoolEvent) (ev PoolEvent, ok bool) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev, ok = <-ch:
+			if ok && ev.Type == EventProgress {
+				continue
+			}
+			return ev, ok
+		case <-timeout:
+			t.Fatal("no watch event")
+		}
+	}
+}
+
+func mustGet(t *testing.T, store PoolStore, ip net.IP) *TakenEntry {
+	t.Helper()
+	entry, err := store.Get(context.Background(), ip)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", ip, err)
+	}
+	if entry == nil {
+		t.Fatalf("Get(%s) = nil, want the taken entry", ip)
+	}
+	return entry
+}
+
+func TestStoreClaimRelease(t *testing.T) {
+	eachStore(t, func(t *testing.T, store PoolStore) {
+		ctx := context.Background()
+		ips := poolIPs(3)
+		if err := store.AddAvailable(ctx, ips...); err != nil {
+			t.Fatal(err)
+		}
+
+		if res, err := store.Claim(ctx, ips[0], "peer-a", []byte("a"), nil); err != nil || res != ClaimOK {
+			t.Fatalf("Claim(%s) = %v, %v, want ok", ips[0], res, err)
+		}
+		if res, err := store.Claim(ctx, ips[0], "peer-b", []byte("b"), nil); err != nil || res != ClaimTaken {
+			t.Fatalf("second Claim(%s) = %v, %v, want taken", ips[0], res, err)
+		}
+		// Neither a taken nor an available IP is added twice
+		if err := store.AddAvailable(ctx, ips...); err != nil {
+			t.Fatal(err)
+		}
+		if available, _, err := store.Available(ctx); err != nil || len(available) != 2 {
+			t.Fatalf("Available() = %v, %v, want 2 IPs", available, err)
+		}
+
+		entry := mustGet(t, store, ips[0])
+		if !bytes.Equal(entry.Value, []byte("a")) {
+			t.Fatalf("Get(%s).Value = %q, want %q", ips[0], entry.Value, "a")
+		}
+		if ip, err := store.LookupID(ctx, "peer-a"); err != nil || !ip.Equal(ips[0]) {
+			t.Fatalf("LookupID(peer-a) = %v, %v, want %s", ip, err, ips[0])
+		}
+		if entry, err := store.Get(ctx, ips[1]); err != nil || entry != nil {
+			t.Fatalf("Get(%s) = %v, %v, want nil", ips[1], entry, err)
+		}
+
+		if ok, err := store.Update(ctx, ips[0], []byte("a2"), entry.Revision-1); err != nil || ok {
+			t.Fatalf("Update with a stale revision = %v, %v, want false", ok, err)
+		}
+		if ok, err := store.Update(ctx, ips[0], []byte("a2"), entry.Revision); err != nil || !ok {
+			t.Fatalf("Update = %v, %v, want true", ok, err)
+		}
+		updated := mustGet(t, store, ips[0])
+		if !bytes.Equal(updated.Value, []byte("a2")) || updated.Revision <= entry.Revision {
+			t.Fatalf("Get(%s) after Update = %q at %d, want %q after %d",
+				ips[0], updated.Value, updated.Revision, "a2", entry.Revision)
+		}
+
+		if ok, err := store.Release(ctx, ips[0], "peer-a", "", entry.Revision); err != nil || ok {
+			t.Fatalf("Release with a stale revision = %v, %v, want false", ok, err)
+		}
+		if ok, err := store.Release(ctx, ips[0], "peer-a", "", updated.Revision); err != nil || !ok {
+			t.Fatalf("Release = %v, %v, want true", ok, err)
+		}
+		if ip, err := store.LookupID(ctx, "peer-a"); err != nil || ip != nil {
+			t.Fatalf("LookupID(peer-a) after Release = %v, %v, want nil", ip, err)
+		}
+		if taken, _, err := store.Taken(ctx); err != nil || len(taken) != 0 {
+			t.Fatalf("Taken() after Release = %v, %v, want none", taken, err)
+		}
+		if available, _, err := store.Available(ctx); err != nil || len(available) != 3 {
+			t.Fatalf("Available() after Release = %v, %v, want 3 IPs", available, err)
+		}
+	})
+}
+
+func TestStoreClaimReleaseRace(t *testing.T) {
+	const racers = 16
+	eachStore(t, func(t *testing.T, store PoolStore) {
+		ctx := context.Background()
+		ip := poolIPs(1)[0]
+		if err := store.AddAvailable(ctx, ip); err != nil {
+			t.Fatal(err)
+		}
+
+		results := make([]ClaimResult, racers)
+		errs := make([]error, racers)
+		var wg sync.WaitGroup
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], errs[i] = store.Claim(ctx, ip, fmt.Sprintf("peer-%d", i), []byte{byte(i)}, nil)
+			}()
+		}
+		wg.Wait()
+
+		winner := -1
+		for i := range racers {
+			if errs[i] != nil {
+				t.Fatalf("Claim of racer %d: %v", i, errs[i])
+			}
+			switch results[i] {
+			case ClaimOK:
+				if winner >= 0 {
+					t.Fatalf("racers %d and %d both claimed %s", winner, i, ip)
+				}
+				winner = i
+			case ClaimTaken:
+			default:
+				t.Fatalf("Claim of racer %d = %v, want ok or taken", i, results[i])
+			}
+		}
+		if winner < 0 {
+			t.Fatalf("no racer claimed %s", ip)
+		}
+		entry := mustGet(t, store, ip)
+		if !bytes.Equal(entry.Value, []byte{byte(winner)}) {
+			t.Fatalf("Get(%s).Value = %v, want the winner's %d", ip, entry.Value, winner)
+		}
+
+		released := make([]bool, racers)
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				released[i], errs[i] = store.Release(ctx, ip, fmt.Sprintf("peer-%d", winner), "", entry.Revision)
+			}()
+		}
+		wg.Wait()
+		count := 0
+		for i := range racers {
+			if errs[i] != nil {
+				t.Fatalf("Release of racer %d: %v", i, errs[i])
+			}
+			if released[i] {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Fatalf("%d racers released %s, want 1", count, ip)
+		}
+	})
+}
+
+func TestStoreOwnerCounts(t *testing.T) {
+	const racers = 8
+	eachStore(t, func(t *testing.T, store PoolStore) {
+		ctx := context.Background()
+		ips := poolIPs(racers + 2)
+		if err := store.AddAvailable(ctx, ips...); err != nil {
+			t.Fatal(err)
+		}
+
+		// No count is kept before the first claim, it comes from the records
+		owner, err := store.Owned(ctx, "alice")
+		if err != nil || owner.Count != 0 || owner.Revision != 0 {
+			t.Fatalf("Owned(alice) = %+v, %v, want no count", owner, err)
+		}
+		_, owner.TakenRevision, err = store.Taken(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uncounted := owner
+		if res, err := store.Claim(ctx, ips[0], "peer-0", nil, &owner); err != nil || res != ClaimOK {
+			t.Fatalf("Claim(%s) for alice = %v, %v, want ok", ips[0], res, err)
+		}
+		if owner, err = store.Owned(ctx, "alice"); err != nil || owner.Count != 1 || owner.Revision == 0 {
+			t.Fatalf("Owned(alice) = %+v, %v, want a count of 1", owner, err)
+		}
+		if res, err := store.Claim(ctx, ips[1], "peer-1", nil, &uncounted); err != nil || res != ClaimConflict {
+			t.Fatalf("Claim(%s) with the count read before = %v, %v, want conflict", ips[1], res, err)
+		}
+
+		// Of the claims made with the same count only one wins, even for
+		// different IPs
+		results := make([]ClaimResult, racers)
+		errs := make([]error, racers)
+		var wg sync.WaitGroup
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				read := owner
+				results[i], errs[i] = store.Claim(ctx, ips[i+1], fmt.Sprintf("peer-%d", i+1), nil, &read)
+			}()
+		}
+		wg.Wait()
+		won := 0
+		for i := range racers {
+			if errs[i] != nil {
+				t.Fatalf("Claim of racer %d: %v", i, errs[i])
+			}
+			switch results[i] {
+			case ClaimOK:
+				won++
+			case ClaimConflict:
+			default:
+				t.Fatalf("Claim of racer %d = %v, want ok or conflict", i, results[i])
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d racers claimed with the same count, want 1", won)
+		}
+		if owner, err = store.Owned(ctx, "alice"); err != nil || owner.Count != 2 {
+			t.Fatalf("Owned(alice) = %+v, %v, want a count of 2", owner, err)
+		}
+
+		entry := mustGet(t, store, ips[0])
+		if ok, err := store.Release(ctx, ips[0], "peer-0", "alice", entry.Revision); err != nil || !ok {
+			t.Fatalf("Release(%s) for alice = %v, %v, want true", ips[0], ok, err)
+		}
+		if owner, err = store.Owned(ctx, "alice"); err != nil || owner.Count != 1 {
+			t.Fatalf("Owned(alice) after Release = %+v, %v, want a count of 1", owner, err)
+		}
+	})
+}
+
+func TestStoreWatchResume(t *testing.T) {
+	eachStore(t, func(t *testing.T, store PoolStore) {
+		ctx := context.Background()
+		ips := poolIPs(2)
+		_, start, err := store.Available(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		watchCtx, cancel := context.WithCancel(ctx)
+		ch := store.Watch(watchCtx, start)
+		if err := store.AddAvailable(ctx, ips[0]); err != nil {
+			t.Fatal(err)
+		}
+		added, _ := nextEvent(t, ch)
+		if added.Type != EventAvailable || !added.IP.Equal(ips[0]) || added.Revision <= start {
+			t.Fatalf("event after AddAvailable = %+v, want %s available after %d", added, ips[0], start)
+		}
+		if res, err := store.Claim(ctx, ips[0], "peer-0", nil, nil); err != nil || res != ClaimOK {
+			t.Fatalf("Claim(%s) = %v, %v, want ok", ips[0], res, err)
+		}
+		removed, _ := nextEvent(t, ch)
+		if removed.Type != EventRemoved || !removed.IP.Equal(ips[0]) || removed.Revision <= added.Revision {
+			t.Fatalf("event after Claim = %+v, want %s removed after %d", removed, ips[0], added.Revision)
+		}
+		cancel()
+
+		// A watch resumed from the last event sees only what came after it
+		watchCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		ch = store.Watch(watchCtx, removed.Revision)
+		if err := store.AddAvailable(ctx, ips[1]); err != nil {
+			t.Fatal(err)
+		}
+		resumed, _ := nextEvent(t, ch)
+		if resumed.Type != EventAvailable || !resumed.IP.Equal(ips[1]) || resumed.Revision <= removed.Revision {
+			t.Fatalf("first event after resuming = %+v, want %s available after %d", resumed, ips[1], removed.Revision)
+		}
+
+		// A watch from further back either replays the changes or tells
+		// the pool has to be read again
+		ch = store.Watch(watchCtx, start)
+		first, _ := nextEvent(t, ch)
+		switch {
+		case first.Type == EventError:
+			if !errors.Is(first.Err, ErrCompacted) {
+				t.Fatalf("watch from %d failed with %v, want ErrCompacted", start, first.Err)
+			}
+			if ev, ok := nextEvent(t, ch); ok {
+				t.Fatalf("event after ErrCompacted = %+v, want the channel closed", ev)
+			}
+		case first.Type != EventAvailable || !first.IP.Equal(ips[0]) || first.Revision != added.Revision:
+			t.Fatalf("first event replayed from %d = %+v, want %+v", start, first, added)
+		}
+	})
+}
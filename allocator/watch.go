@@ -0,0 +1,35 @@
+package allocator
+
+import (
+	"sync"
+	"time"
+)
+
+// WatcherStatus describes the pool watcher of this replica. Watching is false
+// while it is reading the pool or waiting to resume a broken watch.
+type WatcherStatus struct {
+	Running   bool       `json:"running"`
+	Watching  bool       `json:"watching"`
+	Revision  int64      `json:"revision"`
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	LastEvent *time.Time `json:"last_event,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	watchStatusMu sync.RWMutex
+	watchStatus   WatcherStatus
+)
+
+// Watcher returns the state of WatchAvailableIPs.
+func Watcher() WatcherStatus {
+	watchStatusMu.RLock()
+	defer watchStatusMu.RUnlock()
+	return watchStatus
+}
+
+func updateWatcher(update func(*WatcherStatus)) {
+	watchStatusMu.Lock()
+	defer watchStatusMu.Unlock()
+	update(&watchStatus)
+}
@@ -0,0 +1,172 @@
+// Package api holds the request and response types of the HTTP API. The
+// server and its clients share them, so both sides always agree on the wire
+// format.
+package api
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PeerIDHeader carries the ID of the peer whose config is returned.
+const PeerIDHeader = "X-Peer-Id"
+
+// NextCursorHeader carries the cursor of the next page of a paginated list.
+// It is absent on the last page.
+const NextCursorHeader = "X-Next-Cursor"
+
+// Error is the body of every failed request.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Credentials is the body of a login request.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Token is returned by a successful login.
+type Token struct {
+	Token string `json:"token"`
+}
+
+// Peer is a WireGuard client with an address from the pool.
+type Peer struct {
+	ID        string     `json:"id"`
+	IP        string     `json:"ip"`
+	PublicKey string     `json:"public_key"`
+	Owner     string     `json:"owner"`
+	Profile   string     `json:"profile,omitempty"`
+	Escrowed  bool       `json:"escrowed,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// LastHeartbeat is when the agent managing the peer last called in. It
+	// is added by the API, it is not stored with the peer.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// Status is added by the API from the status collector, it is not
+	// stored with the peer.
+	Status *PeerStatus `json:"status,omitempty"`
+}
+
+const (
+	PeerOnline  = "online"
+	PeerOffline = "offline"
+)
+
+// PeerStatus is whether the peer is connected, judged by its latest
+// handshake with the server.
+type PeerStatus struct {
+	State string `json:"state"`
+	// Since is when the peer went online or offline.
+	Since         time.Time  `json:"since"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	// ReceiveBytes and TransmitBytes are the traffic counters of the device
+	// at the latest handshake.
+	ReceiveBytes  int64 `json:"receive_bytes"`
+	TransmitBytes int64 `json:"transmit_bytes"`
+}
+
+const (
+	EventPeerCreated = "peer.created"
+	EventPeerRotated = "peer.rotated"
+	EventPeerRevoked = "peer.revoked"
+	EventPeerExpired = "peer.expired"
+	EventPeerOnline  = "peer.online"
+	EventPeerOffline = "peer.offline"
+)
+
+// Event is a change in the lifecycle of a peer, sent to webhooks and the
+// event stream.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Actor is the user that caused the event, or the background task.
+	Actor   string            `json:"actor"`
+	Peer    Peer              `json:"peer"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// DeadLetter is an event a webhook did not accept after every retry.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	URL      string    `json:"url"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// EnrollRequest enrolls a peer whose private key is kept by the caller.
+type EnrollRequest struct {
+	PublicKey string `json:"public_key"`
+	Profile   string `json:"profile,omitempty"`
+}
+
+// KeyUpdate replaces the public key of a peer.
+type KeyUpdate struct {
+	PublicKey string `json:"public_key"`
+}
+
+// PeerSettings is everything a peer needs to configure its interface, apart
+// from its private key.
+type PeerSettings struct {
+	Peer Peer `json:"peer"`
+	// Address is the IP of the peer with the prefix length of the tunnel
+	// network, e.g. 10.0.0.7/24.
+	Address             string `json:"address"`
+	ServerPublicKey     string `json:"server_public_key"`
+	Endpoint            string `json:"endpoint"`
+	AllowedIPs          string `json:"allowed_ips"`
+	DNS                 string `json:"dns"`
+	PersistentKeepalive int    `json:"persistent_keepalive"`
+}
+
+var validProfileName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Profile holds the client side settings rendered into a peer config.
+type Profile struct {
+	Name                string `json:"name"`
+	DNS                 string `json:"dns"`
+	Endpoint            string `json:"endpoint"`
+	AllowedIPs          string `json:"allowed_ips"`
+	PersistentKeepalive int    `json:"persistent_keepalive"`
+	// EscrowPrivateKey keeps a copy of the generated client private key in
+	// Vault so the config can be downloaded again.
+	EscrowPrivateKey bool `json:"escrow_private_key"`
+}
+
+func (p Profile) Validate() error {
+	if !validProfileName.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	if strings.TrimSpace(p.Endpoint) == "" {
+		return errors.New("endpoint is required")
+	}
+	if strings.TrimSpace(p.AllowedIPs) == "" {
+		return errors.New("allowed_ips is required")
+	}
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		return errors.New("persistent_keepalive must be between 0 and 65535")
+	}
+	return nil
+}
+
+// PoolStats is a snapshot of a pool. Utilization is the percentage of
+// allocatable addresses that are taken; reserved addresses are not
+// allocatable.
+type PoolStats struct {
+	Name        string    `json:"name"`
+	Total       int       `json:"total"`
+	Available   int       `json:"available"`
+	Taken       int       `json:"taken"`
+	Reserved    int       `json:"reserved"`
+	Expiring    int       `json:"expiring"`
+	Utilization float64   `json:"utilization"`
+	Time        time.Time `json:"time"`
+}
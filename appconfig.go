@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/authentication"
+	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/generator"
+	"github.com/Zacky3181V/wireable/health"
+	"github.com/Zacky3181V/wireable/logging"
+	"github.com/Zacky3181V/wireable/metrics"
+	"github.com/Zacky3181V/wireable/peerstatus"
+	"github.com/Zacky3181V/wireable/pools"
+	"github.com/Zacky3181V/wireable/ratelimit"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/telemetry"
+	"github.com/Zacky3181V/wireable/tlsserver"
+	"github.com/Zacky3181V/wireable/vaultclient"
+)
+
+// Config is the whole configuration of the server. It is loaded and checked
+// once at startup, before anything is started.
+type Config struct {
+	ListenAddress   string
+	ShutdownTimeout time.Duration
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For
+	// header is believed. With none the client IP is the peer address.
+	TrustedProxies []string
+
+	Log       logging.Config
+	Telemetry telemetry.Config
+	Metrics   metrics.Config
+	Health    health.Config
+	Audit     audit.Config
+	Server    config.Config
+	Vault     vaultclient.Config
+	Secrets   vaultclient.SecretPaths
+	Cipher    allocator.CipherConfig
+	Keys      authentication.KeyConfig
+	Roles     authentication.RoleConfig
+	RateLimit ratelimit.Config
+	Peers     generator.Config
+	Pools     pools.Config
+	Status    peerstatus.Config
+	Events    events.Config
+	TLS       tlsserver.Config
+}
+
+// loadConfig reads the configuration from args, the environment and the
+// config file, and reports every invalid setting at once.
+func loadConfig(args []string) (Config, error) {
+	s, err := settings.Load(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		ListenAddress:   s.String("LISTEN_ADDRESS", ":8081"),
+		ShutdownTimeout: s.Duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		TrustedProxies:  s.List("TRUSTED_PROXIES"),
+		Log:             logging.ConfigFrom(s),
+		Telemetry:       telemetry.ConfigFrom(s),
+		Metrics:         metrics.ConfigFrom(s),
+		Health:          health.ConfigFrom(s),
+		Server:          config.ConfigFrom(s),
+		Vault:           vaultclient.ConfigFrom(s),
+		Secrets:         vaultclient.SecretPathsFrom(s),
+		Cipher:          allocator.CipherConfigFrom(s),
+		Keys:            authentication.KeyConfigFrom(s),
+		Roles:           authentication.RoleConfigFrom(s),
+		RateLimit:       ratelimit.ConfigFrom(s),
+		Peers:           generator.ConfigFrom(s),
+		Status:          peerstatus.ConfigFrom(s),
+		Events:          events.ConfigFrom(s),
+		TLS:             tlsserver.ConfigFrom(s),
+	}
+	cfg.Pools = pools.ConfigFrom(s, cfg.Server.Store)
+	cfg.Audit = audit.ConfigFrom(s, len(cfg.Server.EtcdEndpoints) > 0)
+	if cfg.ShutdownTimeout <= 0 {
+		s.Invalid("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout.String(), errors.New("must be positive"))
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			s.Invalid("TRUSTED_PROXIES", proxy, errors.New("expected an IP address or CIDR"))
+		}
+	}
+	return cfg, s.Err()
+}
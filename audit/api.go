@@ -0,0 +1,239 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	verifyPageSize    = 500
+)
+
+type VerifyResult struct {
+	Valid     bool   `json:"valid"`
+	Entries   uint64 `json:"entries"`
+	BrokenSeq uint64 `json:"broken_seq,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// @Summary Query audit log
+// @Description Returns audit entries, newest first. Requires the admin role.
+// @ID audit-query
+// @Produce json
+// @Security BearerAuth
+// @Param actor query string false "Actor"
+// @Param action query string false "Action, e.g. login or peer.allocate"
+// @Param result query string false "success, failure or denied"
+// @Param target query string false "Target, e.g. a peer ID"
+// @Param since query string false "RFC 3339 lower bound"
+// @Param until query string false "RFC 3339 upper bound"
+// @Param limit query int false "Maximum number of entries (default 100)"
+// @Success 200 {array} Entry
+// @Failure 400
+// @Failure 403
+// @Failure 500
+// @Failure 503
+// @Router /audit [get]
+func QueryHandler(c *gin.Context) {
+	limit := defaultQueryLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxQueryLimit)
+	}
+
+	var since, until time.Time
+	for name, bound := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+				return
+			}
+			*bound = t
+		}
+	}
+
+	match := func(e Entry) bool {
+		return (c.Query("actor") == "" || e.Actor == c.Query("actor")) &&
+			(c.Query("action") == "" || e.Action == c.Query("action")) &&
+			(c.Query("result") == "" || e.Result == c.Query("result")) &&
+			(c.Query("target") == "" || e.Target == c.Query("target")) &&
+			(since.IsZero() || !e.Time.Before(since)) &&
+			(until.IsZero() || !e.Time.After(until))
+	}
+
+	entries, err := query(c.Request.Context(), match, limit)
+	if errors.Is(err, ErrDisabled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Audit log is disabled"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to query audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// query walks the log from the newest entry backwards in pages until limit
+// matching entries are found.
+func query(ctx context.Context, match func(Entry) bool, limit int) ([]Entry, error) {
+	if etcdClient == nil {
+		return nil, ErrDisabled
+	}
+	entries := []Entry{}
+	end := clientv3.GetPrefixRangeEnd(entryPrefix)
+
+	for {
+		resp, err := etcdClient.Get(ctx, entryPrefix,
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+			clientv3.WithLimit(verifyPageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			var entry Entry
+			if err := json.Unmarshal(kv.Value, &entry); err != nil {
+				continue
+			}
+			if match(entry) {
+				entries = append(entries, entry)
+				if len(entries) == limit {
+					return entries, nil
+				}
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return entries, nil
+		}
+		end = string(resp.Kvs[len(resp.Kvs)-1].Key)
+	}
+}
+
+// @Summary Verify audit log
+// @Description Recomputes the hash chain and reports the first entry that does not match. Requires the admin role.
+// @ID audit-verify
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} VerifyResult
+// @Failure 403
+// @Failure 500
+// @Failure 503
+// @Router /audit/verify [get]
+func VerifyHandler(c *gin.Context) {
+	result, err := Verify(c.Request.Context())
+	if errors.Is(err, ErrDisabled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Audit log is disabled"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to verify audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Verify checks that every entry hashes correctly, links to its predecessor
+// and that the sequence has no gaps up to the recorded head. Everything is
+// read at the revision of the first page, so entries appended meanwhile are
+// not mistaken for a truncation.
+func Verify(ctx context.Context) (VerifyResult, error) {
+	var result VerifyResult
+	if etcdClient == nil {
+		return result, ErrDisabled
+	}
+	prevHash := ""
+	expected := uint64(1)
+	start := entryPrefix
+	end := clientv3.GetPrefixRangeEnd(entryPrefix)
+	var rev int64
+
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+			clientv3.WithLimit(verifyPageSize),
+		}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		resp, err := etcdClient.Get(ctx, start, opts...)
+		if err != nil {
+			return result, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			var entry Entry
+			if err := json.Unmarshal(kv.Value, &entry); err != nil {
+				return broken(result, expected, "entry is not valid JSON"), nil
+			}
+			if entry.Seq != expected {
+				return broken(result, expected, "entry is missing"), nil
+			}
+			if entry.PrevHash != prevHash {
+				return broken(result, entry.Seq, "previous hash does not match"), nil
+			}
+			hash, err := computeHash(entry)
+			if err != nil {
+				return result, err
+			}
+			if hash != entry.Hash {
+				return broken(result, entry.Seq, "entry hash does not match"), nil
+			}
+
+			prevHash = entry.Hash
+			expected++
+			result.Entries++
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+
+	resp, err := etcdClient.Get(ctx, headKey, clientv3.WithRev(rev))
+	if err != nil {
+		return result, err
+	}
+	if len(resp.Kvs) > 0 {
+		var current head
+		if err := json.Unmarshal(resp.Kvs[0].Value, &current); err != nil {
+			return broken(result, expected, "head is not valid JSON"), nil
+		}
+		if current.Seq != result.Entries || current.Hash != prevHash {
+			return broken(result, result.Entries+1, "log was truncated"), nil
+		}
+	}
+
+	result.Valid = true
+	return result, nil
+}
+
+func broken(result VerifyResult, seq uint64, reason string) VerifyResult {
+	result.Valid = false
+	result.BrokenSeq = seq
+	result.Reason = reason
+	return result
+}
@@ -0,0 +1,351 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/leases"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/gin-gonic/gin"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	headKey     = "/audit/head"
+	entryPrefix = "/audit/entries/"
+	dedupPrefix = "/audit/dedup/"
+	// dedupTTL is how long a dedup key is kept. The keys written within
+	// dedupPeriod share a lease.
+	dedupTTL    = time.Hour
+	dedupPeriod = 5 * time.Minute
+	// maxBackoff caps the wait between two attempts to move the head.
+	maxBackoff = time.Second
+	// submitTimeout bounds how long a caller waits for its entry before it
+	// is left to Run.
+	submitTimeout = 5 * time.Second
+	retryInterval = 5 * time.Second
+	// minKeyLength is the size of a SHA-256 hash, the shortest key HMAC-SHA256
+	// should get.
+	minKeyLength = 32
+)
+
+const (
+	ActionLogin        = "login"
+	ActionPeerAllocate = "peer.allocate"
+	ActionPeerRelease  = "peer.release"
+	ActionPeerRotate   = "peer.rotate"
+	ActionPoolChange   = "pool.change"
+	ActionEscrowWrite  = "escrow.write"
+	ActionEscrowRead   = "escrow.read"
+	ActionEscrowDelete = "escrow.delete"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultDenied  = "denied"
+)
+
+// Entry is one link of the audit chain. Hash is an HMAC over every other
+// field, including PrevHash, so changing or removing an entry breaks every
+// hash after it, and only holders of the key can compute a new chain.
+type Entry struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`
+	Actor    string            `json:"actor"`
+	SourceIP string            `json:"source_ip,omitempty"`
+	TraceID  string            `json:"trace_id,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	Result   string            `json:"result"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// ErrDisabled is returned by queries when the service runs without etcd.
+var ErrDisabled = errors.New("audit log is disabled")
+
+// Config holds the key the chain is computed with.
+type Config struct {
+	HMACKey settings.Secret
+}
+
+// ConfigFrom reads AUDIT_HMAC_KEY, which is required when etcd is used since
+// the log is kept there.
+func ConfigFrom(s *settings.Source, etcd bool) Config {
+	cfg := Config{HMACKey: s.Secret("AUDIT_HMAC_KEY")}
+	switch {
+	case len(cfg.HMACKey) == 0 && etcd:
+		s.Fail(errors.New("AUDIT_HMAC_KEY is required with etcd"))
+	case len(cfg.HMACKey) > 0 && len(cfg.HMACKey) < minKeyLength:
+		s.Invalid("AUDIT_HMAC_KEY", cfg.HMACKey.String(), fmt.Errorf("must be at least %d bytes", minKeyLength))
+	}
+	return cfg
+}
+
+type queuedEntry struct {
+	entry    Entry
+	dedupKey string
+}
+
+var (
+	etcdClient  *clientv3.Client
+	hmacKey     []byte
+	dedupLeases *leases.Bucket
+
+	queueMu sync.Mutex
+	// queue holds the entries that could not be written yet, oldest first.
+	queue  []queuedEntry
+	queued = make(chan struct{}, 1)
+)
+
+// Init sets the etcd client the log is kept in and the key of the chain.
+// Without a client the audit log is disabled and appending does nothing.
+func Init(cli *clientv3.Client, cfg Config) {
+	etcdClient = cli
+	hmacKey = []byte(cfg.HMACKey.Reveal())
+	dedupLeases = leases.NewBucket(cli, dedupTTL, dedupPeriod)
+}
+
+func entryKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", entryPrefix, seq)
+}
+
+func computeHash(entry Entry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Append links entry to the end of the chain. When dedupKey is not empty the
+// entry is written at most once per dedupKey, which lets every replica report
+// the same event without duplicating it. Contention on the head is retried
+// until ctx is done.
+func Append(ctx context.Context, entry Entry, dedupKey string) error {
+	if etcdClient == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	var leaseID clientv3.LeaseID
+	if dedupKey != "" {
+		// Another replica usually wrote the entry already
+		exists, err := etcdClient.Get(ctx, dedupPrefix+dedupKey, clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+		if exists.Count > 0 {
+			return nil
+		}
+		if leaseID, err = dedupLeases.Lease(ctx); err != nil {
+			return err
+		}
+	}
+
+	backoff := 10 * time.Millisecond
+	for {
+		resp, err := etcdClient.Get(ctx, headKey)
+		if err != nil {
+			return err
+		}
+
+		var current head
+		var headRevision int64
+		if len(resp.Kvs) > 0 {
+			if err := json.Unmarshal(resp.Kvs[0].Value, &current); err != nil {
+				return fmt.Errorf("corrupt audit head: %w", err)
+			}
+			headRevision = resp.Kvs[0].ModRevision
+		}
+
+		entry.Seq = current.Seq + 1
+		entry.PrevHash = current.Hash
+		entry.Hash, err = computeHash(entry)
+		if err != nil {
+			return err
+		}
+
+		entryData, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		headData, err := json.Marshal(head{Seq: entry.Seq, Hash: entry.Hash})
+		if err != nil {
+			return err
+		}
+
+		cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(headKey), "=", headRevision)}
+		ops := []clientv3.Op{
+			clientv3.OpPut(entryKey(entry.Seq), string(entryData)),
+			clientv3.OpPut(headKey, string(headData)),
+		}
+		if dedupKey != "" {
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(dedupPrefix+dedupKey), "=", 0))
+			ops = append(ops, clientv3.OpPut(dedupPrefix+dedupKey, "", clientv3.WithLease(leaseID)))
+		}
+
+		txnResp, err := etcdClient.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			dedupLeases.Forget(leaseID)
+			if leaseID, err = dedupLeases.Lease(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+
+		if dedupKey != "" {
+			exists, err := etcdClient.Get(ctx, dedupPrefix+dedupKey, clientv3.WithCountOnly())
+			if err != nil {
+				return err
+			}
+			if exists.Count > 0 {
+				return nil
+			}
+		}
+
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("audit head kept moving: %w", ctx.Err())
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// Submit appends entry like Append but never drops it: when it cannot be
+// written within submitTimeout it is queued and written by Run, in order.
+func Submit(ctx context.Context, entry Entry, dedupKey string) {
+	if etcdClient == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	queueMu.Lock()
+	waiting := len(queue) > 0
+	queueMu.Unlock()
+	if !waiting {
+		// The entry must outlive the request that caused it
+		appendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), submitTimeout)
+		err := Append(appendCtx, entry, dedupKey)
+		cancel()
+		if err == nil {
+			return
+		}
+		slog.WarnContext(ctx, "Failed to write audit entry, retrying in the background", "action", entry.Action, "target", entry.Target, "error", err)
+	}
+
+	queueMu.Lock()
+	queue = append(queue, queuedEntry{entry: entry, dedupKey: dedupKey})
+	queueMu.Unlock()
+	select {
+	case queued <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the queued entries until ctx is done. It then makes a last
+// attempt, and logs the entries that are still queued after it.
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			lastCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), submitTimeout)
+			flush(lastCtx)
+			cancel()
+			queueMu.Lock()
+			defer queueMu.Unlock()
+			for _, q := range queue {
+				slog.Error("Audit entry was never written", "action", q.entry.Action, "actor", q.entry.Actor, "target", q.entry.Target, "result", q.entry.Result, "time", q.entry.Time)
+			}
+			return
+		case <-queued:
+		case <-ticker.C:
+		}
+		flush(ctx)
+	}
+}
+
+// flush writes the queued entries in order and stops at the first failure.
+func flush(ctx context.Context) {
+	for {
+		queueMu.Lock()
+		if len(queue) == 0 {
+			queueMu.Unlock()
+			return
+		}
+		next := queue[0]
+		queueMu.Unlock()
+
+		if err := Append(ctx, next.entry, next.dedupKey); err != nil {
+			slog.ErrorContext(ctx, "Failed to write queued audit entries", "queued", queueLen(), "error", err)
+			return
+		}
+		queueMu.Lock()
+		queue = queue[1:]
+		queueMu.Unlock()
+	}
+}
+
+func queueLen() int {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return len(queue)
+}
+
+// Record appends an entry for the current request. The actor is the
+// authenticated user unless actor is given explicitly, e.g. for logins.
+// Failures never fail the request, the entry is written later instead.
+func Record(c *gin.Context, action, actor, target, result string, details map[string]string) {
+	ctx := c.Request.Context()
+	if actor == "" {
+		actor = c.GetString("username")
+	}
+
+	entry := Entry{
+		Action:   action,
+		Actor:    actor,
+		SourceIP: c.ClientIP(),
+		Target:   target,
+		Result:   result,
+		Details:  details,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		entry.TraceID = sc.TraceID().String()
+	}
+
+	Submit(ctx, entry, "")
+}
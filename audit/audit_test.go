@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Zacky3181V/wireable/internal/etcdtest"
+	"github.com/Zacky3181V/wireable/settings"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// initLog points the audit log at a fresh etcd and appends n entries.
+func initLog(t *testing.T, n int) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts an etcd server")
+	}
+	Init(etcdtest.New(t), Config{HMACKey: settings.Secret("0123456789abcdef0123456789abcdef")})
+	t.Cleanup(func() { Init(nil, Config{}) })
+
+	for i := range n {
+		entry := Entry{Action: ActionLogin, Actor: fmt.Sprintf("user-%d", i), Result: ResultSuccess}
+		if err := Append(context.Background(), entry, ""); err != nil {
+			t.Fatalf("Append %d: %v", i+1, err)
+		}
+	}
+}
+
+func getEntry(t *testing.T, seq uint64) Entry {
+	t.Helper()
+	resp, err := etcdClient.Get(context.Background(), entryKey(seq))
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("Get entry %d = %v, %v", seq, resp, err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(resp.Kvs[0].Value, &entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func putEntry(t *testing.T, entry Entry) {
+	t.Helper()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := etcdClient.Put(context.Background(), entryKey(entry.Seq), string(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustVerify(t *testing.T) VerifyResult {
+	t.Helper()
+	result, err := Verify(context.Background())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	return result
+}
+
+func TestVerifyDisabled(t *testing.T) {
+	if _, err := Verify(context.Background()); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("Verify without etcd = %v, want ErrDisabled", err)
+	}
+}
+
+func TestVerifyIntact(t *testing.T) {
+	// More than a page, so the chain is followed across pages
+	n := verifyPageSize + 2
+	initLog(t, n)
+
+	// An entry reported by every replica is written once
+	for range 3 {
+		entry := Entry{Action: ActionPeerRelease, Actor: "system", Result: ResultSuccess}
+		if err := Append(context.Background(), entry, "expired/peer-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := mustVerify(t)
+	if !result.Valid || result.Entries != uint64(n+1) {
+		t.Fatalf("Verify() = %+v, want %d valid entries", result, n+1)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T)
+		seq    uint64
+		reason string
+	}{
+		{"changed field", func(t *testing.T) {
+			entry := getEntry(t, 3)
+			entry.Result = ResultFailure
+			putEntry(t, entry)
+		}, 3, "entry hash does not match"},
+		{"rehashed with another key", func(t *testing.T) {
+			entry := getEntry(t, 3)
+			entry.Result = ResultFailure
+			key := hmacKey
+			hmacKey = []byte("not the key of the chain, but long")
+			defer func() { hmacKey = key }()
+			var err error
+			if entry.Hash, err = computeHash(entry); err != nil {
+				t.Fatal(err)
+			}
+			putEntry(t, entry)
+		}, 3, "entry hash does not match"},
+		{"relinked", func(t *testing.T) {
+			// Entry 3 is dropped and entry 4 renumbered in its place
+			entry := getEntry(t, 4)
+			entry.Seq = 3
+			putEntry(t, entry)
+			if _, err := etcdClient.Delete(context.Background(), entryKey(4)); err != nil {
+				t.Fatal(err)
+			}
+		}, 3, "previous hash does not match"},
+		{"removed", func(t *testing.T) {
+			if _, err := etcdClient.Delete(context.Background(), entryKey(3)); err != nil {
+				t.Fatal(err)
+			}
+		}, 3, "entry is missing"},
+		{"not JSON", func(t *testing.T) {
+			if _, err := etcdClient.Put(context.Background(), entryKey(3), "{"); err != nil {
+				t.Fatal(err)
+			}
+		}, 3, "entry is not valid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initLog(t, 5)
+			tt.tamper(t)
+			result := mustVerify(t)
+			if result.Valid || result.BrokenSeq != tt.seq || result.Reason != tt.reason {
+				t.Fatalf("Verify() = %+v, want broken at %d with %q", result, tt.seq, tt.reason)
+			}
+		})
+	}
+}
+
+func TestVerifyTruncated(t *testing.T) {
+	initLog(t, 5)
+	// Dropping the newest entries leaves a consistent chain, only the head
+	// tells it is too short
+	if _, err := etcdClient.Delete(context.Background(), entryKey(4), clientv3.WithRange(entryKey(6))); err != nil {
+		t.Fatal(err)
+	}
+
+	result := mustVerify(t)
+	if result.Valid || result.Entries != 3 || result.BrokenSeq != 4 || result.Reason != "log was truncated" {
+		t.Fatalf("Verify() = %+v, want truncated after 3 entries", result)
+	}
+}
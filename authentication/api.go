@@ -1,30 +1,35 @@
 package authentication
 
 import (
-	"errors"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/logging"
+	"github.com/Zacky3181V/wireable/ratelimit"
+	"github.com/Zacky3181V/wireable/tlsserver"
 	"github.com/Zacky3181V/wireable/vaultclient"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
+type Credentials = api.Credentials
 
-func generateJWT(username string, jwtSecret []byte) (string, error) {
+func generateJWT(ctx context.Context, username, role string, jwtSecret []byte) (string, error) {
 	claims := jwt.MapClaims{
 		"username": username,
+		"role":     role,
 		"exp":      time.Now().Add(time.Hour * 1).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	return token.SignedString(jwtSecret)
+	return signToken(ctx, claims, jwtSecret)
 }
 
 // @Summary Login
@@ -32,10 +37,12 @@ func generateJWT(username string, jwtSecret []byte) (string, error) {
 // @ID login
 // @Accept json
 // @Produce json
-// @Param loginRequest body Credentials true "Login credentials"
-// @Success 200
+// @Param loginRequest body api.Credentials true "Login credentials"
+// @Success 200 {object} api.Token
+// @Failure 401
+// @Failure 429
 // @Router /authentication/login [post]
-func LoginHandler(c *gin.Context) {
+func (a *Authenticator) LoginHandler(c *gin.Context) {
 	var creds Credentials
 
 	if err := c.ShouldBindJSON(&creds); err != nil {
@@ -43,25 +50,67 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
-	if creds.Username != vaultclient.Username || creds.Password != vaultclient.Password {
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	guard := ratelimit.Get()
+
+	locked, err := guard.LoginLocked(ctx, ip, creds.Username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check login lockout", "error", err)
+	}
+	if locked > 0 {
+		countLogin(ctx, audit.ResultDenied, "locked out")
+		audit.Record(c, audit.ActionLogin, creds.Username, "", audit.ResultDenied, map[string]string{"reason": "locked out"})
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts"})
+		return
+	}
+
+	current := vaultclient.CurrentSecrets()
+	if subtle.ConstantTimeCompare([]byte(creds.Username), []byte(current.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(creds.Password), []byte(current.Password)) != 1 {
+		if _, err := guard.LoginFailed(ctx, ip, creds.Username); err != nil {
+			slog.ErrorContext(ctx, "Failed to record login failure", "error", err)
+		}
+		countLogin(ctx, audit.ResultFailure, "invalid credentials")
+		audit.Record(c, audit.ActionLogin, creds.Username, "", audit.ResultFailure, map[string]string{"reason": "invalid credentials"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	token, err := generateJWT(creds.Username, []byte(vaultclient.JWTSecret))
+	if err := guard.LoginSucceeded(ctx, ip, creds.Username); err != nil {
+		slog.ErrorContext(ctx, "Failed to reset login failures", "error", err)
+	}
+
+	token, err := generateJWT(ctx, creds.Username, a.roleFor(creds.Username), []byte(current.JWTSecret))
 	if err != nil {
+		countLogin(ctx, audit.ResultFailure, "token signing failed")
+		audit.Record(c, audit.ActionLogin, creds.Username, "", audit.ResultFailure, map[string]string{"reason": "token signing failed"})
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	countLogin(ctx, audit.ResultSuccess, "")
+	audit.Record(c, audit.ActionLogin, creds.Username, "", audit.ResultSuccess, nil)
+	c.JSON(http.StatusOK, api.Token{Token: token})
 }
 
-func JWTMiddleware() gin.HandlerFunc {
+// JWTMiddleware authenticates the caller with a JWT or a client certificate
+// and sets its username and role.
+func (a *Authenticator) JWTMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
+			// A verified client certificate is accepted in place of a JWT
+			if identity, ok := tlsserver.ClientIdentity(c.Request.TLS); ok {
+				c.Set("username", identity)
+				c.Set("role", a.roleFor(identity))
+				logging.SetUser(c, identity)
+				c.Next()
+				return
+			}
+
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
 			c.Abort()
 			return
@@ -70,12 +119,8 @@ func JWTMiddleware() gin.HandlerFunc {
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(vaultclient.JWTSecret), nil
-		})
+			return verificationKeyFor(token, vaultclient.JWTVerificationSecrets())
+		}, jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
 
 		if err != nil || !token.Valid {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -90,7 +135,16 @@ func JWTMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("username", claims["username"])
+		username, _ := claims["username"].(string)
+		role, _ := claims["role"].(string)
+		if role == "" {
+			// Tokens issued before roles were introduced
+			role = a.roleFor(username)
+		}
+
+		c.Set("username", username)
+		c.Set("role", role)
+		logging.SetUser(c, username)
 
 		c.Next()
 	}
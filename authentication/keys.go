@@ -0,0 +1,463 @@
+package authentication
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hashicorp/vault/api"
+)
+
+// KeyConfig selects how tokens are signed. With the default HS256 algorithm
+// tokens keep being signed with the shared secret from Vault and no key
+// manager is started. With an asymmetric algorithm HS256 tokens are rejected,
+// unless AcceptHS256Until is set to give clients time to move over.
+type KeyConfig struct {
+	Algorithm        string // HS256, RS256 or EdDSA
+	Signer           string // local or transit
+	MountPath        string
+	KeysSecret       string // KV path holding PEM private keys for the local signer
+	TransitMount     string
+	TransitKey       string
+	RefreshInterval  time.Duration
+	AcceptHS256Until time.Time
+}
+
+func KeyConfigFrom(s *settings.Source) KeyConfig {
+	cfg := KeyConfig{
+		Algorithm:       s.String("JWT_SIGNING_ALG", "HS256"),
+		Signer:          s.String("JWT_SIGNER", "local"),
+		MountPath:       s.String("MOUNT_PATH", ""),
+		KeysSecret:      s.String("JWT_KEYS_SECRET", ""),
+		TransitMount:    s.String("JWT_TRANSIT_MOUNT", "transit"),
+		TransitKey:      s.String("JWT_TRANSIT_KEY", ""),
+		RefreshInterval: s.Duration("JWT_KEYS_REFRESH_INTERVAL", 5*time.Minute),
+	}
+	if v := s.String("JWT_ACCEPT_HS256_UNTIL", ""); v != "" {
+		until, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			s.Invalid("JWT_ACCEPT_HS256_UNTIL", v, errors.New("expected an RFC 3339 time"))
+		}
+		cfg.AcceptHS256Until = until
+	}
+	if _, err := cfg.signingMethod(); err != nil {
+		s.Fail(err)
+	}
+	return cfg
+}
+
+// signingMethod checks cfg and returns the method tokens are signed with, or
+// nil for HS256.
+func (cfg KeyConfig) signingMethod() (jwt.SigningMethod, error) {
+	var method jwt.SigningMethod
+	switch cfg.Algorithm {
+	case "HS256":
+		return nil, nil
+	case "RS256":
+		method = jwt.SigningMethodRS256
+	case "EdDSA":
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT_SIGNING_ALG %q", cfg.Algorithm)
+	}
+
+	switch cfg.Signer {
+	case "local":
+		if cfg.KeysSecret == "" {
+			return nil, errors.New("JWT_KEYS_SECRET is required for the local signer")
+		}
+	case "transit":
+		if cfg.TransitKey == "" {
+			return nil, errors.New("JWT_TRANSIT_KEY is required for the transit signer")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT_SIGNER %q", cfg.Signer)
+	}
+	if cfg.RefreshInterval <= 0 {
+		return nil, errors.New("JWT_KEYS_REFRESH_INTERVAL must be positive")
+	}
+	return method, nil
+}
+
+type verificationKey struct {
+	kid       string
+	algorithm string
+	public    crypto.PublicKey
+}
+
+type tokenSigner interface {
+	keyID() string
+	sign(ctx context.Context, signingString string) ([]byte, error)
+}
+
+// keyManager holds the active signing key and every key that is still
+// accepted for verification. Keys are reloaded periodically so a rotation in
+// Vault is picked up without a restart.
+type keyManager struct {
+	cfg    KeyConfig
+	method jwt.SigningMethod
+
+	mu     sync.RWMutex
+	signer tokenSigner
+	keys   map[string]verificationKey
+}
+
+var keys *keyManager
+
+// InitKeys loads the asymmetric signing keys. It does nothing for HS256.
+func InitKeys(ctx context.Context, cfg KeyConfig) error {
+	method, err := cfg.signingMethod()
+	if err != nil || method == nil {
+		return err
+	}
+
+	km := &keyManager{cfg: cfg, method: method}
+	if err := km.refresh(ctx); err != nil {
+		return err
+	}
+	keys = km
+	slog.Info("Loaded JWT verification keys", "count", len(km.keys), "signing_key", km.signer.keyID())
+	if time.Now().Before(cfg.AcceptHS256Until) {
+		slog.Warn("HS256 tokens are still accepted", "until", cfg.AcceptHS256Until)
+	}
+	return nil
+}
+
+// WatchKeys reloads the signing keys until ctx is done.
+func WatchKeys(ctx context.Context) {
+	if keys == nil {
+		return
+	}
+	ticker := time.NewTicker(keys.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := keys.refresh(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to refresh JWT keys, keeping the current set", "error", err)
+			}
+		}
+	}
+}
+
+func (km *keyManager) refresh(ctx context.Context) error {
+	vc, err := vaultclient.Client()
+	if err != nil {
+		return err
+	}
+
+	var signer tokenSigner
+	var loaded map[string]verificationKey
+	if km.cfg.Signer == "transit" {
+		signer, loaded, err = km.loadTransitKeys(ctx, vc)
+	} else {
+		signer, loaded, err = km.loadLocalKeys(ctx, vc)
+	}
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	km.signer = signer
+	km.keys = loaded
+	km.mu.Unlock()
+	return nil
+}
+
+// loadLocalKeys reads a KV secret where every entry except "active_kid" maps
+// a key ID to a PEM encoded private key. Keys that are no longer active stay
+// valid for verification until they are removed from the secret.
+func (km *keyManager) loadLocalKeys(ctx context.Context, vc *api.Client) (tokenSigner, map[string]verificationKey, error) {
+	data, err := vaultclient.ReadSecretData(ctx, vc, km.cfg.MountPath, km.cfg.KeysSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read JWT keys: %w", err)
+	}
+
+	activeKid, _ := data["active_kid"].(string)
+	loaded := make(map[string]verificationKey)
+	var signer tokenSigner
+
+	for kid, raw := range data {
+		if kid == "active_kid" {
+			continue
+		}
+		pemData, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		private, err := parsePrivateKey(pemData)
+		if err != nil {
+			slog.Warn("Skipping JWT key", "kid", kid, "error", err)
+			continue
+		}
+
+		algorithm := algorithmForKey(private.Public())
+		loaded[kid] = verificationKey{kid: kid, algorithm: algorithm, public: private.Public()}
+		if kid == activeKid {
+			if algorithm != km.method.Alg() {
+				return nil, nil, fmt.Errorf("active JWT key %s is %s, expected %s", kid, algorithm, km.method.Alg())
+			}
+			signer = &localSigner{kid: kid, method: km.method, key: private}
+		}
+	}
+
+	if signer == nil {
+		return nil, nil, fmt.Errorf("active JWT key %q not found in %s", activeKid, km.cfg.KeysSecret)
+	}
+	return signer, loaded, nil
+}
+
+func (km *keyManager) loadTransitKeys(ctx context.Context, vc *api.Client) (tokenSigner, map[string]verificationKey, error) {
+	published, err := vaultclient.TransitPublicKeys(ctx, vc, km.cfg.TransitMount, km.cfg.TransitKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read transit public keys: %w", err)
+	}
+
+	loaded := make(map[string]verificationKey)
+	latest := 0
+	for version, encoded := range published {
+		public, err := parseTransitPublicKey(encoded)
+		if err != nil {
+			slog.Warn("Skipping transit key version", "version", version, "error", err)
+			continue
+		}
+		kid := transitKeyID(km.cfg.TransitKey, version)
+		loaded[kid] = verificationKey{kid: kid, algorithm: algorithmForKey(public), public: public}
+		if version > latest {
+			latest = version
+		}
+	}
+	if latest == 0 {
+		return nil, nil, fmt.Errorf("transit key %s has no usable public keys", km.cfg.TransitKey)
+	}
+	if loaded[transitKeyID(km.cfg.TransitKey, latest)].algorithm != km.method.Alg() {
+		return nil, nil, fmt.Errorf("transit key %s does not match %s", km.cfg.TransitKey, km.method.Alg())
+	}
+
+	return &transitSigner{cfg: km.cfg, method: km.method, version: latest}, loaded, nil
+}
+
+func (km *keyManager) lookup(kid string) (verificationKey, bool) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	key, ok := km.keys[kid]
+	return key, ok
+}
+
+func (km *keyManager) activeSigner() tokenSigner {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.signer
+}
+
+type localSigner struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func (s *localSigner) keyID() string { return s.kid }
+
+func (s *localSigner) sign(_ context.Context, signingString string) ([]byte, error) {
+	return s.method.Sign(signingString, s.key)
+}
+
+// transitSigner delegates signing to the Vault transit engine, so the private
+// key never leaves Vault. It signs with the newest key version seen during
+// the last refresh, which keeps the kid header in step with the signature.
+type transitSigner struct {
+	cfg     KeyConfig
+	method  jwt.SigningMethod
+	version int
+}
+
+func (s *transitSigner) keyID() string { return transitKeyID(s.cfg.TransitKey, s.version) }
+
+func (s *transitSigner) sign(ctx context.Context, signingString string) ([]byte, error) {
+	return vaultclient.TransitSign(ctx, vaultclient.GetClient(), s.cfg.TransitMount, s.cfg.TransitKey,
+		s.version, []byte(signingString), s.method == jwt.SigningMethodRS256)
+}
+
+func transitKeyID(keyName string, version int) string {
+	return fmt.Sprintf("%s-v%d", keyName, version)
+}
+
+// signToken signs claims with the active key, or with the shared HMAC secret
+// when no asymmetric key manager is configured.
+func signToken(ctx context.Context, claims jwt.MapClaims, hmacSecret []byte) (string, error) {
+	if keys == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(hmacSecret)
+	}
+
+	signer := keys.activeSigner()
+	token := jwt.NewWithClaims(keys.method, claims)
+	token.Header["kid"] = signer.keyID()
+
+	signingString, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+	sig, err := signer.sign(ctx, signingString)
+	if err != nil {
+		return "", err
+	}
+	return signingString + "." + token.EncodeSegment(sig), nil
+}
+
+// verificationKeyFor resolves the key a token must be verified with. Once
+// asymmetric keys are configured, HMAC tokens are only accepted until
+// AcceptHS256Until: anyone holding the shared secret could mint them.
+func verificationKeyFor(token *jwt.Token, hmacSecrets [][]byte) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if keys != nil && !time.Now().Before(keys.cfg.AcceptHS256Until) {
+			return nil, errors.New("HMAC tokens are not accepted with asymmetric signing")
+		}
+		if len(hmacSecrets) == 0 {
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		set := jwt.VerificationKeySet{}
+		for _, secret := range hmacSecrets {
+			set.Keys = append(set.Keys, secret)
+		}
+		return set, nil
+	}
+
+	if keys == nil {
+		return nil, errors.New("unexpected signing method")
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.algorithm != token.Method.Alg() {
+		return nil, errors.New("signing method does not match key")
+	}
+	return key.public, nil
+}
+
+func parsePrivateKey(pemData string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// parseTransitPublicKey accepts the PEM encoding Vault uses for RSA keys and
+// the raw base64 encoding it uses for ed25519 keys.
+func parseTransitPublicKey(encoded string) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key length")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func algorithmForKey(public crypto.PublicKey) string {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Alg()
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA.Alg()
+	}
+	return ""
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// @Summary JSON Web Key Set
+// @Description Publishes the public keys that verify tokens issued by this service.
+// @ID jwks
+// @Produce json
+// @Success 200 {object} JWKSet
+// @Router /.well-known/jwks.json [get]
+func JWKSHandler(c *gin.Context) {
+	set := JWKSet{Keys: []JWK{}}
+	if keys != nil {
+		keys.mu.RLock()
+		for _, key := range keys.keys {
+			set.Keys = append(set.Keys, toJWK(key))
+		}
+		keys.mu.RUnlock()
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
+
+func toJWK(key verificationKey) JWK {
+	jwk := JWK{Kid: key.kid, Use: "sig", Alg: key.algorithm}
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
@@ -0,0 +1,21 @@
+package authentication
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("wireable/authentication")
+
+var logins, _ = meter.Int64Counter("wireable.auth.logins",
+	metric.WithDescription("Login attempts by result and reason"))
+
+func countLogin(ctx context.Context, result, reason string) {
+	logins.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("result", result),
+		attribute.String("reason", reason),
+	))
+}
@@ -0,0 +1,67 @@
+package authentication
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// RoleConfig lists the users with the admin role. Without Admins the Vault
+// login user is the only admin.
+type RoleConfig struct {
+	Admins []string
+}
+
+func RoleConfigFrom(s *settings.Source) RoleConfig {
+	return RoleConfig{Admins: s.List("ADMIN_USERS")}
+}
+
+// Authenticator logs users in and authenticates their requests, giving them
+// the roles of its RoleConfig.
+type Authenticator struct {
+	roles RoleConfig
+}
+
+func NewAuthenticator(roles RoleConfig) *Authenticator {
+	return &Authenticator{roles: roles}
+}
+
+// roleFor returns the role of username.
+func (a *Authenticator) roleFor(username string) string {
+	if len(a.roles.Admins) == 0 {
+		if username != "" && username == vaultclient.CurrentSecrets().Username {
+			return RoleAdmin
+		}
+		return RoleUser
+	}
+	if slices.Contains(a.roles.Admins, username) {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
+// IsAdmin reports whether the authenticated caller has the admin role.
+func IsAdmin(c *gin.Context) bool {
+	return c.GetString("role") == RoleAdmin
+}
+
+// RequireAdmin rejects callers without the admin role. It must run after
+// JWTMiddleware.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !IsAdmin(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
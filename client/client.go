@@ -0,0 +1,244 @@
+// Package client talks to the Wireable API. It is used by wireablectl and
+// the agent, and speaks the same types as the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+)
+
+// Client calls the API at BaseURL, e.g. https://wireable.example.com,
+// authenticated with Token.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is a failed request. Message is the error reported by the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// PeerConfig is a rendered WireGuard config of a peer.
+type PeerConfig struct {
+	PeerID string
+	Config string
+}
+
+func (c *Client) Login(ctx context.Context, creds api.Credentials) (string, error) {
+	var token api.Token
+	if err := c.do(ctx, http.MethodPost, "/authentication/login", nil, creds, &token); err != nil {
+		return "", err
+	}
+	return token.Token, nil
+}
+
+// Generate enrolls a new peer with profile, or the default profile when it is
+// empty, and returns its config.
+func (c *Client) Generate(ctx context.Context, profile string) (*PeerConfig, error) {
+	query := url.Values{}
+	if profile != "" {
+		query.Set("profile", profile)
+	}
+	return c.peerConfig(ctx, http.MethodGet, "/generate", query)
+}
+
+// ListPeers returns the caller's peers. Admins get every peer, or the peers
+// of owner when it is not empty. A non-empty state, api.PeerOnline or
+// api.PeerOffline, only returns the peers in that state.
+func (c *Client) ListPeers(ctx context.Context, owner, state string) ([]api.Peer, error) {
+	query := url.Values{}
+	if owner != "" {
+		query.Set("owner", owner)
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	var peers []api.Peer
+	err := c.do(ctx, http.MethodGet, "/peers", query, nil, &peers)
+	return peers, err
+}
+
+func (c *Client) GetPeer(ctx context.Context, id string) (*api.Peer, error) {
+	var peer api.Peer
+	if err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id), nil, nil, &peer); err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+func (c *Client) RevokePeer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/peers/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// RotatePeer replaces the keys of the peer and returns its new config.
+func (c *Client) RotatePeer(ctx context.Context, id string) (*PeerConfig, error) {
+	return c.peerConfig(ctx, http.MethodPost, "/peers/"+url.PathEscape(id)+"/rotate", nil)
+}
+
+// DownloadConfig returns the config of a peer whose private key is escrowed.
+func (c *Client) DownloadConfig(ctx context.Context, id string) (*PeerConfig, error) {
+	return c.peerConfig(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/config", nil)
+}
+
+// Enroll enrolls a peer with a key pair generated by the caller.
+func (c *Client) Enroll(ctx context.Context, req api.EnrollRequest) (*api.PeerSettings, error) {
+	var settings api.PeerSettings
+	if err := c.do(ctx, http.MethodPost, "/peers", nil, req, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// Heartbeat reports that the peer is managed and alive, and returns its
+// current settings.
+func (c *Client) Heartbeat(ctx context.Context, id string) (*api.PeerSettings, error) {
+	var settings api.PeerSettings
+	if err := c.do(ctx, http.MethodPost, "/peers/"+url.PathEscape(id)+"/heartbeat", nil, nil, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// UpdateKey replaces the public key of the peer with one generated by the
+// caller.
+func (c *Client) UpdateKey(ctx context.Context, id, publicKey string) (*api.PeerSettings, error) {
+	var settings api.PeerSettings
+	if err := c.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id)+"/key", nil, api.KeyUpdate{PublicKey: publicKey}, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (c *Client) PoolStats(ctx context.Context, name string) (*api.PoolStats, error) {
+	var stats api.PoolStats
+	if err := c.do(ctx, http.MethodGet, "/pools/"+url.PathEscape(name)+"/stats", nil, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *Client) ListProfiles(ctx context.Context) ([]api.Profile, error) {
+	var profiles []api.Profile
+	err := c.do(ctx, http.MethodGet, "/profiles", nil, nil, &profiles)
+	return profiles, err
+}
+
+func (c *Client) GetProfile(ctx context.Context, name string) (*api.Profile, error) {
+	var profile api.Profile
+	if err := c.do(ctx, http.MethodGet, "/profiles/"+url.PathEscape(name), nil, nil, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// PutProfile creates or replaces the profile named profile.Name.
+func (c *Client) PutProfile(ctx context.Context, profile api.Profile) (*api.Profile, error) {
+	var stored api.Profile
+	if err := c.do(ctx, http.MethodPut, "/profiles/"+url.PathEscape(profile.Name), nil, profile, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (c *Client) DeleteProfile(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/profiles/"+url.PathEscape(name), nil, nil, nil)
+}
+
+func (c *Client) peerConfig(ctx context.Context, method, path string, query url.Values) (*PeerConfig, error) {
+	resp, err := c.send(ctx, method, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerConfig{PeerID: resp.Header.Get(api.PeerIDHeader), Config: string(body)}, nil
+}
+
+// do sends in as JSON and decodes the response into out, when they are not
+// nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	resp, err := c.send(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// send makes the request and turns error statuses into an *Error.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	target := c.BaseURL + "/api/v1" + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr api.Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Error == "" {
+		apiErr.Error = strings.TrimSpace(string(data))
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/client"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var errRevoked = errors.New("the peer was revoked or has expired, remove the state file to enroll again")
+
+type agent struct {
+	cfg   Config
+	api   *client.Client
+	dev   *device
+	state *state
+	// configured is set once the interface was set up by this process
+	configured bool
+}
+
+// run enrolls the device when it has no peer yet and then keeps the interface
+// in sync with the server until ctx is done.
+func (a *agent) run(ctx context.Context) error {
+	st, err := loadState(a.cfg.StateFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", a.cfg.StateFile, err)
+	}
+	a.state = st
+	if st.Revoked {
+		return errRevoked
+	}
+
+	if st.PeerID == "" {
+		if err := a.enroll(ctx); err != nil {
+			return err
+		}
+	} else if st.Applied != nil {
+		// Bring the tunnel up after a reboot even if the server is down
+		if err := a.apply(st.Applied); err != nil {
+			slog.Error("Failed to restore the last configuration", "interface", a.cfg.Interface, "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(a.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.sync(ctx); errors.Is(err, errRevoked) {
+			return err
+		} else if err != nil {
+			// Keep the current config, the tunnel may still work
+			slog.Error("Failed to sync with the server", "peer", a.state.PeerID, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping, the interface is left up", "interface", a.cfg.Interface)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// enroll generates a key pair and registers the public key with the server.
+// The private key is saved before it is used, so a crash cannot leave the
+// server with a key the device has lost.
+func (a *agent) enroll(ctx context.Context) error {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	a.state.PrivateKey = key.String()
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	var settings *api.PeerSettings
+	err = a.call(ctx, func() (err error) {
+		settings, err = a.api.Enroll(ctx, api.EnrollRequest{PublicKey: key.PublicKey().String(), Profile: a.cfg.Profile})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enroll: %w", err)
+	}
+	a.state.PeerID = settings.Peer.ID
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	slog.Info("Enrolled", "peer", settings.Peer.ID, "ip", settings.Peer.IP, "profile", settings.Peer.Profile)
+	return nil
+}
+
+// sync sends a heartbeat, replaces the key when it was rotated elsewhere or
+// is due, and applies the settings returned by the server when they changed.
+func (a *agent) sync(ctx context.Context) error {
+	var settings *api.PeerSettings
+	err := a.call(ctx, func() (err error) {
+		settings, err = a.api.Heartbeat(ctx, a.state.PeerID)
+		return err
+	})
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return a.revoked()
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.state.PendingKey != "" && settings.Peer.PublicKey == publicKeyOf(a.state.PendingKey) {
+		// The last rotation went through but its answer was lost
+		a.state.PrivateKey, a.state.PendingKey = a.state.PendingKey, ""
+		if err := a.state.save(a.cfg.StateFile); err != nil {
+			return err
+		}
+	}
+	if reason := a.rotationReason(&settings.Peer); reason != "" {
+		if settings, err = a.rotate(ctx, reason); err != nil {
+			return err
+		}
+	}
+
+	if a.configured && reflect.DeepEqual(a.state.Applied, withoutStatus(settings)) {
+		return nil
+	}
+	return a.apply(settings)
+}
+
+// rotationReason returns why the key has to be replaced, or "".
+func (a *agent) rotationReason(peer *api.Peer) string {
+	if peer.PublicKey != publicKeyOf(a.state.PrivateKey) {
+		return "key replaced on the server"
+	}
+	since := peer.CreatedAt
+	if peer.RotatedAt != nil {
+		since = *peer.RotatedAt
+	}
+	if a.cfg.RotateInterval > 0 && time.Since(since) >= a.cfg.RotateInterval {
+		return "rotation interval elapsed"
+	}
+	if peer.ExpiresAt != nil && time.Now().After(since.Add(peer.ExpiresAt.Sub(since)*2/3)) {
+		return "peer expires soon"
+	}
+	return ""
+}
+
+// rotate generates a new key pair and registers it. It also renews peers that
+// expire.
+func (a *agent) rotate(ctx context.Context, reason string) (*api.PeerSettings, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	a.state.PendingKey = key.String()
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return nil, fmt.Errorf("failed to save state: %w", err)
+	}
+
+	var settings *api.PeerSettings
+	err = a.call(ctx, func() (err error) {
+		settings, err = a.api.UpdateKey(ctx, a.state.PeerID, key.PublicKey().String())
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to replace key: %w", err)
+	}
+	a.state.PrivateKey, a.state.PendingKey = key.String(), ""
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return nil, fmt.Errorf("failed to save state: %w", err)
+	}
+	slog.Info("Replaced key", "peer", a.state.PeerID, "reason", reason, "expires_at", settings.Peer.ExpiresAt)
+	return settings, nil
+}
+
+func (a *agent) apply(settings *api.PeerSettings) error {
+	key, err := a.state.key()
+	if err != nil {
+		return err
+	}
+	routes, err := a.dev.apply(settings, key, a.state.Applied, a.state.Routes)
+	if err != nil {
+		return err
+	}
+	if settings.DNS != "" && (a.state.Applied == nil || a.state.Applied.DNS != settings.DNS) {
+		slog.Info("DNS servers of the profile are not configured by the agent", "dns", settings.DNS)
+	}
+
+	a.state.Applied, a.state.Routes = withoutStatus(settings), routes
+	a.configured = true
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return err
+	}
+	slog.Info("Applied configuration", "interface", a.cfg.Interface, "ip", settings.Peer.IP,
+		"endpoint", settings.Endpoint, "allowed_ips", settings.AllowedIPs)
+	return nil
+}
+
+// withoutStatus drops the fields of settings that change without affecting
+// the interface, such as the heartbeat time.
+func withoutStatus(settings *api.PeerSettings) *api.PeerSettings {
+	s := *settings
+	s.Peer = api.Peer{ID: settings.Peer.ID, IP: settings.Peer.IP, PublicKey: settings.Peer.PublicKey}
+	return &s
+}
+
+// revoked takes the interface down and remembers that the peer is gone.
+func (a *agent) revoked() error {
+	slog.Error("The server no longer knows this peer, taking the interface down", "peer", a.state.PeerID, "interface", a.cfg.Interface)
+	if err := a.dev.down(a.state.Routes); err != nil {
+		slog.Error("Failed to remove the interface", "interface", a.cfg.Interface, "error", err)
+	}
+	a.state.Revoked = true
+	a.state.Applied, a.state.Routes = nil, nil
+	if err := a.state.save(a.cfg.StateFile); err != nil {
+		return err
+	}
+	return errRevoked
+}
+
+// call runs fn, authenticating first when needed and once more when the
+// server rejects the token.
+func (a *agent) call(ctx context.Context, fn func() error) error {
+	if a.api.Token == "" {
+		if err := a.authenticate(ctx); err != nil {
+			return err
+		}
+	}
+	err := fn()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || (a.cfg.TokenFile == "" && a.cfg.Username == "") {
+		return err
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// authenticate reads the token file or logs in. With only a client
+// certificate there is nothing to do.
+func (a *agent) authenticate(ctx context.Context) error {
+	switch {
+	case a.cfg.TokenFile != "":
+		// Re-read every time, whatever issues tokens may have replaced it
+		data, err := os.ReadFile(a.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		a.api.Token = strings.TrimSpace(string(data))
+	case a.cfg.Username != "":
+		token, err := a.api.Login(ctx, api.Credentials{Username: a.cfg.Username, Password: a.cfg.Password.Reveal()})
+		if err != nil {
+			return fmt.Errorf("failed to log in: %w", err)
+		}
+		a.api.Token = token
+	}
+	return nil
+}
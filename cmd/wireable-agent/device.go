@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// tunnelTable is the routing table and firewall mark of full tunnels, as in
+// wg-quick. The interface marks its own packets; everything else is looked
+// up in the table, which routes it through the interface, while the marked
+// packets to the endpoint keep using the main table.
+const tunnelTable = 51820
+
+// device configures the WireGuard interface of the agent. wgctrl sets the
+// keys and the server peer; creating the link, addresses and routes is left
+// to ip(8), which wgctrl does not cover.
+type device struct {
+	name string
+	wg   *wgctrl.Client
+}
+
+func openDevice(name string) (*device, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return &device{name: name, wg: wg}, nil
+}
+
+func (d *device) Close() error {
+	return d.wg.Close()
+}
+
+// apply brings the interface in line with settings and returns the routes it
+// installed. prev and prevRoutes are the previous configuration, used to drop
+// the address and routes that are gone.
+func (d *device) apply(settings *api.PeerSettings, key wgtypes.Key, prev *api.PeerSettings, prevRoutes []string) ([]string, error) {
+	serverKey, err := wgtypes.ParseKey(settings.ServerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server public key: %w", err)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", settings.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve endpoint %s: %w", settings.Endpoint, err)
+	}
+	var allowed []net.IPNet
+	for _, cidr := range strings.Split(settings.AllowedIPs, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IPs %q: %w", settings.AllowedIPs, err)
+		}
+		allowed = append(allowed, *network)
+	}
+
+	if _, err := d.wg.Device(d.name); errors.Is(err, fs.ErrNotExist) {
+		if err := ip("link", "add", "dev", d.name, "type", "wireguard"); err != nil {
+			return nil, err
+		}
+		slog.Info("Created WireGuard interface", "interface", d.name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	keepalive := time.Duration(settings.PersistentKeepalive) * time.Second
+	mark := tunnelTable
+	err = d.wg.ConfigureDevice(d.name, wgtypes.Config{
+		PrivateKey:   &key,
+		FirewallMark: &mark,
+		ReplacePeers: true,
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:                   serverKey,
+			Endpoint:                    endpoint,
+			AllowedIPs:                  allowed,
+			ReplaceAllowedIPs:           true,
+			PersistentKeepaliveInterval: &keepalive,
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure %s: %w", d.name, err)
+	}
+
+	address := settings.Address
+	if address == "" {
+		// Servers that do not send the tunnel network
+		address = hostAddress(settings.Peer.IP)
+	}
+	if prev != nil && (prev.Peer.IP != settings.Peer.IP || prev.Address != settings.Address) {
+		if err := ip("address", "flush", "dev", d.name); err != nil {
+			return nil, err
+		}
+	}
+	// The prefix length routes the tunnel network, and the server, through
+	// the interface
+	if err := ip("address", "replace", address, "dev", d.name); err != nil {
+		return nil, err
+	}
+	if err := ip("link", "set", "up", "dev", d.name); err != nil {
+		return nil, err
+	}
+
+	var routes []string
+	for _, network := range allowed {
+		var err error
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			err = d.routeDefault(network)
+		} else {
+			err = ip("route", "replace", network.String(), "dev", d.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, network.String())
+	}
+	for _, route := range prevRoutes {
+		if !slices.Contains(routes, route) {
+			d.unroute(route)
+		}
+	}
+	return routes, nil
+}
+
+// routeDefault sends all traffic of the family of network through the
+// tunnel with policy routing, the way wg-quick does.
+func (d *device) routeDefault(network net.IPNet) error {
+	family, table := familyOf(network.String()), strconv.Itoa(tunnelTable)
+	if family == "-4" {
+		// Without it the mark of the reply packets is not used by the reverse
+		// path filter
+		if err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0644); err != nil {
+			slog.Warn("Failed to set src_valid_mark", "error", err)
+		}
+	}
+	if err := ip(family, "route", "replace", network.String(), "dev", d.name, "table", table); err != nil {
+		return err
+	}
+	// Rules are not replaced in place, drop them first so they are not doubled
+	removeDefaultRules(family)
+	if err := ip(family, "rule", "add", "not", "fwmark", table, "table", table); err != nil {
+		return err
+	}
+	return ip(family, "rule", "add", "table", "main", "suppress_prefixlength", "0")
+}
+
+// unroute removes a route installed by apply.
+func (d *device) unroute(route string) {
+	if _, network, err := net.ParseCIDR(route); err == nil {
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			family := familyOf(route)
+			removeDefaultRules(family)
+			if err := ip(family, "route", "del", route, "dev", d.name, "table", strconv.Itoa(tunnelTable)); err != nil {
+				slog.Warn("Failed to remove route", "route", route, "error", err)
+			}
+			return
+		}
+	}
+	if err := ip("route", "del", route, "dev", d.name); err != nil {
+		slog.Warn("Failed to remove route", "route", route, "error", err)
+	}
+}
+
+func removeDefaultRules(family string) {
+	table := strconv.Itoa(tunnelTable)
+	// Errors mean the rules were not there
+	ip(family, "rule", "del", "not", "fwmark", table, "table", table)
+	ip(family, "rule", "del", "table", "main", "suppress_prefixlength", "0")
+}
+
+func familyOf(cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return "-6"
+	}
+	return "-4"
+}
+
+// down removes the interface, together with its addresses and routes, and
+// the policy rules of the routes.
+func (d *device) down(routes []string) error {
+	for _, route := range routes {
+		if _, network, err := net.ParseCIDR(route); err == nil {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				removeDefaultRules(familyOf(route))
+			}
+		}
+	}
+	if _, err := d.wg.Device(d.name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return ip("link", "del", "dev", d.name)
+}
+
+func hostAddress(addr string) string {
+	if parsed := net.ParseIP(addr); parsed != nil && parsed.To4() == nil {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
+
+func ip(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v\nOutput: %s", strings.Join(args, " "), err, string(output))
+	}
+	return nil
+}
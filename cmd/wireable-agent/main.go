@@ -0,0 +1,147 @@
+// Command wireable-agent enrolls an edge device as a peer and keeps its
+// WireGuard interface configured. The key pair is generated on the device;
+// only the public key is sent to the server.
+//
+// It reads .env, a config file and flags like the server, see README.md.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Zacky3181V/wireable/client"
+	"github.com/Zacky3181V/wireable/logging"
+	"github.com/Zacky3181V/wireable/settings"
+)
+
+// Config selects the server, how the agent authenticates and the interface it
+// manages.
+type Config struct {
+	Server            string
+	Interface         string
+	Profile           string
+	StateFile         string
+	HeartbeatInterval time.Duration
+	// RotateInterval is how often the key is replaced, zero for never. Keys
+	// are also replaced after two thirds of the lifetime of an expiring peer.
+	RotateInterval time.Duration
+
+	TokenFile string
+	Username  string
+	Password  settings.Secret
+	CertFile  string
+	KeyFile   string
+	CAFile    string
+
+	Log logging.Config
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Server:            s.String("WIREABLE_URL", ""),
+		Interface:         s.String("AGENT_INTERFACE", "wireable"),
+		Profile:           s.String("AGENT_PROFILE", ""),
+		StateFile:         s.String("AGENT_STATE_FILE", "/var/lib/wireable-agent/state.json"),
+		HeartbeatInterval: s.Duration("AGENT_HEARTBEAT_INTERVAL", time.Minute),
+		RotateInterval:    s.Duration("AGENT_ROTATE_INTERVAL", 0),
+		TokenFile:         s.String("AGENT_TOKEN_FILE", ""),
+		Username:          s.String("AGENT_USERNAME", ""),
+		Password:          s.Secret("WIREABLE_PASSWORD"),
+		CertFile:          s.String("AGENT_CERT_FILE", ""),
+		KeyFile:           s.String("AGENT_KEY_FILE", ""),
+		CAFile:            s.String("AGENT_CA_FILE", ""),
+		Log:               logging.ConfigFrom(s),
+	}
+	if cfg.Server == "" {
+		s.Invalid("WIREABLE_URL", "", errors.New("the API address is required"))
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		s.Invalid("AGENT_HEARTBEAT_INTERVAL", cfg.HeartbeatInterval.String(), errors.New("must be positive"))
+	}
+	if cfg.RotateInterval < 0 {
+		s.Invalid("AGENT_ROTATE_INTERVAL", cfg.RotateInterval.String(), errors.New("must not be negative"))
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		s.Fail(errors.New("AGENT_CERT_FILE and AGENT_KEY_FILE must be set together"))
+	}
+	if cfg.TokenFile == "" && cfg.Username == "" && cfg.CertFile == "" {
+		s.Fail(errors.New("one of AGENT_TOKEN_FILE, AGENT_USERNAME or AGENT_CERT_FILE is required"))
+	}
+	return cfg
+}
+
+func main() {
+	s, err := settings.Load(os.Args[1:])
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	cfg := ConfigFrom(s)
+	if err := s.Err(); err != nil {
+		fatal("Invalid configuration", err)
+	}
+	slog.SetDefault(logging.New(cfg.Log, os.Stderr))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	api, err := newClient(cfg)
+	if err != nil {
+		fatal("Failed to set up the API client", err)
+	}
+	dev, err := openDevice(cfg.Interface)
+	if err != nil {
+		fatal("Failed to open WireGuard", err)
+	}
+	defer dev.Close()
+
+	a := &agent{
+		cfg: cfg,
+		api: api,
+		dev: dev,
+	}
+	if err := a.run(ctx); err != nil {
+		fatal("Agent stopped", err)
+	}
+}
+
+// newClient returns an API client, presenting the client certificate when
+// one is configured.
+func newClient(cfg Config) (*client.Client, error) {
+	c := client.New(cfg.Server, "")
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.HTTPClient.Transport = transport
+	return c, nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
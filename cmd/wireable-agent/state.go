@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/client"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// state is what the agent keeps between restarts. It holds the private key,
+// so it is only readable by its owner.
+type state struct {
+	PeerID     string `json:"peer_id,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	// PendingKey is a new key sent to the server whose answer has not been
+	// seen yet. It is adopted once the server reports its public key.
+	PendingKey string `json:"pending_key,omitempty"`
+	// Revoked is set when the server no longer knows the peer, so a restart
+	// does not silently enroll a device an admin revoked.
+	Revoked bool `json:"revoked,omitempty"`
+
+	// Applied is the configuration the interface was last set up with.
+	Applied *api.PeerSettings `json:"applied,omitempty"`
+	Routes  []string          `json:"routes,omitempty"`
+}
+
+func loadState(path string) (*state, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &state{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// save replaces the state file atomically.
+func (st *state) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return client.WriteFile(path, data)
+}
+
+func (st *state) key() (wgtypes.Key, error) {
+	return wgtypes.ParseKey(st.PrivateKey)
+}
+
+func publicKeyOf(privateKey string) string {
+	key, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return ""
+	}
+	return key.PublicKey().String()
+}
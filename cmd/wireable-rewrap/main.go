@@ -0,0 +1,84 @@
+// Command wireable-rewrap re-encrypts the sealed fields of every peer record
+// with the latest key version after a key rotation. Records stored in plain
+// text, e.g. before PEER_ENCRYPTION was enabled, are sealed as well.
+//
+// It reads the same environment, .env, config file and flags as the server.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/logging"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	"github.com/hashicorp/vault/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func main() {
+	s, err := settings.Load(os.Args[1:])
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	logConfig := logging.ConfigFrom(s)
+	storeConfig := allocator.StoreConfigFrom(s)
+	cipherConfig := allocator.CipherConfigFrom(s)
+	vaultConfig := vaultclient.ConfigFrom(s)
+	etcdEndpoints := s.List("ETCD_ENDPOINT")
+	if err := s.ValueErr(); err != nil {
+		fatal("Invalid configuration", err)
+	}
+
+	logger := logging.New(logConfig, os.Stderr)
+	slog.SetDefault(logger)
+	allocator.SetLogger(logger)
+	vaultclient.SetLogger(logger)
+	ctx := context.Background()
+
+	var cli *clientv3.Client
+	if storeConfig.NeedsEtcd() {
+		cli, err = clientv3.New(clientv3.Config{
+			Endpoints:   etcdEndpoints,
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			fatal("Failed to connect to etcd", err)
+		}
+		defer cli.Close()
+	}
+
+	store, err := allocator.OpenStore(storeConfig, cli)
+	if err != nil {
+		fatal("Failed to open pool store", err)
+	}
+	defer store.Close()
+
+	var vc *api.Client
+	if cipherConfig.Mode == "transit" {
+		if vc, err = vaultclient.InitClient(vaultConfig); err != nil {
+			fatal("Failed to initialize Vault client", err)
+		}
+	}
+
+	peerCipher, err := allocator.NewCipher(cipherConfig, vc)
+	if err != nil {
+		fatal("Failed to set up peer record encryption", err)
+	}
+	allocator.SetCipher(peerCipher, cipherConfig.Fields)
+
+	rewritten, err := allocator.RewrapRecords(ctx, store)
+	if err != nil {
+		slog.Error("Rewrap failed", "rewrapped", rewritten, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Rewrapped peer records", "count", rewritten)
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/api"
+)
+
+// tokenCache is the token of the last login and the server it is valid for.
+type tokenCache struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func tokenCachePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wireable", "token.json"), nil
+}
+
+func loadTokenCache() (tokenCache, error) {
+	var cache tokenCache
+	path, err := tokenCachePath()
+	if err != nil {
+		return cache, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return cache, fmt.Errorf("corrupt token cache %s: %w", path, err)
+	}
+	return cache, nil
+}
+
+func saveTokenCache(cache tokenCache) error {
+	path, err := tokenCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func login(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("login")
+	username := fs.String("username", os.Getenv("WIREABLE_USERNAME"), "user name (default WIREABLE_USERNAME)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	if *username == "" {
+		fmt.Fprint(os.Stderr, "Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read username: %w", err)
+		}
+		*username = strings.TrimSpace(line)
+	}
+	password := os.Getenv("WIREABLE_PASSWORD")
+	if *passwordStdin || password == "" {
+		if !*passwordStdin {
+			fmt.Fprint(os.Stderr, "Password: ")
+		}
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	token, err := c.client.Login(ctx, api.Credentials{Username: *username, Password: password})
+	if err != nil {
+		return err
+	}
+	if err := saveTokenCache(tokenCache{Server: c.server, Token: token}); err != nil {
+		return fmt.Errorf("failed to cache token: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "Logged in to", c.server)
+	return nil
+}
+
+func logout() error {
+	path, err := tokenCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Command wireablectl manages peers, pools and profiles through the Wireable
+// API.
+//
+//	wireablectl [--server URL] [-o table|json] <command> [arguments]
+//
+// The server defaults to WIREABLE_URL, then to the server of the last login.
+// The token is taken from WIREABLE_TOKEN or from the cache written by login.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/Zacky3181V/wireable/client"
+)
+
+const defaultServer = "http://localhost:8081"
+
+const usage = `Usage: wireablectl [--server URL] [-o table|json] <command> [arguments]
+
+Commands:
+  login [--username NAME] [--password-stdin]
+  logout
+  peers list [--owner NAME]
+  peers get ID
+  peers generate [--profile NAME] [--write INTERFACE] [--dir DIR] [--force]
+  peers enroll [--profile NAME] [--interface INTERFACE] [--dir DIR] [--force]
+  peers revoke ID
+  peers rotate ID [--write INTERFACE] [--dir DIR] [--force]
+  peers config ID [--write INTERFACE] [--dir DIR] [--force]
+  pools stats [NAME]
+  profiles list
+  profiles get NAME
+  profiles put NAME --endpoint HOST:PORT --allowed-ips CIDRS [--dns IP] [--keepalive SECONDS] [--escrow]
+  profiles delete NAME
+
+Flags:
+`
+
+// cli holds the global flags and the client built from them.
+type cli struct {
+	server string
+	output string
+	client *client.Client
+}
+
+type command func(ctx context.Context, c *cli, args []string) error
+
+var commands = map[string]map[string]command{
+	"peers": {
+		"list":     peersList,
+		"get":      peersGet,
+		"generate": peersGenerate,
+		"enroll":   peersEnroll,
+		"revoke":   peersRevoke,
+		"rotate":   peersRotate,
+		"config":   peersConfig,
+	},
+	"pools": {
+		"stats": poolsStats,
+	},
+	"profiles": {
+		"list":   profilesList,
+		"get":    profilesGet,
+		"put":    profilesPut,
+		"delete": profilesDelete,
+	},
+}
+
+func main() {
+	c := &cli{}
+	flag.StringVar(&c.server, "server", "", "API address, e.g. https://wireable.example.com (default WIREABLE_URL)")
+	flag.StringVar(&c.output, "o", "table", "output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, c, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "wireablectl:", err)
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && flag.Arg(0) != "login" {
+			fmt.Fprintln(os.Stderr, "Run wireablectl login to get a new token.")
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, c *cli, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return errors.New("no command given")
+	}
+
+	cache, err := loadTokenCache()
+	if err != nil {
+		return err
+	}
+	if c.server == "" {
+		c.server = os.Getenv("WIREABLE_URL")
+	}
+	if c.server == "" {
+		c.server = cache.Server
+	}
+	if c.server == "" {
+		c.server = defaultServer
+	}
+	token := os.Getenv("WIREABLE_TOKEN")
+	if token == "" && cache.Server == c.server {
+		token = cache.Token
+	}
+	c.client = client.New(c.server, token)
+
+	switch args[0] {
+	case "login":
+		return login(ctx, c, args[1:])
+	case "logout":
+		return logout()
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("%s needs a subcommand", args[0])
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+	return cmd(ctx, c, args[2:])
+}
+
+// flagSet returns the flag set of a subcommand, which accepts -o as well.
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.output, "o", c.output, "output format: table or json")
+	return fs
+}
+
+// parseArgs parses the flags of a subcommand, which may come before or after
+// its arguments, and returns the arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseFlags is parseArgs for subcommands that take exactly nargs arguments.
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != nargs {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", fs.Name(), nargs, len(positional))
+	}
+	return positional, nil
+}
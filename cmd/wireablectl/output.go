@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/client"
+)
+
+// print writes v as JSON, or as a table of rows under header.
+func (c *cli) print(v any, header []string, rows [][]string) error {
+	switch c.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "table":
+	default:
+		return fmt.Errorf("unknown output format %q", c.output)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// printPeers prints v, which is peers or the only peer, as JSON or as a
+// table of peers.
+func (c *cli) printPeers(v any, peers ...api.Peer) error {
+	rows := make([][]string, len(peers))
+	for i, p := range peers {
+		status := "-"
+		if p.Status != nil {
+			status = p.Status.State
+		}
+		rows[i] = []string{p.ID, p.IP, p.Owner, p.Profile, status, formatTime(&p.CreatedAt), formatTime(p.ExpiresAt), p.PublicKey}
+	}
+	return c.print(v, []string{"ID", "IP", "OWNER", "PROFILE", "STATUS", "CREATED", "EXPIRES", "PUBLIC KEY"}, rows)
+}
+
+func (c *cli) printProfiles(v any, profiles ...api.Profile) error {
+	rows := make([][]string, len(profiles))
+	for i, p := range profiles {
+		rows[i] = []string{p.Name, p.Endpoint, p.AllowedIPs, p.DNS, strconv.Itoa(p.PersistentKeepalive), strconv.FormatBool(p.EscrowPrivateKey)}
+	}
+	return c.print(v, []string{"NAME", "ENDPOINT", "ALLOWED IPS", "DNS", "KEEPALIVE", "ESCROW"}, rows)
+}
+
+// printConfig prints a peer config, or writes it to dir/iface.conf when iface
+// is set.
+func (c *cli) printConfig(config *client.PeerConfig, iface, dir string, force bool) error {
+	if iface == "" {
+		if c.output == "json" {
+			return c.print(struct {
+				PeerID string `json:"peer_id"`
+				Config string `json:"config"`
+			}{config.PeerID, config.Config}, nil, nil)
+		}
+		fmt.Fprintf(os.Stderr, "Peer %s\n", config.PeerID)
+		_, err := fmt.Print(config.Config)
+		return err
+	}
+
+	path, err := configPath(dir, iface, force)
+	if err != nil {
+		return err
+	}
+	if err := client.WriteFile(path, []byte(config.Config)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Peer %s written to %s\n", config.PeerID, path)
+	return nil
+}
+
+// configPath returns dir/iface.conf. An existing file is only replaced when
+// force is set, since it may belong to another interface.
+func configPath(dir, iface string, force bool) (string, error) {
+	if iface != filepath.Base(iface) || iface == "." || iface == ".." {
+		return "", fmt.Errorf("invalid interface name %q", iface)
+	}
+	path := filepath.Join(dir, iface+".conf")
+	if _, err := os.Stat(path); err == nil && !force {
+		return "", fmt.Errorf("%s already exists, use --force to replace it", path)
+	}
+	return path, nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Zacky3181V/wireable/client"
+)
+
+const defaultConfigDir = "/etc/wireguard"
+
+// writeFlags are the flags of commands that return a peer config.
+type writeFlags struct {
+	iface string
+	dir   string
+	force bool
+}
+
+func (w *writeFlags) register(fs *flag.FlagSet, ifaceFlag, ifaceDefault string) {
+	fs.StringVar(&w.iface, ifaceFlag, ifaceDefault, "write the config to DIR/INTERFACE.conf instead of printing it")
+	fs.StringVar(&w.dir, "dir", defaultConfigDir, "directory the config is written to")
+	fs.BoolVar(&w.force, "force", false, "replace an existing config")
+}
+
+func peersList(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("peers list")
+	owner := fs.String("owner", "", "only peers of this owner (admin only)")
+	state := fs.String("state", "", "only peers in this state, online or offline")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	peers, err := c.client.ListPeers(ctx, *owner, *state)
+	if err != nil {
+		return err
+	}
+	return c.printPeers(peers, peers...)
+}
+
+func peersGet(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("peers get")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	peer, err := c.client.GetPeer(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printPeers(peer, *peer)
+}
+
+func peersGenerate(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("peers generate")
+	profile := fs.String("profile", "", "client profile (default: default)")
+	var w writeFlags
+	w.register(fs, "write", "")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	return generate(ctx, c, *profile, w)
+}
+
+// peersEnroll generates a peer for this host and installs its config, ready
+// for wg-quick up.
+func peersEnroll(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("peers enroll")
+	profile := fs.String("profile", "", "client profile (default: default)")
+	var w writeFlags
+	w.register(fs, "interface", "wireable")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if w.iface == "" {
+		return fmt.Errorf("--interface must not be empty")
+	}
+	if err := generate(ctx, c, *profile, w); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Bring it up with: wg-quick up %s\n", w.iface)
+	return nil
+}
+
+func generate(ctx context.Context, c *cli, profile string, w writeFlags) error {
+	if w.iface != "" {
+		// Fail before a peer is allocated whose config could not be saved
+		if _, err := configPath(w.dir, w.iface, w.force); err != nil {
+			return err
+		}
+	}
+	config, err := c.client.Generate(ctx, profile)
+	if err != nil {
+		return err
+	}
+	return c.printConfig(config, w.iface, w.dir, w.force)
+}
+
+func peersRevoke(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("peers revoke")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.client.RevokePeer(ctx, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Peer %s revoked\n", args[0])
+	return nil
+}
+
+func peersRotate(ctx context.Context, c *cli, args []string) error {
+	return peerConfigCommand(ctx, c, "peers rotate", args, c.client.RotatePeer)
+}
+
+func peersConfig(ctx context.Context, c *cli, args []string) error {
+	return peerConfigCommand(ctx, c, "peers config", args, c.client.DownloadConfig)
+}
+
+func peerConfigCommand(ctx context.Context, c *cli, name string, args []string, fetch func(context.Context, string) (*client.PeerConfig, error)) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var w writeFlags
+	w.register(fs, "write", "")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	config, err := fetch(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printConfig(config, w.iface, w.dir, w.force)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Zacky3181V/wireable/api"
+)
+
+func poolsStats(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("pools stats")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	name := "default"
+	switch len(args) {
+	case 0:
+	case 1:
+		name = args[0]
+	default:
+		return fmt.Errorf("pools stats takes at most one argument")
+	}
+
+	stats, err := c.client.PoolStats(ctx, name)
+	if err != nil {
+		return err
+	}
+	return c.print(stats, []string{"NAME", "TOTAL", "AVAILABLE", "TAKEN", "RESERVED", "EXPIRING", "UTILIZATION"}, [][]string{{
+		stats.Name,
+		strconv.Itoa(stats.Total),
+		strconv.Itoa(stats.Available),
+		strconv.Itoa(stats.Taken),
+		strconv.Itoa(stats.Reserved),
+		strconv.Itoa(stats.Expiring),
+		strconv.FormatFloat(stats.Utilization, 'f', 1, 64) + "%",
+	}})
+}
+
+func profilesList(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("profiles list")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	profiles, err := c.client.ListProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printProfiles(profiles, profiles...)
+}
+
+func profilesGet(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("profiles get")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	profile, err := c.client.GetProfile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printProfiles(profile, *profile)
+}
+
+func profilesPut(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("profiles put")
+	var profile api.Profile
+	fs.StringVar(&profile.Endpoint, "endpoint", "", "server endpoint, host:port")
+	fs.StringVar(&profile.AllowedIPs, "allowed-ips", "", "comma separated networks routed through the tunnel")
+	fs.StringVar(&profile.DNS, "dns", "", "DNS server of the client")
+	fs.IntVar(&profile.PersistentKeepalive, "keepalive", 25, "persistent keepalive in seconds, 0 to disable")
+	fs.BoolVar(&profile.EscrowPrivateKey, "escrow", false, "escrow client private keys in Vault")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	profile.Name = args[0]
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	stored, err := c.client.PutProfile(ctx, profile)
+	if err != nil {
+		return err
+	}
+	return c.printProfiles(stored, *stored)
+}
+
+func profilesDelete(ctx context.Context, c *cli, args []string) error {
+	fs := c.flagSet("profiles delete")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.client.DeleteProfile(ctx, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Profile %s deleted\n", args[0])
+	return nil
+}
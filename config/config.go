@@ -1,100 +1,200 @@
 package config
 
 import (
-	"container/heap"
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/settings"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var (
-	wgAllocator        *allocator.IPAllocator
-	serverPrivateKey   wgtypes.Key
-	serverPublicKey    wgtypes.Key
-	privateKeyFile     = "server_private.key"
-	wasKeyGeneratedNow bool
-	ipHeap             allocator.IPHeap
+// Config describes the WireGuard server and where the pool is stored.
+type Config struct {
+	// Interface is the name of the server's WireGuard interface.
+	Interface string
+	// Address is the server address written to a new peers file.
+	Address    string
+	ListenPort int
+	// PrivateKeyFile holds the server key, generated on first start.
+	PrivateKeyFile string
+	// PeersFile is the wg-quick config of the server interface.
+	PeersFile    string
+	TemplatesDir string
+	// EtcdEndpoints is empty when the service runs without etcd.
+	EtcdEndpoints []string
+	// SeedCIDR is added to the pool on startup when set.
+	SeedCIDR string
+	Store    allocator.StoreConfig
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Interface:      s.String("WG_INTERFACE", "wg0"),
+		Address:        s.String("WG_ADDRESS", "10.0.0.1/24"),
+		ListenPort:     s.Int("WG_LISTEN_PORT", 51820),
+		PrivateKeyFile: s.String("WG_PRIVATE_KEY_FILE", "server_private.key"),
+		PeersFile:      s.String("WG_PEERS_FILE", "peers.conf"),
+		TemplatesDir:   s.String("TEMPLATES_DIR", "templates"),
+		EtcdEndpoints:  s.List("ETCD_ENDPOINT"),
+		SeedCIDR:       s.String("POOL_SEED_CIDR", ""),
+		Store:          allocator.StoreConfigFrom(s),
+	}
+	if _, _, err := net.ParseCIDR(cfg.Address); err != nil {
+		s.Invalid("WG_ADDRESS", cfg.Address, err)
+	}
+	if cfg.ListenPort < 1 || cfg.ListenPort > 65535 {
+		s.Invalid("WG_LISTEN_PORT", strconv.Itoa(cfg.ListenPort), errors.New("not a port"))
+	}
+	if cfg.SeedCIDR != "" {
+		if _, _, err := net.ParseCIDR(cfg.SeedCIDR); err != nil {
+			s.Invalid("POOL_SEED_CIDR", cfg.SeedCIDR, err)
+		}
+	}
+	if cfg.Store.NeedsEtcd() && len(cfg.EtcdEndpoints) == 0 {
+		s.Invalid("ETCD_ENDPOINT", "", errors.New("required by the etcd pool store"))
+	}
+	return cfg
+}
+
+// Server holds the WireGuard server key and the pool storage, set up from a
+// Config.
+type Server struct {
+	cfg        Config
+	privateKey wgtypes.Key
+	publicKey  wgtypes.Key
+	ipHeap     *allocator.IPHeap
 	etcdClient *clientv3.Client
-	once               sync.Once
-)
+	poolStore  allocator.PoolStore
+}
 
-func init() {
+// New loads the server key, or generates it together with a fresh peers
+// file on first start.
+func New(c Config) (*Server, error) {
+	s := &Server{cfg: c}
+	var generated bool
 	var err error
-	wgAllocator, err = allocator.NewIPAllocator("10.0.0.0/24")
+	s.privateKey, s.publicKey, generated, err = s.loadOrGenerateServerKeys()
 	if err != nil {
-		log.Fatalf("Failed to initialize IPAllocator: %v", err)
+		return nil, fmt.Errorf("failed to initialize WireGuard server keys: %w", err)
 	}
-	log.Println("IPAllocator initialized successfully.")
 
-	serverPrivateKey, serverPublicKey, wasKeyGeneratedNow, err = loadOrGenerateServerKeys()
-	if err != nil {
-		log.Fatalf("Failed to initialize WireGuard server keys: %v", err)
+	if !generated {
+		slog.Info("Using existing WireGuard private key. Skipping config rewrite")
+		return s, nil
 	}
-	log.Println("WireGuard server keys initialized.")
-
-	if wasKeyGeneratedNow {
-		log.Println("New WireGuard private key generated. Creating fresh server config")
-		writeInitialPeersFile(serverPrivateKey.String())
-	} else {
-		log.Println("Using existing WireGuard private key. Skipping config rewrite")
+	slog.Info("New WireGuard private key generated. Creating fresh server config")
+	if err := s.writeInitialPeersFile(s.privateKey.String()); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", c.PeersFile, err)
 	}
+	return s, nil
 }
 
-func InitEtcdAndHeap(ctx context.Context) error {
+// OpenStorage opens the pool store and builds the heap of available IPs.
+// etcd is connected when the store needs it or when endpoints are
+// configured; without it the audit log, rate limits and stored profiles are
+// unavailable.
+func (s *Server) OpenStorage(ctx context.Context) error {
 	var err error
-	once.Do(func() {
-		etcdClient, err = clientv3.New(clientv3.Config{
-			Endpoints:   []string{os.Getenv("ETCD_ENDPOINT")},
+	if len(s.cfg.EtcdEndpoints) > 0 {
+		s.etcdClient, err = clientv3.New(clientv3.Config{
+			Endpoints:   s.cfg.EtcdEndpoints,
 			DialTimeout: 5 * time.Second,
 		})
 		if err != nil {
-			return
+			return err
 		}
-		log.Println("Connected to etcd")
+		slog.InfoContext(ctx, "Connected to etcd")
+	}
 
-		availableIPs, err := allocator.LoadAvailableIPs(ctx, etcdClient)
-		if err != nil {
-			log.Fatalf("Failed to load available IPs: %v", err)
+	s.poolStore, err = allocator.OpenStore(s.cfg.Store, s.etcdClient)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Using pool store", "backend", s.cfg.Store.Backend)
+
+	if s.cfg.SeedCIDR != "" {
+		if err := allocator.SeedCIDR(ctx, s.poolStore, s.cfg.SeedCIDR, s.cfg.Store.Reserved); err != nil {
+			return err
 		}
-		log.Printf("Loaded available IPs from etcd")
+		slog.InfoContext(ctx, "Seeded pool", "cidr", s.cfg.SeedCIDR)
+	}
 
-		ipHeap = allocator.IPHeap(availableIPs)
-		heap.Init(&ipHeap)
-		log.Println("Initialized IP Heap")
-	})
-	return err
+	availableIPs, _, err := allocator.LoadAvailableIPs(ctx, s.poolStore)
+	if err != nil {
+		return fmt.Errorf("failed to load available IPs: %w", err)
+	}
+	slog.InfoContext(ctx, "Loaded available IPs from the pool store")
+
+	s.ipHeap = allocator.NewIPHeap(availableIPs)
+	slog.InfoContext(ctx, "Initialized IP Heap")
+	return nil
+}
+
+// Close closes the pool store and the etcd client opened by OpenStorage.
+func (s *Server) Close() error {
+	var errs []error
+	if s.poolStore != nil {
+		errs = append(errs, s.poolStore.Close())
+	}
+	if s.etcdClient != nil {
+		errs = append(errs, s.etcdClient.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// PeerAddress returns ip with the prefix length of the tunnel network, taken
+// from WG_ADDRESS, so the peer reaches the server and the other peers through
+// the tunnel.
+func (s *Server) PeerAddress(ip string) string {
+	_, network, err := net.ParseCIDR(s.cfg.Address)
+	if err != nil {
+		return ip
+	}
+	ones, _ := network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// EtcdClient returns nil when the service runs without etcd.
+func (s *Server) EtcdClient() *clientv3.Client {
+	return s.etcdClient
 }
 
-func GetEtcdClient() *clientv3.Client {
-	return etcdClient
+func (s *Server) IPHeap() *allocator.IPHeap {
+	return s.ipHeap
 }
 
-func GetIPHeap() *allocator.IPHeap {
-	return &ipHeap
+func (s *Server) PoolStore() allocator.PoolStore {
+	return s.poolStore
 }
 
-func GetAllocator() *allocator.IPAllocator {
-	return wgAllocator
+// Interface returns the name of the server's WireGuard interface.
+func (s *Server) Interface() string {
+	return s.cfg.Interface
 }
 
-func GetServerPublicKey() string {
-	return serverPublicKey.String()
+// TemplatePath returns the path of the template called name.
+func (s *Server) TemplatePath(name string) string {
+	return filepath.Join(s.cfg.TemplatesDir, name)
 }
 
-func GetServerPrivateKey() string {
-	return serverPrivateKey.String()
+func (s *Server) PublicKey() string {
+	return s.publicKey.String()
 }
 
-func loadOrGenerateServerKeys() (wgtypes.Key, wgtypes.Key, bool, error) {
+func (s *Server) loadOrGenerateServerKeys() (wgtypes.Key, wgtypes.Key, bool, error) {
 	// Try loading private key from file
-	if data, err := os.ReadFile(privateKeyFile); err == nil {
+	if data, err := os.ReadFile(s.cfg.PrivateKeyFile); err == nil {
 		privKey, err := wgtypes.ParseKey(string(data))
 		if err != nil {
 			return wgtypes.Key{}, wgtypes.Key{}, false, err
@@ -109,7 +209,7 @@ func loadOrGenerateServerKeys() (wgtypes.Key, wgtypes.Key, bool, error) {
 	}
 
 	// Save private key to file
-	err = os.WriteFile(privateKeyFile, []byte(privKey.String()), 0600)
+	err = os.WriteFile(s.cfg.PrivateKeyFile, []byte(privKey.String()), 0600)
 	if err != nil {
 		return wgtypes.Key{}, wgtypes.Key{}, false, err
 	}
@@ -117,30 +217,69 @@ func loadOrGenerateServerKeys() (wgtypes.Key, wgtypes.Key, bool, error) {
 	return privKey, privKey.PublicKey(), true, nil
 }
 
-func writeInitialPeersFile(privateKey string) {
-	tmplContent, err := os.ReadFile("./templates/server_template.conf")
+func (s *Server) writeInitialPeersFile(privateKey string) error {
+	tmplContent, err := os.ReadFile(s.TemplatePath("server_template.conf"))
 	if err != nil {
-		log.Fatalf("Failed to read server template file %v", err)
+		return err
 	}
 
 	tmpl, err := template.New("server").Parse(string(tmplContent))
 	if err != nil {
-		log.Fatalf("Failed to parse template: %v", err)
+		return err
 	}
 
-	file, err := os.Create("peers.conf")
+	file, err := os.Create(s.cfg.PeersFile)
 	if err != nil {
-		log.Fatalf("Failed to create peers.conf: %v", err)
+		return err
 	}
 	defer file.Close()
 
-	err = tmpl.Execute(file, struct {
+	return tmpl.Execute(file, struct {
 		PrivateKey string
+		Interface  string
+		Address    string
+		ListenPort int
 	}{
 		PrivateKey: privateKey,
+		Interface:  s.cfg.Interface,
+		Address:    s.cfg.Address,
+		ListenPort: s.cfg.ListenPort,
 	})
+}
+
+// ServerAddresses returns the addresses of the server interface listed in
+// the peers file, in CIDR notation.
+func (s *Server) ServerAddresses() ([]string, error) {
+	data, err := os.ReadFile(s.cfg.PeersFile)
 	if err != nil {
-		log.Fatalf("Failed to execute template: %v", err)
+		return nil, err
 	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "Address" {
+			var addresses []string
+			for _, address := range strings.Split(value, ",") {
+				addresses = append(addresses, strings.TrimSpace(address))
+			}
+			return addresses, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no Address line", s.cfg.PeersFile)
+}
 
+// AddServerAddress appends address to the Address line of the server
+// interface in the peers file, so it survives a restart of the interface.
+func (s *Server) AddServerAddress(address string) error {
+	data, err := os.ReadFile(s.cfg.PeersFile)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if key, _, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "Address" {
+			lines[i] = strings.TrimRight(line, " ") + ", " + address
+			return os.WriteFile(s.cfg.PeersFile, []byte(strings.Join(lines, "\n")), 0600)
+		}
+	}
+	return fmt.Errorf("%s has no Address line", s.cfg.PeersFile)
 }
@@ -0,0 +1,195 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/authentication"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// keepaliveInterval is how often an idle stream sends a comment, so
+	// proxies do not close it.
+	keepaliveInterval      = 15 * time.Second
+	defaultDeadLetterLimit = 100
+)
+
+// @Summary Stream events
+// @Description Streams peer lifecycle events as Server-Sent Events; the event name is the type and the data an api.Event. Non-admins only receive the events of their own peers. With etcd, reconnecting with Last-Event-ID resumes after that event while it is retained.
+// @ID stream-events
+// @Produce text/event-stream
+// @Security BearerAuth
+// @Param type query string false "Comma separated event types, e.g. peer.offline,peer.revoked"
+// @Param Last-Event-ID header string false "ID of the last event received"
+// @Success 200 {object} api.Event
+// @Failure 400
+// @Failure 500
+// @Router /events [get]
+func StreamHandler(c *gin.Context) {
+	b := Get()
+	types := map[string]bool{}
+	if v := c.Query("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if !slices.Contains(Types, t) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type " + t})
+				return
+			}
+			types[t] = true
+		}
+	}
+	owner := ""
+	if !authentication.IsAdmin(c) {
+		owner = c.GetString("username")
+	}
+
+	ctx := c.Request.Context()
+	stream, cancel, err := b.subscribe(ctx, c.GetHeader("Last-Event-ID"))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to subscribe to events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to events"})
+		return
+	}
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.closed:
+			return
+		case <-keepalive.C:
+			fmt.Fprint(c.Writer, ": keepalive\n\n")
+		case event, ok := <-stream:
+			if !ok {
+				// The client reconnects and resumes from the last ID
+				return
+			}
+			if (len(types) > 0 && !types[event.Type]) || (owner != "" && event.Peer.Owner != owner) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		c.Writer.Flush()
+	}
+}
+
+// @Summary List dead letters
+// @Description Returns the events that webhooks did not accept after every retry, oldest first. Requires the admin role. When there are more letters, X-Next-Cursor holds the after value of the next page.
+// @ID list-dead-letters
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "Maximum number of letters (default 100, at most 1000)"
+// @Param after query string false "Cursor returned in X-Next-Cursor"
+// @Success 200 {array} api.DeadLetter
+// @Header 200 {string} X-Next-Cursor "Cursor of the next page"
+// @Failure 400
+// @Failure 403
+// @Failure 500
+// @Router /events/dead-letters [get]
+func ListDeadLettersHandler(c *gin.Context) {
+	limit := defaultDeadLetterLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(n, maxDeadLetters)
+	}
+	var after int64
+	if v := c.Query("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		after = n
+	}
+
+	letters, next, err := Get().DeadLetters(c.Request.Context(), after, limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list dead letters", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list dead letters"})
+		return
+	}
+	if next > 0 {
+		c.Header(api.NextCursorHeader, strconv.FormatInt(next, 10))
+	}
+	c.JSON(http.StatusOK, letters)
+}
+
+// @Summary Retry dead letter
+// @Description Delivers a dead letter to its webhook once more and removes it when the webhook accepts it. Requires the admin role.
+// @ID retry-dead-letter
+// @Security BearerAuth
+// @Param id path string true "Dead letter ID"
+// @Success 204
+// @Failure 403
+// @Failure 404
+// @Failure 409
+// @Failure 500
+// @Failure 502
+// @Router /events/dead-letters/{id}/retry [post]
+func RetryDeadLetterHandler(c *gin.Context) {
+	err := Get().RetryDeadLetter(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, ErrDeadLetterNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+	case errors.Is(err, ErrWebhookRemoved):
+		c.JSON(http.StatusConflict, gin.H{"error": "The webhook is no longer configured"})
+	case errors.Is(err, ErrDeliveryFailed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case err != nil:
+		slog.ErrorContext(c.Request.Context(), "Failed to retry dead letter", "id", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry dead letter"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Delete dead letter
+// @Description Drops a dead letter without delivering it. Requires the admin role.
+// @ID delete-dead-letter
+// @Security BearerAuth
+// @Param id path string true "Dead letter ID"
+// @Success 204
+// @Failure 403
+// @Failure 404
+// @Failure 500
+// @Router /events/dead-letters/{id} [delete]
+func DeleteDeadLetterHandler(c *gin.Context) {
+	err := Get().DeleteDeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete dead letter", "id", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete dead letter"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,412 @@
+// Package events publishes the lifecycle of peers to webhooks and to the
+// event stream. Events are published by the replica where they happen: it
+// delivers them to the webhooks and, with etcd, keeps them for a while under
+// /events/stream/ so the streams of every replica see them.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/leases"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	streamPrefix     = "/events/stream/"
+	queueSize        = 1000
+	subscriberBuffer = 100
+	// leaseBuckets is how many leases the events of one retention period
+	// share; an event is kept up to a tenth longer.
+	leaseBuckets = 10
+)
+
+// Types are the event types that are published.
+var Types = []string{
+	api.EventPeerCreated,
+	api.EventPeerRotated,
+	api.EventPeerRevoked,
+	api.EventPeerExpired,
+	api.EventPeerOnline,
+	api.EventPeerOffline,
+}
+
+// Config lists the webhooks events are posted to and how deliveries are
+// retried. Failed attempts are retried MaxAttempts times in total, waiting
+// RetryDelay and then twice as long each time. Retention is how long events
+// can be resumed from in the stream, DeadLetterRetention how long dead
+// letters are kept. WebhookSecret signs the webhook requests.
+type Config struct {
+	WebhookURLs         []string
+	WebhookSecret       settings.Secret
+	WebhookTimeout      time.Duration
+	MaxAttempts         int
+	RetryDelay          time.Duration
+	Retention           time.Duration
+	DeadLetterRetention time.Duration
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		WebhookSecret:       s.Secret("EVENT_WEBHOOK_SECRET"),
+		WebhookTimeout:      s.Duration("EVENT_WEBHOOK_TIMEOUT", 10*time.Second),
+		MaxAttempts:         s.Int("EVENT_WEBHOOK_MAX_ATTEMPTS", 8),
+		RetryDelay:          s.Duration("EVENT_WEBHOOK_RETRY_DELAY", 2*time.Second),
+		Retention:           s.Duration("EVENT_RETENTION", time.Hour),
+		DeadLetterRetention: s.Duration("EVENT_DEAD_LETTER_RETENTION", 7*24*time.Hour),
+	}
+	for _, v := range s.List("EVENT_WEBHOOK_URLS") {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.Invalid("EVENT_WEBHOOK_URLS", v, errors.New("expected an http or https URL"))
+			continue
+		}
+		cfg.WebhookURLs = append(cfg.WebhookURLs, v)
+	}
+	if len(cfg.WebhookURLs) > 0 && cfg.WebhookSecret == "" {
+		s.Fail(errors.New("EVENT_WEBHOOK_SECRET is required to sign the events sent to EVENT_WEBHOOK_URLS"))
+	}
+	if cfg.WebhookTimeout <= 0 {
+		s.Invalid("EVENT_WEBHOOK_TIMEOUT", cfg.WebhookTimeout.String(), errors.New("must be positive"))
+	}
+	if cfg.MaxAttempts < 1 {
+		s.Invalid("EVENT_WEBHOOK_MAX_ATTEMPTS", fmt.Sprint(cfg.MaxAttempts), errors.New("must be at least 1"))
+	}
+	if cfg.RetryDelay <= 0 {
+		s.Invalid("EVENT_WEBHOOK_RETRY_DELAY", cfg.RetryDelay.String(), errors.New("must be positive"))
+	}
+	if cfg.Retention < time.Second {
+		s.Invalid("EVENT_RETENTION", cfg.Retention.String(), errors.New("must be at least 1s"))
+	}
+	if cfg.DeadLetterRetention < time.Second {
+		s.Invalid("EVENT_DEAD_LETTER_RETENTION", cfg.DeadLetterRetention.String(), errors.New("must be at least 1s"))
+	}
+	return cfg
+}
+
+// Bus hands published events to the webhooks and the streams.
+type Bus struct {
+	cli *clientv3.Client
+	cfg Config
+	// streamLeases and deadLeases expire the events and dead letters
+	// written to etcd.
+	streamLeases *leases.Bucket
+	deadLeases   *leases.Bucket
+	// cipher seals the events kept in etcd, which name the owner of the
+	// peer. It is nil when peer records are not encrypted either.
+	cipher   allocator.FieldCipher
+	secret   []byte
+	client   *http.Client
+	webhooks []*webhook
+	// published is drained by Run, which writes the events to etcd or, without
+	// it, to the subscribers.
+	published chan api.Event
+	// overflow holds the events that did not fit in the queue of a webhook
+	// until Run dead-letters them, one at a time.
+	overflow chan overflowEvent
+
+	mu          sync.Mutex
+	subscribers map[chan api.Event]struct{}
+	// dead holds the dead letters when there is no etcd to keep them in,
+	// numbered by deadSeq in the order they were first saved.
+	dead    map[string]memoryLetter
+	deadSeq int64
+
+	// closed is closed when the server shuts down, to end the streams.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var bus *Bus
+
+// Init sets up the bus. cli may be nil, in which case streams only see the
+// events of this replica and cannot be resumed, and dead letters are kept in
+// memory. Events written to etcd are sealed with cipher, the cipher
+// of the peer records, unless it is nil.
+func Init(cli *clientv3.Client, cfg Config, cipher allocator.FieldCipher) *Bus {
+	b := &Bus{
+		cli:         cli,
+		cfg:         cfg,
+		cipher:      cipher,
+		secret:      []byte(cfg.WebhookSecret.Reveal()),
+		client:      &http.Client{Timeout: cfg.WebhookTimeout},
+		published:   make(chan api.Event, queueSize),
+		overflow:    make(chan overflowEvent, queueSize),
+		subscribers: make(map[chan api.Event]struct{}),
+		dead:        make(map[string]memoryLetter),
+		closed:      make(chan struct{}),
+	}
+	if cli != nil {
+		b.streamLeases = leases.NewBucket(cli, cfg.Retention, cfg.Retention/leaseBuckets)
+		b.deadLeases = leases.NewBucket(cli, cfg.DeadLetterRetention, cfg.DeadLetterRetention/leaseBuckets)
+	}
+	for _, u := range cfg.WebhookURLs {
+		b.webhooks = append(b.webhooks, &webhook{url: u, queue: make(chan api.Event, queueSize)})
+	}
+	bus = b
+	return b
+}
+
+// Get returns the bus set up by Init, or nil.
+func Get() *Bus {
+	return bus
+}
+
+// overflowEvent is an event that did not fit in the queue of the webhook at
+// url.
+type overflowEvent struct {
+	url   string
+	event api.Event
+}
+
+// Publish sends an event about peer to the webhooks and the streams. It does
+// not wait for either; events that do not fit in a full queue are logged and
+// dropped, or dead-lettered for webhooks while the dead-letter backlog has
+// room.
+func Publish(ctx context.Context, eventType, actor string, peer *api.Peer, details map[string]string) {
+	b := bus
+	if b == nil {
+		return
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish event", "type", eventType, "peer", peer.ID, "error", err)
+		return
+	}
+	event := api.Event{
+		ID:      hex.EncodeToString(id),
+		Type:    eventType,
+		Time:    time.Now().UTC(),
+		Actor:   actor,
+		Peer:    *peer,
+		Details: details,
+	}
+	published.Add(ctx, 1, typeAttribute(eventType))
+
+	select {
+	case b.published <- event:
+	default:
+		dropped.Add(ctx, 1, typeAttribute(eventType))
+		slog.ErrorContext(ctx, "Event queue is full, the event is not streamed", "event", event.ID, "type", eventType, "peer", peer.ID)
+	}
+	for _, w := range b.webhooks {
+		select {
+		case w.queue <- event:
+		default:
+			select {
+			case b.overflow <- overflowEvent{url: w.url, event: event}:
+			default:
+				deliveries.Add(ctx, 1, resultAttribute("dropped"))
+				slog.ErrorContext(ctx, "Webhook and dead-letter queues are full, the event is dropped", "url", w.url, "event", event.ID, "type", eventType)
+			}
+		}
+	}
+}
+
+// Record publishes an event caused by the current request.
+func Record(c *gin.Context, eventType string, peer *api.Peer, details map[string]string) {
+	Publish(c.Request.Context(), eventType, c.GetString("username"), peer, details)
+}
+
+// Run delivers published events until ctx is done. Events still queued for a
+// webhook then are dead-lettered.
+func (b *Bus) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range b.webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.runWebhook(ctx, w)
+		}()
+	}
+	if len(b.webhooks) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.runOverflow(ctx)
+		}()
+	}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-b.published:
+			if err := b.broadcast(ctx, event); err != nil {
+				slog.ErrorContext(ctx, "Failed to stream event", "event", event.ID, "type", event.Type, "error", err)
+			}
+		}
+	}
+}
+
+// CloseStreams ends every open stream. It is called when the server shuts
+// down, which would otherwise wait for the streams to end.
+func (b *Bus) CloseStreams() {
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+// broadcast writes event to etcd, where the streams watch for it, or hands it
+// to the subscribers directly. Subscribers that fall behind are
+// disconnected, so they notice they missed events.
+func (b *Bus) broadcast(ctx context.Context, event api.Event) error {
+	if b.cli == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for ch := range b.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+		return nil
+	}
+
+	key := streamPrefix + event.ID
+	data, err := b.seal(ctx, key, event)
+	if err != nil {
+		return err
+	}
+	return b.streamLeases.Put(ctx, key, string(data))
+}
+
+// sealedValue is how events and dead letters are kept in etcd when they are
+// encrypted.
+// Bound is set when Sealed is bound to the key it is stored under.
+type sealedValue struct {
+	Sealed string `json:"sealed"`
+	Bound  bool   `json:"bound,omitempty"`
+}
+
+// seal encodes v for the etcd key, encrypted when the bus has a cipher.
+func (b *Bus) seal(ctx context.Context, key string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || b.cipher == nil {
+		return data, err
+	}
+	sealed, err := b.cipher.Encrypt(ctx, data, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt event: %w", err)
+	}
+	return json.Marshal(sealedValue{Sealed: sealed, Bound: true})
+}
+
+// unseal decodes values written by seal under keys into the values returned
+// by target, decrypting them in a single batch. Values written before
+// encryption was enabled are read as they are.
+func (b *Bus) unseal(ctx context.Context, keys []string, values [][]byte, target func(i int) any) error {
+	plain := make([][]byte, len(values))
+	var ciphertexts []string
+	var aads [][]byte
+	var sealed []int
+	for i, value := range values {
+		var v sealedValue
+		if err := json.Unmarshal(value, &v); err == nil && v.Sealed != "" {
+			ciphertexts = append(ciphertexts, v.Sealed)
+			var aad []byte
+			if v.Bound {
+				aad = []byte(keys[i])
+			}
+			aads = append(aads, aad)
+			sealed = append(sealed, i)
+			continue
+		}
+		plain[i] = value
+	}
+	if len(ciphertexts) > 0 {
+		if b.cipher == nil {
+			return errors.New("events are encrypted but PEER_ENCRYPTION is not set")
+		}
+		plaintexts, err := b.cipher.Decrypt(ctx, ciphertexts, aads)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt events: %w", err)
+		}
+		for j, i := range sealed {
+			plain[i] = plaintexts[j]
+		}
+	}
+	for i, data := range plain {
+		if err := json.Unmarshal(data, target(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe returns the events published from now on, or after the event
+// lastID when it is still retained in etcd. The channel is closed when ctx
+// is done, when the subscriber falls behind or the watch fails. cancel must
+// be called once the events are no longer read.
+func (b *Bus) subscribe(ctx context.Context, lastID string) (<-chan api.Event, func(), error) {
+	if b.cli == nil {
+		ch := make(chan api.Event, subscriberBuffer)
+		b.mu.Lock()
+		b.subscribers[ch] = struct{}{}
+		b.mu.Unlock()
+		return ch, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subscribers[ch]; ok {
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if lastID != "" {
+		resp, err := b.cli.Get(ctx, streamPrefix+lastID)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		// An unknown ID has expired; the stream starts from now
+		if len(resp.Kvs) > 0 {
+			opts = append(opts, clientv3.WithRev(resp.Kvs[0].ModRevision+1))
+		}
+	}
+
+	ch := make(chan api.Event, subscriberBuffer)
+	watch := b.cli.Watch(clientv3.WithRequireLeader(ctx), streamPrefix, opts...)
+	go func() {
+		defer close(ch)
+		for resp := range watch {
+			if err := resp.Err(); err != nil {
+				slog.WarnContext(ctx, "Event stream watch failed", "error", err)
+				return
+			}
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				var event api.Event
+				if err := b.unseal(ctx, []string{string(ev.Kv.Key)}, [][]byte{ev.Kv.Value}, func(int) any { return &event }); err != nil {
+					slog.WarnContext(ctx, "Ignoring invalid event", "key", string(ev.Kv.Key), "error", err)
+					continue
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, cancel, nil
+}
@@ -0,0 +1,26 @@
+package events
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("wireable/events")
+
+var (
+	published, _ = meter.Int64Counter("wireable.events.published",
+		metric.WithDescription("Events published, by type"))
+	dropped, _ = meter.Int64Counter("wireable.events.dropped",
+		metric.WithDescription("Events left out of the stream because the queue was full, by type"))
+	deliveries, _ = meter.Int64Counter("wireable.webhook.deliveries",
+		metric.WithDescription("Webhook delivery attempts, by result: success, retry, dead or dropped"))
+)
+
+func typeAttribute(eventType string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("type", eventType))
+}
+
+func resultAttribute(result string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("result", result))
+}
@@ -0,0 +1,377 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	deadPrefix     = "/events/dead/"
+	maxRetryDelay  = 10 * time.Minute
+	maxDeadLetters = 1000
+	// buryTimeout bounds saving a dead letter once the bus is stopping.
+	buryTimeout = 5 * time.Second
+
+	SignatureHeader = "X-Wireable-Signature"
+	EventHeader     = "X-Wireable-Event"
+	DeliveryHeader  = "X-Wireable-Delivery"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrWebhookRemoved     = errors.New("webhook is no longer configured")
+	ErrDeliveryFailed     = errors.New("webhook delivery failed")
+)
+
+// webhook delivers events to url one at a time, so they arrive in order.
+type webhook struct {
+	url   string
+	queue chan api.Event
+}
+
+func (b *Bus) runWebhook(ctx context.Context, w *webhook) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-w.queue:
+					b.bury(ctx, w.url, event, 0, errors.New("not delivered before shutdown"))
+				default:
+					return
+				}
+			}
+		case event := <-w.queue:
+			b.deliver(ctx, w.url, event)
+		}
+	}
+}
+
+// runOverflow dead-letters the events that did not fit in the queue of their
+// webhook, including those still waiting when ctx is done.
+func (b *Bus) runOverflow(ctx context.Context) {
+	cause := errors.New("webhook queue is full")
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case o := <-b.overflow:
+					b.bury(ctx, o.url, o.event, 0, cause)
+				default:
+					return
+				}
+			}
+		case o := <-b.overflow:
+			b.bury(ctx, o.url, o.event, 0, cause)
+		}
+	}
+}
+
+// deliver posts event until the webhook accepts it or the attempts run out,
+// and dead-letters it then.
+func (b *Bus) deliver(ctx context.Context, url string, event api.Event) {
+	delay := b.cfg.RetryDelay
+	attempt := 1
+	for ; ; attempt++ {
+		err := b.post(ctx, url, event)
+		if err == nil {
+			deliveries.Add(ctx, 1, resultAttribute("success"))
+			return
+		}
+		if attempt == b.cfg.MaxAttempts {
+			b.bury(ctx, url, event, attempt, err)
+			return
+		}
+
+		deliveries.Add(ctx, 1, resultAttribute("retry"))
+		slog.WarnContext(ctx, "Webhook delivery failed, retrying", "url", url, "event", event.ID, "type", event.Type,
+			"attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			b.bury(ctx, url, event, attempt, err)
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// post sends event to url, signed with the webhook secret.
+func (b *Bus) post(ctx context.Context, url string, event api.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, event.ID)
+	req.Header.Set(SignatureHeader, "t="+timestamp+",v1="+Sign(b.secret, timestamp, body))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read a bit of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a webhook request: the hex HMAC-SHA256 of
+// timestamp, a dot and body.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bury moves an event that could not be delivered to url to the dead-letter
+// queue.
+func (b *Bus) bury(ctx context.Context, url string, event api.Event, attempts int, cause error) {
+	deliveries.Add(ctx, 1, resultAttribute("dead"))
+	slog.ErrorContext(ctx, "Webhook delivery failed, moved to the dead-letter queue", "url", url, "event", event.ID,
+		"type", event.Type, "attempts", attempts, "error", cause)
+
+	letter := api.DeadLetter{
+		ID:       deadLetterID(event.ID, url),
+		URL:      url,
+		Event:    event,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+	// The bus may be stopping, which must not lose the letter
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), buryTimeout)
+	defer cancel()
+	if err := b.saveDeadLetter(ctx, letter); err != nil {
+		slog.ErrorContext(ctx, "Failed to save dead letter", "id", letter.ID, "error", err)
+	}
+}
+
+func deadLetterID(eventID, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return eventID + "-" + hex.EncodeToString(sum[:4])
+}
+
+// memoryLetter is a dead letter kept in memory. seq orders the letters like
+// the create revision does in etcd.
+type memoryLetter struct {
+	letter api.DeadLetter
+	seq    int64
+}
+
+// saveDeadLetter stores letter for DeadLetterRetention, replacing an earlier
+// letter with the same ID, and drops the oldest letters beyond
+// maxDeadLetters.
+func (b *Bus) saveDeadLetter(ctx context.Context, letter api.DeadLetter) error {
+	if b.cli == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		expired := time.Now().Add(-b.cfg.DeadLetterRetention)
+		for id, l := range b.dead {
+			if l.letter.FailedAt.Before(expired) {
+				delete(b.dead, id)
+			}
+		}
+		stored, ok := b.dead[letter.ID]
+		if !ok {
+			if len(b.dead) >= maxDeadLetters {
+				oldest := ""
+				for id, l := range b.dead {
+					if oldest == "" || l.seq < b.dead[oldest].seq {
+						oldest = id
+					}
+				}
+				slog.WarnContext(ctx, "Dead-letter queue is full, dropping the oldest letter", "id", oldest)
+				delete(b.dead, oldest)
+			}
+			b.deadSeq++
+			stored.seq = b.deadSeq
+		}
+		stored.letter = letter
+		b.dead[letter.ID] = stored
+		return nil
+	}
+
+	key := deadPrefix + letter.ID
+	data, err := b.seal(ctx, key, letter)
+	if err != nil {
+		return err
+	}
+	if err := b.deadLeases.Put(ctx, key, string(data)); err != nil {
+		return err
+	}
+
+	count, err := b.cli.Get(ctx, deadPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if over := count.Count - maxDeadLetters; over > 0 {
+		oldest, err := b.cli.Get(ctx, deadPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+			clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+			clientv3.WithLimit(over))
+		if err != nil {
+			return err
+		}
+		for _, kv := range oldest.Kvs {
+			slog.WarnContext(ctx, "Dead-letter queue is full, dropping the oldest letter", "id", strings.TrimPrefix(string(kv.Key), deadPrefix))
+			if _, err := b.cli.Delete(ctx, string(kv.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters, oldest first, starting after
+// the cursor after; zero starts at the oldest. The returned cursor continues
+// the list and is zero when there are no more letters.
+func (b *Bus) DeadLetters(ctx context.Context, after int64, limit int) ([]api.DeadLetter, int64, error) {
+	letters := []api.DeadLetter{}
+	if b.cli == nil {
+		b.mu.Lock()
+		var stored []memoryLetter
+		expired := time.Now().Add(-b.cfg.DeadLetterRetention)
+		for _, l := range b.dead {
+			if l.seq > after && !l.letter.FailedAt.Before(expired) {
+				stored = append(stored, l)
+			}
+		}
+		b.mu.Unlock()
+		sort.Slice(stored, func(i, j int) bool { return stored[i].seq < stored[j].seq })
+
+		var next int64
+		if len(stored) > limit {
+			stored = stored[:limit]
+			next = stored[limit-1].seq
+		}
+		for _, l := range stored {
+			letters = append(letters, l.letter)
+		}
+		return letters, next, nil
+	}
+
+	resp, err := b.cli.Get(ctx, deadPrefix, clientv3.WithPrefix(),
+		clientv3.WithMinCreateRev(after+1),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+		clientv3.WithLimit(int64(limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := make([]string, len(resp.Kvs))
+	values := make([][]byte, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		keys[i], values[i] = string(kv.Key), kv.Value
+	}
+	letters = make([]api.DeadLetter, len(values))
+	if err := b.unseal(ctx, keys, values, func(i int) any { return &letters[i] }); err != nil {
+		return nil, 0, err
+	}
+	var next int64
+	if resp.More && len(resp.Kvs) > 0 {
+		next = resp.Kvs[len(resp.Kvs)-1].CreateRevision
+	}
+	return letters, next, nil
+}
+
+func (b *Bus) deadLetter(ctx context.Context, id string) (*api.DeadLetter, error) {
+	if b.cli == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		stored, ok := b.dead[id]
+		if !ok {
+			return nil, ErrDeadLetterNotFound
+		}
+		return &stored.letter, nil
+	}
+
+	resp, err := b.cli.Get(ctx, deadPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	var letter api.DeadLetter
+	if err := b.unseal(ctx, []string{deadPrefix + id}, [][]byte{resp.Kvs[0].Value}, func(int) any { return &letter }); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// DeleteDeadLetter drops a dead letter without delivering it.
+func (b *Bus) DeleteDeadLetter(ctx context.Context, id string) error {
+	if b.cli == nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.dead[id]; !ok {
+			return ErrDeadLetterNotFound
+		}
+		delete(b.dead, id)
+		return nil
+	}
+
+	resp, err := b.cli.Delete(ctx, deadPrefix+id)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// RetryDeadLetter delivers a dead letter once more. It is removed from the
+// queue when the webhook accepts it, and kept with the new error otherwise.
+func (b *Bus) RetryDeadLetter(ctx context.Context, id string) error {
+	letter, err := b.deadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(b.cfg.WebhookURLs, letter.URL) {
+		return ErrWebhookRemoved
+	}
+
+	if err := b.post(ctx, letter.URL, letter.Event); err != nil {
+		letter.Attempts++
+		letter.Error = err.Error()
+		letter.FailedAt = time.Now().UTC()
+		if err := b.saveDeadLetter(ctx, *letter); err != nil {
+			slog.ErrorContext(ctx, "Failed to save dead letter", "id", letter.ID, "error", err)
+		}
+		return fmt.Errorf("%w: %v", ErrDeliveryFailed, err)
+	}
+	deliveries.Add(ctx, 1, resultAttribute("success"))
+	if err := b.DeleteDeadLetter(ctx, id); err != nil && !errors.Is(err, ErrDeadLetterNotFound) {
+		return err
+	}
+	return nil
+}
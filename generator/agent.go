@@ -0,0 +1,201 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/profiles"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerSettings returns what the peer needs to configure its interface, from
+// its current profile and the current server key.
+func (g *Generator) peerSettings(ctx context.Context, record *allocator.PeerRecord) (*api.PeerSettings, error) {
+	profile, err := g.loadProfile(ctx, record.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return &api.PeerSettings{
+		Peer:                *record,
+		Address:             g.server.PeerAddress(record.IP),
+		ServerPublicKey:     g.server.PublicKey(),
+		Endpoint:            profile.Endpoint,
+		AllowedIPs:          profile.AllowedIPs,
+		DNS:                 profile.DNS,
+		PersistentKeepalive: profile.PersistentKeepalive,
+	}, nil
+}
+
+func (g *Generator) respondSettings(ctx context.Context, c *gin.Context, status int, record *allocator.PeerRecord) {
+	settings, err := g.peerSettings(ctx, record)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load profile of peer", "peer", record.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load profile"})
+		return
+	}
+	c.JSON(status, settings)
+}
+
+// @Summary Enroll peer
+// @Description Enrolls a peer whose key pair was generated by the caller, e.g. wireable-agent. Only the public key is sent; profiles that escrow private keys cannot be used.
+// @ID enroll-peer
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body api.EnrollRequest true "Public key and profile"
+// @Success 201 {object} api.PeerSettings
+// @Failure 400
+// @Failure 403
+// @Failure 500
+// @Failure 503
+// @Router /peers [post]
+func (g *Generator) EnrollHandler(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "EnrollHandler")
+	defer span.End()
+
+	var req api.EnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := wgtypes.ParseKey(req.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		return
+	}
+
+	profile, err := profiles.Get(ctx, g.server.EtcdClient(), req.Profile)
+	if errors.Is(err, profiles.ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown profile"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load profile"})
+		return
+	}
+	if profile.EscrowPrivateKey {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Profile requires key escrow, which needs a server generated key"})
+		return
+	}
+
+	record, err := allocator.NewPeerRecord(req.PublicKey, c.GetString("username"))
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create peer record"})
+		return
+	}
+	record.Profile = profile.Name
+	record.ExpiresAt = g.expiresAt()
+
+	if ip, _ := g.allocatePeer(ctx, c, record); ip == nil {
+		return
+	}
+	span.SetAttributes(attribute.String("peer.id", record.ID), attribute.String("peer.ip", record.IP))
+	g.respondSettings(ctx, c, http.StatusCreated, record)
+}
+
+// @Summary Peer heartbeat
+// @Description Records that the agent managing the peer is alive and returns the current settings of the peer, which pick up profile and server key changes.
+// @ID peer-heartbeat
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Success 200 {object} api.PeerSettings
+// @Failure 404
+// @Failure 500
+// @Router /peers/{id}/heartbeat [post]
+func (g *Generator) HeartbeatHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := g.recordHeartbeat(ctx, record.ID, now); err != nil {
+		slog.ErrorContext(ctx, "Failed to record heartbeat", "peer", record.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record heartbeat"})
+		return
+	}
+	record.LastHeartbeat = &now
+	g.respondSettings(ctx, c, http.StatusOK, record)
+}
+
+// @Summary Replace peer key
+// @Description Replaces the public key of the peer with one generated by the caller and keeps its IP. With PEER_TTL set the peer is renewed for another TTL.
+// @ID update-peer-key
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Param request body api.KeyUpdate true "New public key"
+// @Success 200 {object} api.PeerSettings
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /peers/{id}/key [put]
+func (g *Generator) UpdateKeyHandler(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "UpdateKeyHandler")
+	defer span.End()
+
+	var req api.KeyUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if _, err := wgtypes.ParseKey(req.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		return
+	}
+
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.String("peer.id", record.ID), attribute.String("peer.ip", record.IP))
+
+	prev := *record
+	oldPublicKey := record.PublicKey
+	record, err := allocator.UpdatePeer(ctx, g.server.PoolStore(), record.ID, func(r *allocator.PeerRecord) {
+		now := time.Now().UTC()
+		r.PublicKey = req.PublicKey
+		r.RotatedAt = &now
+		if t := g.expiresAt(); t != nil {
+			r.ExpiresAt = t
+		}
+	})
+	if errors.Is(err, allocator.ErrPeerNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peer not found"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to replace peer key", "peer", c.Param("id"), "error", err)
+		audit.Record(c, audit.ActionPeerRotate, "", c.Param("id"), audit.ResultFailure, map[string]string{"reason": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update peer"})
+		return
+	}
+
+	if err := g.swapWireguardKey(ctx, &prev, record); err != nil {
+		span.RecordError(err)
+		audit.Record(c, audit.ActionPeerRotate, "", record.ID, audit.ResultFailure, map[string]string{"reason": "wireguard peer update failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add wireguard peer"})
+		return
+	}
+
+	audit.Record(c, audit.ActionPeerRotate, "", record.ID, audit.ResultSuccess, map[string]string{
+		"old_public_key": oldPublicKey,
+		"public_key":     record.PublicKey,
+	})
+	events.Record(c, api.EventPeerRotated, record, map[string]string{"old_public_key": oldPublicKey})
+	g.respondSettings(ctx, c, http.StatusOK, record)
+}
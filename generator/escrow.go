@@ -0,0 +1,134 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/profiles"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	"github.com/gin-gonic/gin"
+)
+
+const escrowKeyField = "private_key"
+
+// EscrowConfig locates escrowed private keys in Vault KV.
+type EscrowConfig struct {
+	MountPath  string
+	PathPrefix string
+}
+
+func EscrowConfigFrom(s *settings.Source) EscrowConfig {
+	return EscrowConfig{
+		MountPath:  s.String("ESCROW_MOUNT_PATH", s.String("MOUNT_PATH", "")),
+		PathPrefix: s.String("ESCROW_PATH_PREFIX", "wireable/escrow"),
+	}
+}
+
+// escrowLocation returns the KV mount and secret path a peer's private key is
+// escrowed under.
+func (g *Generator) escrowLocation(peerID string) (string, string) {
+	return g.cfg.Escrow.MountPath, strings.TrimSuffix(g.cfg.Escrow.PathPrefix, "/") + "/" + peerID
+}
+
+func (g *Generator) escrowPrivateKey(ctx context.Context, c *gin.Context, peerID, privateKey string) error {
+	mount, path := g.escrowLocation(peerID)
+	err := vaultclient.WriteSecretData(ctx, vaultclient.GetClient(), mount, path, map[string]interface{}{
+		escrowKeyField: privateKey,
+	})
+
+	result := audit.ResultSuccess
+	var details map[string]string
+	if err != nil {
+		result = audit.ResultFailure
+		details = map[string]string{"reason": err.Error()}
+	}
+	audit.Record(c, audit.ActionEscrowWrite, "", peerID, result, details)
+	return err
+}
+
+func (g *Generator) deleteEscrowedKey(ctx context.Context, c *gin.Context, peerID string) {
+	mount, path := g.escrowLocation(peerID)
+	err := vaultclient.DeleteSecret(ctx, vaultclient.GetClient(), mount, path)
+
+	result := audit.ResultSuccess
+	var details map[string]string
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to delete escrowed key", "peer", peerID, "error", err)
+		result = audit.ResultFailure
+		details = map[string]string{"reason": err.Error()}
+	}
+	audit.Record(c, audit.ActionEscrowDelete, "", peerID, result, details)
+}
+
+// loadProfile returns the profile a peer was created with, falling back to
+// the default profile if it has been deleted since.
+func (g *Generator) loadProfile(ctx context.Context, name string) (*profiles.Profile, error) {
+	profile, err := profiles.Get(ctx, g.server.EtcdClient(), name)
+	if errors.Is(err, profiles.ErrNotFound) {
+		slog.WarnContext(ctx, "Profile no longer exists, using the default profile", "profile", name)
+		return profiles.Get(ctx, g.server.EtcdClient(), profiles.DefaultName)
+	}
+	return profile, err
+}
+
+func (g *Generator) renderPeerConfig(ctx context.Context, record *allocator.PeerRecord, privateKey string) (string, error) {
+	profile, err := g.loadProfile(ctx, record.Profile)
+	if err != nil {
+		return "", err
+	}
+	return g.generateConfigFromTemplate(ctx, g.newConfigData(privateKey, record.IP, profile))
+}
+
+// @Summary Download escrowed peer configuration
+// @Description Rebuilds the configuration of a peer from its escrowed private key. Requires the admin role; every access is audited.
+// @ID peer-config
+// @Produce text/plain
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Success 200 {string} string "WireGuard Configuration Template"
+// @Failure 403
+// @Failure 404
+// @Failure 500
+// @Router /peers/{id}/config [get]
+func (g *Generator) DownloadConfigHandler(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "DownloadConfigHandler")
+	defer span.End()
+
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+	if !record.Escrowed {
+		audit.Record(c, audit.ActionEscrowRead, "", record.ID, audit.ResultDenied, map[string]string{"reason": "key not escrowed"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Private key of this peer is not escrowed"})
+		return
+	}
+
+	mount, path := g.escrowLocation(record.ID)
+	privateKey := vaultclient.ProcessSecret(vaultclient.GetClient(), mount, path, escrowKeyField)
+	if privateKey == "" {
+		audit.Record(c, audit.ActionEscrowRead, "", record.ID, audit.ResultFailure, map[string]string{"reason": "escrowed key unavailable"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read escrowed key"})
+		return
+	}
+
+	configTemplate, err := g.renderPeerConfig(ctx, record, privateKey)
+	if err != nil {
+		span.RecordError(err)
+		audit.Record(c, audit.ActionEscrowRead, "", record.ID, audit.ResultFailure, map[string]string{"reason": "config generation failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate config"})
+		return
+	}
+
+	audit.Record(c, audit.ActionEscrowRead, "", record.ID, audit.ResultSuccess, nil)
+	c.Header(api.PeerIDHeader, record.ID)
+	c.Header("Content-Type", "text/plain")
+	c.String(http.StatusOK, configTemplate)
+}
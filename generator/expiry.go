@@ -0,0 +1,128 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/Zacky3181V/wireable/vaultclient"
+)
+
+const (
+	reaperActor         = "reaper"
+	defaultReapInterval = time.Minute
+)
+
+// ExpiryConfig sets how long new peers live and how often expired peers are
+// revoked. A zero TTL means peers never expire.
+type ExpiryConfig struct {
+	TTL          time.Duration
+	ReapInterval time.Duration
+}
+
+func ExpiryConfigFrom(s *settings.Source) ExpiryConfig {
+	cfg := ExpiryConfig{
+		TTL:          s.Duration("PEER_TTL", 0),
+		ReapInterval: s.Duration("PEER_REAP_INTERVAL", defaultReapInterval),
+	}
+	if cfg.ReapInterval <= 0 {
+		s.Invalid("PEER_REAP_INTERVAL", cfg.ReapInterval.String(), errors.New("must be positive"))
+	}
+	return cfg
+}
+
+// expiresAt returns the expiry of a peer created now, or nil.
+func (g *Generator) expiresAt() *time.Time {
+	if g.cfg.Expiry.TTL <= 0 {
+		return nil
+	}
+	t := time.Now().UTC().Add(g.cfg.Expiry.TTL)
+	return &t
+}
+
+// ReapExpiredPeers revokes expired peers until ctx is done. Every replica
+// runs it; releasing the IP is conditional, so only one of them records the
+// revocation.
+func (g *Generator) ReapExpiredPeers(ctx context.Context) {
+	ticker := time.NewTicker(g.cfg.Expiry.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		records, err := allocator.ExpiredPeers(ctx, g.server.PoolStore(), time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list expired peers", "error", err)
+			continue
+		}
+		for i := range records {
+			g.reapPeer(ctx, &records[i])
+		}
+	}
+}
+
+func (g *Generator) reapPeer(ctx context.Context, record *allocator.PeerRecord) {
+	if err := g.removeWireguardPeer(record.PublicKey); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove expired peer", "peer", record.ID, "error", err)
+		return
+	}
+
+	err := allocator.ReleaseIP(ctx, g.server.PoolStore(), net.ParseIP(record.IP))
+	if errors.Is(err, allocator.ErrPeerNotFound) {
+		// Another replica got there first
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to release IP of expired peer", "peer", record.ID, "error", err)
+		// Keep the device in line with the store until the next sweep
+		if err := g.addWireguardPeer(record.IP, record.PublicKey); err != nil {
+			slog.ErrorContext(ctx, "Failed to restore expired peer", "peer", record.ID, "error", err)
+		}
+		return
+	}
+	slog.InfoContext(ctx, "Revoked expired peer", "peer", record.ID, "ip", record.IP)
+	g.forgetHeartbeat(ctx, record.ID)
+
+	if record.Escrowed {
+		mount, path := g.escrowLocation(record.ID)
+		err := vaultclient.DeleteSecret(ctx, vaultclient.GetClient(), mount, path)
+		result := audit.ResultSuccess
+		var details map[string]string
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to delete escrowed key of peer", "peer", record.ID, "error", err)
+			result = audit.ResultFailure
+			details = map[string]string{"reason": err.Error()}
+		}
+		appendReaperEntry(ctx, audit.ActionEscrowDelete, record.ID, result, details)
+	}
+
+	appendReaperEntry(ctx, audit.ActionPeerRelease, record.ID, audit.ResultSuccess, map[string]string{
+		"ip":         record.IP,
+		"owner":      record.Owner,
+		"public_key": record.PublicKey,
+		"reason":     "expired",
+	})
+	events.Publish(ctx, api.EventPeerExpired, reaperActor, record, nil)
+}
+
+func appendReaperEntry(ctx context.Context, action, target, result string, details map[string]string) {
+	entry := audit.Entry{
+		Action:  action,
+		Actor:   reaperActor,
+		Target:  target,
+		Result:  result,
+		Details: details,
+	}
+	audit.Submit(ctx, entry, "")
+}
@@ -0,0 +1,42 @@
+package generator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/settings"
+)
+
+// Config holds the settings of the peer handlers.
+type Config struct {
+	Quotas QuotaConfig
+	Expiry ExpiryConfig
+	Escrow EscrowConfig
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	return Config{
+		Quotas: QuotaConfigFrom(s),
+		Expiry: ExpiryConfigFrom(s),
+		Escrow: EscrowConfigFrom(s),
+	}
+}
+
+// Generator creates, lists and revokes the peers of the WireGuard server.
+type Generator struct {
+	server *config.Server
+	cfg    Config
+
+	heartbeatsMu sync.Mutex
+	// heartbeats holds the heartbeats when there is no etcd to keep them in.
+	heartbeats map[string]time.Time
+}
+
+func New(server *config.Server, cfg Config) *Generator {
+	return &Generator{
+		server:     server,
+		cfg:        cfg,
+		heartbeats: make(map[string]time.Time),
+	}
+}
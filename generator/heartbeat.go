@@ -0,0 +1,94 @@
+package generator
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Heartbeats are kept apart from the peer records: writing them to the
+// record would bump its revision with every heartbeat and make concurrent
+// claims, rotations and releases of the peer fail.
+const heartbeatPrefix = "/peer-heartbeat/"
+
+func (g *Generator) recordHeartbeat(ctx context.Context, id string, at time.Time) error {
+	cli := g.server.EtcdClient()
+	if cli == nil {
+		g.heartbeatsMu.Lock()
+		defer g.heartbeatsMu.Unlock()
+		g.heartbeats[id] = at
+		return nil
+	}
+	_, err := cli.Put(ctx, heartbeatPrefix+id, at.Format(time.RFC3339Nano))
+	return err
+}
+
+// loadHeartbeats returns the latest heartbeat of every peer that sent one.
+func (g *Generator) loadHeartbeats(ctx context.Context) (map[string]time.Time, error) {
+	loaded := make(map[string]time.Time)
+	cli := g.server.EtcdClient()
+	if cli == nil {
+		g.heartbeatsMu.Lock()
+		defer g.heartbeatsMu.Unlock()
+		for id, at := range g.heartbeats {
+			loaded[id] = at
+		}
+		return loaded, nil
+	}
+
+	resp, err := cli.Get(ctx, heartbeatPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		id := string(kv.Key[len(heartbeatPrefix):])
+		at, err := time.Parse(time.RFC3339Nano, string(kv.Value))
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring invalid heartbeat", "peer", id, "error", err)
+			continue
+		}
+		loaded[id] = at
+	}
+	return loaded, nil
+}
+
+// attachHeartbeat sets the latest heartbeat of record, if any.
+func (g *Generator) attachHeartbeat(ctx context.Context, record *allocator.PeerRecord) error {
+	cli := g.server.EtcdClient()
+	if cli == nil {
+		g.heartbeatsMu.Lock()
+		defer g.heartbeatsMu.Unlock()
+		if at, ok := g.heartbeats[record.ID]; ok {
+			record.LastHeartbeat = &at
+		}
+		return nil
+	}
+
+	resp, err := cli.Get(ctx, heartbeatPrefix+record.ID)
+	if err != nil || len(resp.Kvs) == 0 {
+		return err
+	}
+	at, err := time.Parse(time.RFC3339Nano, string(resp.Kvs[0].Value))
+	if err != nil {
+		return err
+	}
+	record.LastHeartbeat = &at
+	return nil
+}
+
+// forgetHeartbeat drops the heartbeat of a released peer.
+func (g *Generator) forgetHeartbeat(ctx context.Context, id string) {
+	cli := g.server.EtcdClient()
+	if cli == nil {
+		g.heartbeatsMu.Lock()
+		defer g.heartbeatsMu.Unlock()
+		delete(g.heartbeats, id)
+		return
+	}
+	if _, err := cli.Delete(ctx, heartbeatPrefix+id); err != nil {
+		slog.WarnContext(ctx, "Failed to delete heartbeat of peer", "peer", id, "error", err)
+	}
+}
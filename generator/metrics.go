@@ -0,0 +1,29 @@
+package generator
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("wireable/generator")
+
+var generateDuration, _ = meter.Float64Histogram("wireable.generate.duration",
+	metric.WithDescription("Duration of /generate requests by outcome"),
+	metric.WithUnit("s"))
+
+const (
+	outcomeSuccess        = "success"
+	outcomeError          = "error"
+	outcomeUnknownProfile = "unknown_profile"
+	outcomeQuotaExceeded  = "quota_exceeded"
+	outcomePoolExhausted  = "pool_exhausted"
+)
+
+func recordGenerate(ctx context.Context, start time.Time, outcome string) {
+	generateDuration.Record(ctx, time.Since(start).Seconds(),
+		metric.WithAttributes(attribute.String("outcome", outcome)))
+}
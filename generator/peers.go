@@ -0,0 +1,359 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/authentication"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/peerstatus"
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// QuotaConfig limits how many active peers a user may hold. User entries
+// take precedence over role entries, which take precedence over Default.
+// Zero means unlimited.
+type QuotaConfig struct {
+	Default int
+	Roles   map[string]int
+	Users   map[string]int
+}
+
+func QuotaConfigFrom(s *settings.Source) QuotaConfig {
+	return QuotaConfig{
+		Default: s.Int("PEER_QUOTA_DEFAULT", 0),
+		Roles:   parseQuotaList(s, "PEER_QUOTA_ROLES"),
+		Users:   parseQuotaList(s, "PEER_QUOTA_USERS"),
+	}
+}
+
+func (q QuotaConfig) For(username, role string) int {
+	if n, ok := q.Users[username]; ok {
+		return n
+	}
+	if n, ok := q.Roles[role]; ok {
+		return n
+	}
+	return q.Default
+}
+
+// parseQuotaList parses "name=limit,name=limit".
+func parseQuotaList(s *settings.Source, key string) map[string]int {
+	quotas := make(map[string]int)
+	for _, entry := range s.List(key) {
+		name, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			s.Invalid(key, entry, errors.New("expected name=limit"))
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil {
+			s.Invalid(key, entry, errors.New("limit is not an integer"))
+			continue
+		}
+		quotas[strings.TrimSpace(name)] = n
+	}
+	return quotas
+}
+
+// loadOwnedPeer fetches the peer named in the URL and makes sure the caller
+// may act on it. Non-admins only see their own peers; anything else is
+// reported as not found so peer IDs cannot be probed.
+func (g *Generator) loadOwnedPeer(c *gin.Context) (*allocator.PeerRecord, bool) {
+	record, err := allocator.GetPeer(c.Request.Context(), g.server.PoolStore(), c.Param("id"))
+	if errors.Is(err, allocator.ErrPeerNotFound) ||
+		(err == nil && !authentication.IsAdmin(c) && record.Owner != c.GetString("username")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peer not found"})
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to load peer", "peer", c.Param("id"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load peer"})
+		return nil, false
+	}
+	return record, true
+}
+
+// @Summary List peers
+// @Description Lists the caller's peers with their online status. Admins see every peer and can filter by owner.
+// @ID list-peers
+// @Produce json
+// @Security BearerAuth
+// @Param owner query string false "Only peers of this owner (admin only)"
+// @Param state query string false "Only peers in this state" Enums(online, offline)
+// @Success 200 {array} api.Peer
+// @Failure 400
+// @Failure 500
+// @Router /peers [get]
+func (g *Generator) ListPeersHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	state := c.Query("state")
+	if state != "" && state != api.PeerOnline && state != api.PeerOffline {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be online or offline"})
+		return
+	}
+	collector := peerstatus.Get()
+	if state != "" && collector == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Peer status tracking is disabled"})
+		return
+	}
+
+	records, err := allocator.ListPeers(ctx, g.server.PoolStore())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list peers", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list peers"})
+		return
+	}
+
+	heartbeats, err := g.loadHeartbeats(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load heartbeats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list peers"})
+		return
+	}
+	var statuses map[string]api.PeerStatus
+	if collector != nil {
+		if statuses, err = collector.Statuses(ctx); err != nil {
+			slog.ErrorContext(ctx, "Failed to load peer status", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load peer status"})
+			return
+		}
+	}
+
+	owner := c.Query("owner")
+	if !authentication.IsAdmin(c) {
+		owner = c.GetString("username")
+	}
+
+	peers := make([]allocator.PeerRecord, 0, len(records))
+	for _, record := range records {
+		if owner != "" && record.Owner != owner {
+			continue
+		}
+		if at, ok := heartbeats[record.ID]; ok {
+			record.LastHeartbeat = &at
+		}
+		if status, ok := statuses[record.ID]; ok {
+			record.Status = &status
+		}
+		if state != "" && (record.Status == nil || record.Status.State != state) {
+			continue
+		}
+		peers = append(peers, record)
+	}
+	c.JSON(http.StatusOK, peers)
+}
+
+// @Summary Get peer
+// @Description Returns a single peer with its online status.
+// @ID get-peer
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Success 200 {object} api.Peer
+// @Failure 404
+// @Router /peers/{id} [get]
+func (g *Generator) GetPeerHandler(c *gin.Context) {
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+	if err := g.attachHeartbeat(c.Request.Context(), record); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to load heartbeat", "peer", record.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load peer"})
+		return
+	}
+	if collector := peerstatus.Get(); collector != nil {
+		status, err := collector.Status(c.Request.Context(), record.ID)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to load peer status", "peer", record.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load peer status"})
+			return
+		}
+		record.Status = status
+	}
+	c.JSON(http.StatusOK, record)
+}
+
+// @Summary Revoke peer
+// @Description Removes the peer from the WireGuard server and returns its IP to the pool.
+// @ID revoke-peer
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Success 204
+// @Failure 404
+// @Failure 500
+// @Router /peers/{id} [delete]
+func (g *Generator) RevokePeerHandler(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "RevokePeerHandler")
+	defer span.End()
+
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.String("peer.id", record.ID), attribute.String("peer.ip", record.IP))
+
+	if err := g.removeWireguardPeer(record.PublicKey); err != nil {
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to revoke peer", "peer", record.ID, "error", err)
+		audit.Record(c, audit.ActionPeerRelease, "", record.ID, audit.ResultFailure, map[string]string{"reason": "wireguard peer removal failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove wireguard peer"})
+		return
+	}
+
+	if err := allocator.ReleaseIP(ctx, g.server.PoolStore(), net.ParseIP(record.IP)); err != nil {
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to release IP of peer", "peer", record.ID, "error", err)
+		// The peer is still stored, put it back on the device
+		if err := g.addWireguardPeer(record.IP, record.PublicKey); err != nil {
+			slog.ErrorContext(ctx, "Failed to restore wireguard peer", "peer", record.ID, "error", err)
+		}
+		audit.Record(c, audit.ActionPeerRelease, "", record.ID, audit.ResultFailure, map[string]string{"reason": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release IP"})
+		return
+	}
+
+	g.forgetHeartbeat(ctx, record.ID)
+	if record.Escrowed {
+		g.deleteEscrowedKey(ctx, c, record.ID)
+	}
+
+	audit.Record(c, audit.ActionPeerRelease, "", record.ID, audit.ResultSuccess, map[string]string{
+		"ip":         record.IP,
+		"owner":      record.Owner,
+		"public_key": record.PublicKey,
+	})
+	events.Record(c, api.EventPeerRevoked, record, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Rotate peer keys
+// @Description Generates a new key pair for the peer, keeps its IP and returns the new configuration.
+// @ID rotate-peer
+// @Produce text/plain
+// @Security BearerAuth
+// @Param id path string true "Peer ID"
+// @Success 200 {string} string "WireGuard Configuration Template"
+// @Failure 404
+// @Failure 500
+// @Router /peers/{id}/rotate [post]
+func (g *Generator) RotatePeerHandler(c *gin.Context) {
+	ctx, span := tracer.Start(c.Request.Context(), "RotatePeerHandler")
+	defer span.End()
+
+	record, ok := g.loadOwnedPeer(c)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.String("peer.id", record.ID), attribute.String("peer.ip", record.IP))
+
+	privateKey, publicKey, err := generateWireGuardKeys(ctx)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate keys"})
+		return
+	}
+
+	// Rendered first, the IP and profile stay the same. Once the key is
+	// swapped a failure would lose the only copy of the new private key.
+	configTemplate, err := g.renderPeerConfig(ctx, record, privateKey)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate config"})
+		return
+	}
+
+	prev := *record
+	oldPublicKey := record.PublicKey
+	record, err = allocator.UpdatePeerKey(ctx, g.server.PoolStore(), record.ID, publicKey)
+	if err != nil {
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to rotate peer", "peer", c.Param("id"), "error", err)
+		audit.Record(c, audit.ActionPeerRotate, "", c.Param("id"), audit.ResultFailure, map[string]string{"reason": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update peer"})
+		return
+	}
+
+	if err := g.swapWireguardKey(ctx, &prev, record); err != nil {
+		span.RecordError(err)
+		audit.Record(c, audit.ActionPeerRotate, "", record.ID, audit.ResultFailure, map[string]string{"reason": "wireguard peer update failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add wireguard peer"})
+		return
+	}
+
+	if record.Escrowed {
+		// Vault would keep the old key and serve a config that cannot
+		// connect, so the rotation is undone
+		if err := g.escrowPrivateKey(ctx, c, record.ID, privateKey); err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(ctx, "Failed to escrow rotated key, keeping the previous key", "peer", record.ID, "error", err)
+			g.revertKeySwap(ctx, &prev, record)
+			audit.Record(c, audit.ActionPeerRotate, "", record.ID, audit.ResultFailure, map[string]string{"reason": "key escrow failed"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to escrow private key"})
+			return
+		}
+	}
+
+	audit.Record(c, audit.ActionPeerRotate, "", record.ID, audit.ResultSuccess, map[string]string{
+		"old_public_key": oldPublicKey,
+		"public_key":     publicKey,
+	})
+	events.Record(c, api.EventPeerRotated, record, map[string]string{"old_public_key": oldPublicKey})
+
+	c.Header(api.PeerIDHeader, record.ID)
+	c.Header("Content-Type", "text/plain")
+	c.String(http.StatusOK, configTemplate)
+}
+
+// swapWireguardKey moves the device entry of a peer from the key of prev to
+// the key of record, which is already stored. The new key is added before
+// the old one is removed, so the peer is never without an entry. When the new
+// key cannot be added, the stored record is reverted to prev, which still
+// matches the device.
+func (g *Generator) swapWireguardKey(ctx context.Context, prev, record *allocator.PeerRecord) error {
+	if err := g.addWireguardPeer(record.IP, record.PublicKey); err != nil {
+		g.restoreRecordKey(ctx, prev, record)
+		return err
+	}
+	if prev.PublicKey != record.PublicKey {
+		// The allowed IP already moved to the new key
+		if err := g.removeWireguardPeer(prev.PublicKey); err != nil {
+			slog.WarnContext(ctx, "Failed to remove old key of peer", "peer", record.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// revertKeySwap undoes a successful swapWireguardKey, moving the device entry
+// and the stored record back to the key of prev.
+func (g *Generator) revertKeySwap(ctx context.Context, prev, record *allocator.PeerRecord) {
+	if err := g.addWireguardPeer(prev.IP, prev.PublicKey); err != nil {
+		slog.ErrorContext(ctx, "Failed to restore the previous key of peer on the device", "peer", record.ID, "error", err)
+	} else if prev.PublicKey != record.PublicKey {
+		if err := g.removeWireguardPeer(record.PublicKey); err != nil {
+			slog.WarnContext(ctx, "Failed to remove new key of peer", "peer", record.ID, "error", err)
+		}
+	}
+	g.restoreRecordKey(ctx, prev, record)
+}
+
+// restoreRecordKey puts the key of prev back into the stored record.
+func (g *Generator) restoreRecordKey(ctx context.Context, prev, record *allocator.PeerRecord) {
+	_, err := allocator.UpdatePeer(ctx, g.server.PoolStore(), record.ID, func(r *allocator.PeerRecord) {
+		r.PublicKey, r.RotatedAt, r.ExpiresAt = prev.PublicKey, prev.RotatedAt, prev.ExpiresAt
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to restore the previous key of peer", "peer", record.ID, "error", err)
+	}
+}
@@ -0,0 +1,24 @@
+package generator
+
+import (
+	"os"
+	"text/template"
+)
+
+// templateFiles are read for every generated peer.
+var templateFiles = []string{"client_template.conf", "peer.conf"}
+
+// CheckTemplates reports whether every template the generator needs can be
+// read and parsed.
+func (g *Generator) CheckTemplates() error {
+	for _, name := range templateFiles {
+		content, err := os.ReadFile(g.server.TemplatePath(name))
+		if err != nil {
+			return err
+		}
+		if _, err := template.New(name).Parse(string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,32 +3,55 @@ package generator
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"text/template"
+	"time"
 
 	"github.com/Zacky3181V/wireable/allocator"
-	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/audit"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/profiles"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var tracer = otel.Tracer("wireguard-tracer")
 
 type ConfigData struct {
-	PrivateKey      string
-	Address         string
-	ServerPublicKey string
+	PrivateKey          string
+	Address             string
+	ServerPublicKey     string
+	DNS                 string
+	Endpoint            string
+	AllowedIPs          string
+	PersistentKeepalive int
 }
 
-func generateConfigFromTemplate(ctx context.Context, data ConfigData) (string, error) {
+func (g *Generator) newConfigData(privateKey, address string, profile *profiles.Profile) ConfigData {
+	return ConfigData{
+		PrivateKey:          privateKey,
+		Address:             address,
+		ServerPublicKey:     g.server.PublicKey(),
+		DNS:                 profile.DNS,
+		Endpoint:            profile.Endpoint,
+		AllowedIPs:          profile.AllowedIPs,
+		PersistentKeepalive: profile.PersistentKeepalive,
+	}
+}
+
+func (g *Generator) generateConfigFromTemplate(ctx context.Context, data ConfigData) (string, error) {
 	ctx, span := tracer.Start(ctx, "generateConfigFromTemplate")
 	defer span.End()
-	tmplBytes, err := os.ReadFile("./templates/client_template.conf")
+	tmplBytes, err := os.ReadFile(g.server.TemplatePath("client_template.conf"))
 	if err != nil {
 		return "", err
 	}
@@ -68,14 +91,23 @@ func generateWireGuardKeys(ctx context.Context) (string, string, error) {
 // @Accept json
 // @Produce text/plain
 // @Security BearerAuth
+// @Param profile query string false "Client profile (default: default)"
 // @Success 200 {string} string "WireGuard Configuration Template"
+// @Header 200 {string} X-Peer-Id "ID of the new peer"
+// @Failure 400
+// @Failure 403
 // @Failure 500
+// @Failure 503
 // @Router /generate [get]
-func WireGuardHandler(c *gin.Context) {
+func (g *Generator) WireGuardHandler(c *gin.Context) {
 
 	ctx, span := tracer.Start(c.Request.Context(), "WireGuardHandler")
 	defer span.End()
 
+	start := time.Now()
+	outcome := outcomeError
+	defer func() { recordGenerate(ctx, start, outcome) }()
+
 	privateKey, publicKey, err := generateWireGuardKeys(ctx)
 	if err != nil {
 		span.RecordError(err)
@@ -83,40 +115,134 @@ func WireGuardHandler(c *gin.Context) {
 		return
 	}
 
-	ip, err := allocator.AllocateIP(ctx, config.GetEtcdClient(), config.GetIPHeap(), publicKey)
+	profile, err := profiles.Get(ctx, g.server.EtcdClient(), c.Query("profile"))
+	if errors.Is(err, profiles.ErrNotFound) {
+		outcome = outcomeUnknownProfile
+		c.JSON(400, gin.H{"error": "Unknown profile"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(500, gin.H{"error": "Failed to load profile"})
+		return
+	}
 
+	username := c.GetString("username")
+	record, err := allocator.NewPeerRecord(publicKey, username)
 	if err != nil {
-		log.Fatalf("Failed to allocate IP")
+		span.RecordError(err)
+		c.JSON(500, gin.H{"error": "Failed to create peer record"})
 		return
 	}
+	record.Profile = profile.Name
+	record.ExpiresAt = g.expiresAt()
+
+	if profile.EscrowPrivateKey {
+		// Escrow before allocating so a peer never exists without its copy
+		if err := g.escrowPrivateKey(ctx, c, record.ID, privateKey); err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(ctx, "Failed to escrow private key", "peer", record.ID, "error", err)
+			c.JSON(500, gin.H{"error": "Failed to escrow private key"})
+			return
+		}
+		record.Escrowed = true
+	}
 
-	serverPublicKey := config.GetServerPublicKey()
+	ip, result := g.allocatePeer(ctx, c, record)
+	if ip == nil {
+		outcome = result
+		return
+	}
 
-	configTemplate, err := generateConfigFromTemplate(ctx, ConfigData{
-		PrivateKey:      privateKey,
-		Address:         ip.String(),
-		ServerPublicKey: serverPublicKey,
-	})
+	configTemplate, err := g.generateConfigFromTemplate(ctx, g.newConfigData(privateKey, ip.String(), profile))
 
 	if err != nil {
 		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to generate config, releasing the peer", "peer", record.ID, "error", err)
+		// Nobody will ever have the private key, so the peer only holds an
+		// IP and a quota slot
+		g.rollbackPeer(ctx, c, record, ip)
 		c.JSON(500, gin.H{"error": "Failed to generate config"})
 		return
 	}
-	err = addWireguardPeer(ip.String(), publicKey)
-	if err !=nil{
+	outcome = outcomeSuccess
+	c.Header(api.PeerIDHeader, record.ID)
+	c.Header("Content-Type", "text/plain")
+	c.String(200, configTemplate)
+
+}
+
+// allocatePeer takes an IP from the pool for record and adds the peer to the
+// WireGuard server. On failure it responds to c and returns a nil IP.
+func (g *Generator) allocatePeer(ctx context.Context, c *gin.Context, record *allocator.PeerRecord) (net.IP, string) {
+	span := trace.SpanFromContext(ctx)
+	username := c.GetString("username")
+
+	ip, err := allocator.AllocateIP(ctx, g.server.PoolStore(), g.server.IPHeap(), record, g.cfg.Quotas.For(username, c.GetString("role")))
+	if err != nil && record.Escrowed {
+		g.deleteEscrowedKey(ctx, c, record.ID)
+	}
+
+	if errors.Is(err, allocator.ErrQuotaExceeded) {
+		audit.Record(c, audit.ActionPeerAllocate, "", "", audit.ResultDenied, map[string]string{"reason": "quota exceeded"})
+		c.JSON(403, gin.H{"error": "Peer quota exceeded"})
+		return nil, outcomeQuotaExceeded
+	}
+	if errors.Is(err, allocator.ErrPoolExhausted) {
+		audit.Record(c, audit.ActionPeerAllocate, "", record.ID, audit.ResultFailure, map[string]string{"reason": err.Error()})
+		c.JSON(503, gin.H{"error": "No IP addresses available"})
+		return nil, outcomePoolExhausted
+	}
+	if err != nil {
+		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to allocate IP", "peer", record.ID, "error", err)
+		audit.Record(c, audit.ActionPeerAllocate, "", record.ID, audit.ResultFailure, map[string]string{"reason": err.Error()})
+		c.JSON(500, gin.H{"error": "Failed to allocate IP"})
+		return nil, outcomeError
+	}
+
+	if err := g.addWireguardPeer(ip.String(), record.PublicKey); err != nil {
 		span.RecordError(err)
+		slog.ErrorContext(ctx, "Failed to add wireguard peer", "peer", record.ID, "error", err)
+		// Give the IP back, the peer was never usable
+		if err := allocator.ReleaseIP(ctx, g.server.PoolStore(), ip); err != nil {
+			slog.ErrorContext(ctx, "Failed to release IP of peer", "peer", record.ID, "error", err)
+		}
+		if record.Escrowed {
+			g.deleteEscrowedKey(ctx, c, record.ID)
+		}
+		audit.Record(c, audit.ActionPeerAllocate, "", record.ID, audit.ResultFailure, map[string]string{"reason": "wireguard peer add failed"})
 		c.JSON(500, gin.H{"error": "Failed to add wireguard peer"})
-		return
+		return nil, outcomeError
 	}
 
-	c.Header("Content-Type", "text/plain")
-	c.String(200, configTemplate)
+	audit.Record(c, audit.ActionPeerAllocate, "", record.ID, audit.ResultSuccess, map[string]string{
+		"ip":         ip.String(),
+		"public_key": record.PublicKey,
+		"profile":    record.Profile,
+	})
+	events.Record(c, api.EventPeerCreated, record, nil)
+	return ip, outcomeSuccess
+}
 
+// rollbackPeer undoes a successful allocatePeer: the peer is removed from the
+// device, its IP goes back to the pool and its escrowed key is deleted.
+func (g *Generator) rollbackPeer(ctx context.Context, c *gin.Context, record *allocator.PeerRecord, ip net.IP) {
+	if err := g.removeWireguardPeer(record.PublicKey); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove wireguard peer", "peer", record.ID, "error", err)
+	}
+	if err := allocator.ReleaseIP(ctx, g.server.PoolStore(), ip); err != nil {
+		slog.ErrorContext(ctx, "Failed to release IP of peer", "peer", record.ID, "error", err)
+	}
+	if record.Escrowed {
+		g.deleteEscrowedKey(ctx, c, record.ID)
+	}
+	audit.Record(c, audit.ActionPeerRelease, "", record.ID, audit.ResultSuccess, map[string]string{"reason": "config generation failed"})
+	events.Record(c, api.EventPeerRevoked, record, nil)
 }
 
-func addWireguardPeer(ip string, publicKey string) error { 
-	interfaceName := "wg0"
+func (g *Generator) addWireguardPeer(ip string, publicKey string) error {
+	interfaceName := g.server.Interface()
 	allowedIPs := fmt.Sprintf("%s/32", ip)
 
 	cmd := exec.Command(
@@ -133,7 +259,22 @@ func addWireguardPeer(ip string, publicKey string) error {
 	return nil
 }
 
-func appendPeerToFile(ctx context.Context, filename, publicKey, ip string) error {
+func (g *Generator) removeWireguardPeer(publicKey string) error {
+	cmd := exec.Command(
+		"sudo", "wg", "set", g.server.Interface(),
+		"peer", publicKey,
+		"remove",
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove WireGuard peer: %v\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
+func (g *Generator) appendPeerToFile(ctx context.Context, filename, publicKey, ip string) error {
 
 	ctx, span := tracer.Start(ctx, "appendPeerToFile")
 	defer span.End()
@@ -145,7 +286,7 @@ func appendPeerToFile(ctx context.Context, filename, publicKey, ip string) error
 	)
 
 	// Read the peer template
-	tmplBytes, err := os.ReadFile("./templates/peer.conf")
+	tmplBytes, err := os.ReadFile(g.server.TemplatePath("peer.conf"))
 	if err != nil {
 		span.RecordError(err)
 		return err
@@ -0,0 +1,67 @@
+package health
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Liveness probe
+// @Description Returns 200 as long as the process serves HTTP. Dependencies are not checked.
+// @ID healthz
+// @Produce json
+// @Success 200
+// @Router /healthz [get]
+func LivenessHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// @Summary Readiness probe
+// @Description Checks etcd, the Vault token, the pool watcher, the WireGuard device and the templates, reusing the result for HEALTH_CACHE_TTL. Returns 503 with the names of the failing checks when any of them fails, or with shutdown while the service drains.
+// @ID readyz
+// @Produce json
+// @Success 200
+// @Failure 503
+// @Router /readyz [get]
+func ReadinessHandler(c *gin.Context) {
+	checker := Get()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": StatusUnavailable, "failing": []string{"startup"}})
+		return
+	}
+	if shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": StatusUnavailable, "failing": []string{"shutdown"}})
+		return
+	}
+
+	report := checker.Cached(c.Request.Context())
+	if report.Status == StatusOK {
+		c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+		return
+	}
+	failing := []string{}
+	for _, result := range report.Checks {
+		if !result.Healthy {
+			failing = append(failing, result.Name)
+		}
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{"status": StatusUnavailable, "failing": failing})
+}
+
+// @Summary Dependency status
+// @Description Runs the readiness checks and returns the result, latency and details of each one. Requires the admin role.
+// @ID get-status
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} Report
+// @Failure 403
+// @Failure 503
+// @Router /status [get]
+func StatusHandler(c *gin.Context) {
+	checker := Get()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service is starting"})
+		return
+	}
+	c.JSON(http.StatusOK, checker.Run(c.Request.Context()))
+}
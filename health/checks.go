@@ -0,0 +1,133 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/generator"
+	"github.com/Zacky3181V/wireable/vaultclient"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+type etcdEndpoint struct {
+	Endpoint string `json:"endpoint"`
+	Version  string `json:"version,omitempty"`
+	Leader   bool   `json:"leader"`
+	Revision int64  `json:"revision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EtcdCheck passes when at least one etcd endpoint answers, since the client
+// fails over between them. Endpoints are asked concurrently so a dead one does
+// not use up the timeout of the others.
+func EtcdCheck(cli *clientv3.Client) Check {
+	return Check{Name: "etcd", Run: func(ctx context.Context) (any, error) {
+		endpoints := cli.Endpoints()
+		details := make([]etcdEndpoint, len(endpoints))
+		errs := make([]error, len(endpoints))
+
+		var wg sync.WaitGroup
+		for i, endpoint := range endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				details[i].Endpoint = endpoint
+				status, err := cli.Status(ctx, endpoint)
+				if err != nil {
+					details[i].Error = err.Error()
+					errs[i] = err
+					return
+				}
+				details[i].Version = status.Version
+				details[i].Leader = status.Leader == status.Header.MemberId
+				details[i].Revision = status.Header.Revision
+			}()
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err == nil {
+				return details, nil
+			}
+		}
+		return details, errors.Join(errs...)
+	}}
+}
+
+type vaultDetails struct {
+	vaultclient.SessionStatus
+	TTL string `json:"ttl,omitempty"`
+}
+
+// VaultCheck passes when the token is still valid according to Vault itself,
+// which also catches tokens revoked behind our back.
+func VaultCheck() Check {
+	return Check{Name: "vault", Run: func(ctx context.Context) (any, error) {
+		details := vaultDetails{SessionStatus: vaultclient.Session()}
+		if !details.Authenticated {
+			return details, errors.New("not authenticated to Vault")
+		}
+
+		vc := vaultclient.GetClient()
+		if vc == nil {
+			return details, errors.New("Vault client not initialized")
+		}
+		secret, err := vc.Auth().Token().LookupSelfWithContext(ctx)
+		if err != nil {
+			return details, err
+		}
+		if ttl, err := secret.TokenTTL(); err == nil && ttl > 0 {
+			details.TTL = ttl.String()
+		}
+		return details, nil
+	}}
+}
+
+// WatcherCheck passes while the pool watcher is following changes. Without
+// it this replica would hand out addresses from a stale heap.
+func WatcherCheck() Check {
+	return Check{Name: "pool_watcher", Run: func(ctx context.Context) (any, error) {
+		status := allocator.Watcher()
+		switch {
+		case !status.Running:
+			return status, errors.New("pool watcher is not running")
+		case !status.Watching:
+			return status, errors.New("pool watcher is not watching the pool")
+		}
+		return status, nil
+	}}
+}
+
+type deviceDetails struct {
+	Name       string `json:"name"`
+	ListenPort int    `json:"listen_port"`
+	Peers      int    `json:"peers"`
+}
+
+// DeviceCheck passes when the WireGuard interface exists and can be read.
+func DeviceCheck(iface string) Check {
+	return Check{Name: "wireguard", Run: func(ctx context.Context) (any, error) {
+		client, err := wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+
+		device, err := client.Device(iface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", iface, err)
+		}
+		return deviceDetails{Name: device.Name, ListenPort: device.ListenPort, Peers: len(device.Peers)}, nil
+	}}
+}
+
+// TemplatesCheck passes when the peer config templates of gen can be parsed.
+func TemplatesCheck(gen *generator.Generator) Check {
+	return Check{Name: "templates", Run: func(ctx context.Context) (any, error) {
+		return nil, gen.CheckTemplates()
+	}}
+}
@@ -0,0 +1,148 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Zacky3181V/wireable/settings"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check reports whether one dependency is usable. The details it returns are
+// shown by the status endpoint, so they must not contain secrets.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (any, error)
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+	Details   any     `json:"details,omitempty"`
+}
+
+// Report is the outcome of every check. Status is ok only when all of them
+// passed.
+type Report struct {
+	Status string    `json:"status"`
+	Checks []Result  `json:"checks"`
+	Time   time.Time `json:"time"`
+}
+
+// Config bounds how long a single check may take and how long the readiness
+// probe reuses a report.
+type Config struct {
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Timeout:  s.Duration("HEALTH_CHECK_TIMEOUT", 2*time.Second),
+		CacheTTL: s.Duration("HEALTH_CACHE_TTL", 5*time.Second),
+	}
+	if cfg.Timeout <= 0 {
+		s.Invalid("HEALTH_CHECK_TIMEOUT", cfg.Timeout.String(), errors.New("must be positive"))
+	}
+	if cfg.CacheTTL < 0 {
+		s.Invalid("HEALTH_CACHE_TTL", cfg.CacheTTL.String(), errors.New("must not be negative"))
+	}
+	return cfg
+}
+
+// Checker runs the checks of the dependencies the service needs to handle
+// requests.
+type Checker struct {
+	cfg    Config
+	checks []Check
+
+	// mu guards the cached report and makes concurrent probes wait for one
+	// run instead of each hitting the dependencies.
+	mu     sync.Mutex
+	cached Report
+}
+
+var (
+	checker      *Checker
+	shuttingDown atomic.Bool
+)
+
+func Init(cfg Config, checks ...Check) *Checker {
+	checker = &Checker{cfg: cfg, checks: checks}
+	return checker
+}
+
+// Get returns the checker set up by Init, or nil before that.
+func Get() *Checker {
+	return checker
+}
+
+// SetShuttingDown makes the readiness probe fail, so load balancers stop
+// sending requests while the in-flight ones drain.
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// Run runs every check concurrently, each bounded by the configured timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: make([]Result, len(c.checks)), Time: time.Now().UTC()}
+
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if !result.Healthy {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+// Cached returns the last report while it is younger than the cache TTL, and
+// runs the checks otherwise.
+func (c *Checker) Cached(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cached.Time.IsZero() && time.Since(c.cached.Time) < c.cfg.CacheTTL {
+		return c.cached
+	}
+	// Other probes wait for this report, a probe that goes away must not
+	// spoil it
+	c.cached = c.Run(context.WithoutCancel(ctx))
+	return c.cached
+}
+
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	details, err := check.Run(ctx)
+	result := Result{
+		Name:      check.Name,
+		Healthy:   err == nil,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Details:   details,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+// Package leases shares etcd leases between keys that expire at about the
+// same time, so writing many short-lived keys does not grant a lease each.
+package leases
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Bucket grants one lease per period and hands it to every key written in
+// that period. A key attached to it lives at least ttl and at most ttl plus
+// period.
+type Bucket struct {
+	cli    *clientv3.Client
+	ttl    time.Duration
+	period time.Duration
+
+	mu      sync.Mutex
+	id      clientv3.LeaseID
+	granted time.Time
+}
+
+// NewBucket returns a bucket for keys that must live at least ttl. period is
+// how long a lease is handed out; it is capped at ttl.
+func NewBucket(cli *clientv3.Client, ttl, period time.Duration) *Bucket {
+	return &Bucket{cli: cli, ttl: ttl, period: min(period, ttl)}
+}
+
+// Lease returns the lease of the current period, granting it on first use.
+func (b *Bucket) Lease(ctx context.Context) (clientv3.LeaseID, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.id != clientv3.NoLease && now.Sub(b.granted) < b.period {
+		return b.id, nil
+	}
+	seconds := int64((b.ttl + b.period + time.Second - 1) / time.Second)
+	resp, err := b.cli.Grant(ctx, seconds)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	b.id, b.granted = resp.ID, now
+	return b.id, nil
+}
+
+// Put writes key with the lease of the current period. A lease etcd no longer
+// knows is replaced once.
+func (b *Bucket) Put(ctx context.Context, key, value string) error {
+	id, err := b.Lease(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = b.cli.Put(ctx, key, value, clientv3.WithLease(id))
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		b.Forget(id)
+		if id, err = b.Lease(ctx); err != nil {
+			return err
+		}
+		_, err = b.cli.Put(ctx, key, value, clientv3.WithLease(id))
+	}
+	return err
+}
+
+// Forget drops id when etcd no longer knows it, e.g. after a restore from a
+// snapshot, so the next Lease grants a new one.
+func (b *Bucket) Forget(id clientv3.LeaseID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.id == id {
+		b.id = clientv3.NoLease
+	}
+}
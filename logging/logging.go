@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config selects the minimum level and the output format.
+type Config struct {
+	Level  slog.Level
+	Format string
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{Level: slog.LevelInfo, Format: strings.ToLower(s.String("LOG_FORMAT", FormatText))}
+	if v := s.String("LOG_LEVEL", ""); v != "" {
+		if err := cfg.Level.UnmarshalText([]byte(v)); err != nil {
+			s.Invalid("LOG_LEVEL", v, err)
+		}
+	}
+	if cfg.Format != FormatText && cfg.Format != FormatJSON {
+		s.Invalid("LOG_FORMAT", cfg.Format, errors.New("expected text or json"))
+	}
+	return cfg
+}
+
+// New returns a logger that writes to w in the configured format and also
+// passes every record to extra, e.g. an OpenTelemetry log bridge. Records
+// carry the request ID, user and trace of their context, and secrets are
+// redacted before any handler sees them.
+func New(cfg Config, w io.Writer, extra ...slog.Handler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.Level}
+	var base slog.Handler = slog.NewTextHandler(w, opts)
+	if cfg.Format == FormatJSON {
+		base = slog.NewJSONHandler(w, opts)
+	}
+
+	handler := base
+	if len(extra) > 0 {
+		handler = fanoutHandler(append([]slog.Handler{base}, extra...))
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request attributes and the trace and span IDs of
+// the record's context, and redacts secrets.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+
+	if id := RequestID(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	if user := User(ctx); user != "" {
+		out.AddAttrs(slog.String("user", user))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		out.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return contextHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fanoutHandler passes every record to all of its handlers.
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
@@ -2,135 +2,97 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
-
-	"github.com/joho/godotenv"
+	"os/signal"
+	"syscall"
 
 	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/audit"
 	"github.com/Zacky3181V/wireable/authentication"
 	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/events"
 	"github.com/Zacky3181V/wireable/generator"
+	"github.com/Zacky3181V/wireable/health"
+	"github.com/Zacky3181V/wireable/logging"
+	"github.com/Zacky3181V/wireable/metrics"
+	"github.com/Zacky3181V/wireable/peerstatus"
+	"github.com/Zacky3181V/wireable/pools"
+	"github.com/Zacky3181V/wireable/profiles"
+	"github.com/Zacky3181V/wireable/ratelimit"
+	"github.com/Zacky3181V/wireable/telemetry"
+	"github.com/Zacky3181V/wireable/tlsserver"
 	"github.com/Zacky3181V/wireable/vaultclient"
 	"github.com/gin-gonic/gin"
-	"google.golang.org/grpc/credentials"
 
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-
-	//"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 
 	docs "github.com/Zacky3181V/wireable/docs"
 	swaggerfiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
-var (
-	serviceName   string
-	collectorURL  string
-	insecure      string
-	enableTracing bool
-)
-
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	serviceName = os.Getenv("SERVICE_NAME")
-	collectorURL = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	insecure = os.Getenv("INSECURE_MODE")
-
-	enableTracing = os.Getenv("ENABLE_TRACING") == "true"
-	if enableTracing {
-		log.Println("Tracing enabled")
-	} else {
-		log.Println("No tracing")
-	}
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
-func initTracer() func(context.Context) error {
-
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	serviceName = os.Getenv("SERVICE_NAME")
-	collectorURL = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	insecure = os.Getenv("INSECURE_MODE")
-
-	if serviceName == "" {
-		log.Fatal("ERROR: SERVICE_NAME is not set")
-	}
-	if collectorURL == "" {
-		log.Fatal("ERROR: OTEL_EXPORTER_OTLP_ENDPOINT is not set")
-	}
-
-	secureOption := otlptracegrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, ""))
-	if len(insecure) > 0 {
-		secureOption = otlptracegrpc.WithInsecure()
-	}
+func setupRouter(cfg Config, auth *authentication.Authenticator, gen *generator.Generator, profileHandlers *profiles.Handlers) *gin.Engine {
 
-	exporter, err := otlptrace.New(
-		context.Background(),
-		otlptracegrpc.NewClient(
-			secureOption,
-			otlptracegrpc.WithEndpoint(collectorURL),
-		),
-	)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	resources, err := resource.New(
-		context.Background(),
-		resource.WithAttributes(
-			attribute.String("service.name", serviceName),
-			attribute.String("library.language", "go"),
-		),
-	)
-	if err != nil {
-		log.Printf("Could not set resources: %v", err)
+	r := gin.New()
+	// Without trusted proxies gin believes any X-Forwarded-For header, which
+	// would let clients pick the IP that is rate limited and audited. The
+	// list is nil when TRUSTED_PROXIES is empty, which trusts no proxy.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
 	}
-
-	otel.SetTracerProvider(
-		sdktrace.NewTracerProvider(
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter),
-			sdktrace.WithResource(resources),
-		),
-	)
-	return exporter.Shutdown
-}
-
-func setupRouter() *gin.Engine {
-
-	r := gin.Default()
-	r.Use(otelgin.Middleware(serviceName))
+	r.Use(gin.Recovery(), logging.Middleware(), otelgin.Middleware(cfg.Telemetry.ServiceName))
+	limiter := ratelimit.Get()
 	docs.SwaggerInfo.BasePath = "/api/v1"
 	v1 := r.Group("/api/v1")
 	{
+		v1.Use(limiter.PerIP())
 		login := v1.Group("/authentication")
 		{
 
-			login.POST("/login", authentication.LoginHandler)
+			login.POST("/login", auth.LoginHandler)
 		}
 	}
 
 	protected := r.Group(docs.SwaggerInfo.BasePath)
 	{
-		protected.Use(authentication.JWTMiddleware())
-		protected.GET("/generate", generator.WireGuardHandler)
+		protected.Use(limiter.PerIP(), auth.JWTMiddleware(), limiter.PerUser())
+		protected.GET("/generate", limiter.EnrollQuota(), gen.WireGuardHandler)
+		protected.GET("/peers", gen.ListPeersHandler)
+		protected.POST("/peers", limiter.EnrollQuota(), gen.EnrollHandler)
+		protected.GET("/peers/:id", gen.GetPeerHandler)
+		protected.DELETE("/peers/:id", gen.RevokePeerHandler)
+		protected.POST("/peers/:id/rotate", gen.RotatePeerHandler)
+		protected.POST("/peers/:id/heartbeat", gen.HeartbeatHandler)
+		protected.PUT("/peers/:id/key", gen.UpdateKeyHandler)
+		protected.GET("/peers/:id/config", authentication.RequireAdmin(), gen.DownloadConfigHandler)
+		protected.GET("/profiles", profileHandlers.ListHandler)
+		protected.GET("/profiles/:name", profileHandlers.GetHandler)
+		protected.PUT("/profiles/:name", authentication.RequireAdmin(), profileHandlers.PutHandler)
+		protected.DELETE("/profiles/:name", authentication.RequireAdmin(), profileHandlers.DeleteHandler)
+		protected.GET("/pools/:name/stats", authentication.RequireAdmin(), pools.StatsHandler)
+		protected.GET("/audit", authentication.RequireAdmin(), audit.QueryHandler)
+		protected.GET("/audit/verify", authentication.RequireAdmin(), audit.VerifyHandler)
+		protected.GET("/status", authentication.RequireAdmin(), health.StatusHandler)
+		protected.GET("/events", events.StreamHandler)
+		protected.GET("/events/dead-letters", authentication.RequireAdmin(), events.ListDeadLettersHandler)
+		protected.POST("/events/dead-letters/:id/retry", authentication.RequireAdmin(), events.RetryDeadLetterHandler)
+		protected.DELETE("/events/dead-letters/:id", authentication.RequireAdmin(), events.DeleteDeadLetterHandler)
 	}
 
+	if cfg.Metrics.Enabled {
+		r.GET("/metrics", metrics.Handler(cfg.Metrics))
+	}
+	r.GET("/healthz", health.LivenessHandler)
+	r.GET("/readyz", health.ReadinessHandler)
+	r.GET("/.well-known/jwks.json", authentication.JWKSHandler)
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
 	return r
 }
@@ -144,34 +106,160 @@ func setupRouter() *gin.Engine {
 // @name Authorization
 // @BasePath /api/v1/
 func main() {
-	var err error
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	setLogger(logging.New(cfg.Log, os.Stderr))
+
+	var readers []sdkmetric.Reader
+	if cfg.Metrics.Enabled {
+		reader, err := metrics.NewReader()
+		if err != nil {
+			fatal("Failed to set up metrics", err)
+		}
+		readers = append(readers, reader)
+	}
+	shutdownTelemetry, err := telemetry.Init(ctx, cfg.Telemetry, readers...)
+	if err != nil {
+		fatal("Failed to set up telemetry", err)
+	}
+	if handler := telemetry.LogHandler(); handler != nil {
+		setLogger(logging.New(cfg.Log, os.Stderr, handler))
+	}
+	if cfg.Telemetry.Enabled {
+		slog.Info("Exporting traces, metrics and logs", "exporter", cfg.Telemetry.Exporter)
+	} else {
+		slog.Info("No tracing")
+	}
 
-	if err := config.InitEtcdAndHeap(ctx); err != nil {
-		log.Fatalf("Failed to initialize etcd and IP heap: %v", err)
+	server, err := config.New(cfg.Server)
+	if err != nil {
+		fatal("Failed to initialize WireGuard server config", err)
+	}
+	if err := server.OpenStorage(ctx); err != nil {
+		fatal("Failed to initialize pool store and IP heap", err)
 	}
+	if err := allocator.RegisterHeapMetrics(server.IPHeap()); err != nil {
+		slog.Error("Failed to register heap metrics", "error", err)
+	}
+	if cfg.Metrics.Enabled && cfg.Metrics.PeerStats {
+		if err := metrics.RegisterDeviceMetrics(server.Interface()); err != nil {
+			slog.Warn("Per-peer WireGuard metrics are disabled", "error", err)
+		}
+	}
+
+	bg := newWorkers()
+	audit.Init(server.EtcdClient(), cfg.Audit)
+	bg.Go(audit.Run)
+	bg.Go(func(ctx context.Context) {
+		allocator.WatchAvailableIPs(ctx, server.PoolStore(), server.IPHeap())
+	})
+	slog.Info("Watching for new available IPs added to the pool")
+
+	if cli := server.EtcdClient(); cli != nil {
+		ratelimit.Init(cli, cfg.RateLimit)
+	} else {
+		slog.Warn("No etcd configured: audit log and rate limiting are disabled")
+	}
+	gen := generator.New(server, cfg.Peers)
+	auth := authentication.NewAuthenticator(cfg.Roles)
 
-	go allocator.WatchAvailableIPs(ctx, config.GetEtcdClient(), config.GetIPHeap())
-	log.Printf("Watching for new available IPs added to etcd")
+	vc, err := vaultclient.InitClient(cfg.Vault)
+	if err != nil {
+		fatal("Failed to initialize Vault client", err)
+	}
+	bg.Go(vaultclient.WatchToken)
 
-	if enableTracing {
-		cleanup := initTracer()
-		defer cleanup(context.Background())
+	peerCipher, err := allocator.NewCipher(cfg.Cipher, vc)
+	if err != nil {
+		fatal("Failed to set up peer record encryption", err)
 	}
+	allocator.SetCipher(peerCipher, cfg.Cipher.Fields)
 
-	_, err = vaultclient.InitClient()
+	// Events name the owner of the peer and the collector reads the peer
+	// records, both need the cipher
+	eventBus := events.Init(server.EtcdClient(), cfg.Events, peerCipher)
+	bg.Go(eventBus.Run)
+
+	poolMonitor := pools.Init(server, cfg.Pools)
+	bg.Go(poolMonitor.Run)
+
+	statusCollector, err := peerstatus.Init(server.PoolStore(), server.EtcdClient(), server.Interface(), cfg.Status)
 	if err != nil {
-		log.Fatalf("Failed to initialize Vault client %v", err)
+		slog.Warn("Peer status tracking is disabled", "error", err)
+	} else {
+		bg.Go(statusCollector.Run)
 	}
 
-	err = vaultclient.InitSecrets()
+	err = vaultclient.InitSecrets(cfg.Secrets)
 	if err != nil {
-		log.Fatalf("Failed to load secrets: %v", err)
+		fatal("Failed to load secrets", err)
+	}
+	slog.Info("Secrets loaded")
+	bg.Go(vaultclient.WatchSecrets)
+	bg.Go(gen.ReapExpiredPeers)
+
+	if err := authentication.InitKeys(ctx, cfg.Keys); err != nil {
+		fatal("Failed to load JWT signing keys", err)
 	}
-	log.Println("Secrets loaded")
-	log.Println("Hello World from Wireable!")
+	bg.Go(authentication.WatchKeys)
 
-	r := setupRouter()
+	checks := []health.Check{
+		health.VaultCheck(),
+		health.WatcherCheck(),
+		health.DeviceCheck(server.Interface()),
+		health.TemplatesCheck(gen),
+	}
+	if cli := server.EtcdClient(); cli != nil {
+		checks = append(checks, health.EtcdCheck(cli))
+	}
+	health.Init(cfg.Health, checks...)
+	slog.Info("Hello World from Wireable!")
+
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: setupRouter(cfg, auth, gen, profiles.NewHandlers(server.EtcdClient())),
+	}
+	srv.RegisterOnShutdown(eventBus.CloseStreams)
+
+	if cfg.TLS.Enabled {
+		reloader, err := tlsserver.NewReloader(cfg.TLS)
+		if err != nil {
+			fatal("Failed to load TLS certificate", err)
+		}
+		bg.Go(reloader.Run)
+		srv.TLSConfig = reloader.TLSConfig()
+		slog.Info("TLS enabled", "client_certificates", cfg.TLS.ClientAuth)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLS.Enabled {
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	slog.Info("Listening", "address", srv.Addr)
+
+	select {
+	case err := <-serveErr:
+		fatal("Server stopped", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process without waiting
+	stop()
+	shutdown(srv, bg, server, shutdownTelemetry, cfg.ShutdownTimeout)
+}
 
-	r.Run(":8081")
+// setLogger makes l the default logger and hands it to the packages that take
+// one.
+func setLogger(l *slog.Logger) {
+	slog.SetDefault(l)
+	allocator.SetLogger(l)
+	vaultclient.SetLogger(l)
 }
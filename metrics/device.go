@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+var meter = otel.Meter("wireable/metrics")
+
+// RegisterDeviceMetrics exports the handshake age and traffic of every peer
+// of the WireGuard interface, read from the device on each scrape.
+func RegisterDeviceMetrics(iface string) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	if _, err := client.Device(iface); err != nil {
+		client.Close()
+		return err
+	}
+
+	handshakeAge, err := meter.Float64ObservableGauge("wireable.peer.last_handshake_age",
+		metric.WithDescription("Time since the last handshake of the peer"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	received, err := meter.Int64ObservableCounter("wireable.peer.receive",
+		metric.WithDescription("Bytes received from the peer"),
+		metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	transmitted, err := meter.Int64ObservableCounter("wireable.peer.transmit",
+		metric.WithDescription("Bytes sent to the peer"),
+		metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		device, err := client.Device(iface)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, peer := range device.Peers {
+			attrs := []attribute.KeyValue{attribute.String("public_key", peer.PublicKey.String())}
+			if len(peer.AllowedIPs) > 0 {
+				attrs = append(attrs, attribute.String("ip", peer.AllowedIPs[0].IP.String()))
+			}
+			opt := metric.WithAttributes(attrs...)
+
+			// Peers that never completed a handshake have no age
+			if !peer.LastHandshakeTime.IsZero() {
+				o.ObserveFloat64(handshakeAge, now.Sub(peer.LastHandshakeTime).Seconds(), opt)
+			}
+			o.ObserveInt64(received, peer.ReceiveBytes, opt)
+			o.ObserveInt64(transmitted, peer.TransmitBytes, opt)
+		}
+		return nil
+	}, handshakeAge, received, transmitted)
+	return err
+}
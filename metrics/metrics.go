@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// Config controls the Prometheus endpoint.
+type Config struct {
+	Enabled   bool
+	PeerStats bool
+	// Token, when set, must be sent as a bearer token on scrapes.
+	Token settings.Secret
+}
+
+// ConfigFrom reads the metrics settings. The per-peer metrics name the public
+// key and IP of every peer, so they are only served with a token.
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Enabled:   s.Bool("METRICS_ENABLED", true),
+		PeerStats: s.Bool("METRICS_PEER_STATS", false),
+		Token:     s.Secret("METRICS_TOKEN"),
+	}
+	if cfg.Enabled && cfg.PeerStats && cfg.Token == "" {
+		s.Fail(errors.New("METRICS_TOKEN is required with METRICS_PEER_STATS"))
+	}
+	return cfg
+}
+
+// NewReader returns a metric reader that serves every metric of the service
+// through the Prometheus registry. It must be added to the meter provider.
+func NewReader() (sdkmetric.Reader, error) {
+	return prometheus.New()
+}
+
+// Handler serves the metrics in the Prometheus text format. When cfg has a
+// token, scrapes must send it as a bearer token.
+func Handler(cfg Config) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	expected := cfg.Token.Reveal()
+	return func(c *gin.Context) {
+		if expected != "" {
+			token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,52 @@
+package peerstatus
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/Zacky3181V/wireable/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	meter       = otel.Meter("wireable/peerstatus")
+	transitions metric.Int64Counter
+)
+
+func stateAttribute(state string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String("state", state))
+}
+
+// registerMetrics exports the peer counts of the latest collection and
+// counts transitions.
+func registerMetrics() {
+	var err error
+	transitions, err = meter.Int64Counter("wireable.peer.status_transitions",
+		metric.WithDescription("Peers that went online or offline"))
+	if err != nil {
+		slog.Error("Failed to register peer status metrics", "error", err)
+		return
+	}
+	peers, err := meter.Int64ObservableGauge("wireable.peer.status",
+		metric.WithDescription("Peers by online state"))
+	if err != nil {
+		slog.Error("Failed to register peer status metrics", "error", err)
+		return
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		c := Get()
+		if c == nil {
+			return nil
+		}
+		online, total := c.counts()
+		o.ObserveInt64(peers, int64(online), stateAttribute(api.PeerOnline))
+		o.ObserveInt64(peers, int64(total-online), stateAttribute(api.PeerOffline))
+		return nil
+	}, peers)
+	if err != nil {
+		slog.Error("Failed to register peer status metrics", "error", err)
+	}
+}
@@ -0,0 +1,348 @@
+// Package peerstatus tracks whether peers are connected. A collector reads
+// the latest handshake and the traffic counters of every peer from the
+// WireGuard device and records when peers go online and offline.
+package peerstatus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/events"
+	"github.com/Zacky3181V/wireable/settings"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	keyPrefix           = "/peer-status/"
+	collectorActor      = "status-collector"
+	defaultInterval     = 30 * time.Second
+	defaultOfflineAfter = 5 * time.Minute
+)
+
+// Config sets how often the device is read and how long after its latest
+// handshake a peer counts as offline. WireGuard renews the handshake every
+// two minutes while there is traffic, so OfflineAfter should be longer.
+type Config struct {
+	Interval     time.Duration
+	OfflineAfter time.Duration
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Interval:     s.Duration("PEER_STATUS_INTERVAL", defaultInterval),
+		OfflineAfter: s.Duration("PEER_OFFLINE_THRESHOLD", defaultOfflineAfter),
+	}
+	if cfg.Interval <= 0 {
+		s.Invalid("PEER_STATUS_INTERVAL", cfg.Interval.String(), errors.New("must be positive"))
+	}
+	if cfg.OfflineAfter <= 0 {
+		s.Invalid("PEER_OFFLINE_THRESHOLD", cfg.OfflineAfter.String(), errors.New("must be positive"))
+	}
+	return cfg
+}
+
+// Collector keeps the status of every peer up to date.
+type Collector struct {
+	store allocator.PoolStore
+	cli   *clientv3.Client
+	iface string
+	cfg   Config
+	wg    *wgctrl.Client
+
+	mu sync.Mutex
+	// statuses holds the status when there is no etcd to share it through.
+	statuses map[string]api.PeerStatus
+	// online and total are the counts of the latest collection.
+	online, total int
+}
+
+var collector *Collector
+
+// Init sets up the collector for the WireGuard interface iface. cli may be
+// nil, in which case the status is only kept in memory.
+func Init(store allocator.PoolStore, cli *clientv3.Client, iface string, cfg Config) (*Collector, error) {
+	wg, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wg.Device(iface); err != nil {
+		wg.Close()
+		return nil, err
+	}
+	collector = &Collector{store: store, cli: cli, iface: iface, cfg: cfg, wg: wg, statuses: make(map[string]api.PeerStatus)}
+	registerMetrics()
+	return collector, nil
+}
+
+// Get returns the collector set up by Init, or nil.
+func Get() *Collector {
+	return collector
+}
+
+// Run collects the status of every peer every interval until ctx is done.
+func (c *Collector) Run(ctx context.Context) {
+	defer c.wg.Close()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil {
+			slog.ErrorContext(ctx, "Failed to collect peer status", "interface", c.iface, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the status of the peer, or nil when it was not collected
+// yet.
+func (c *Collector) Status(ctx context.Context, id string) (*api.PeerStatus, error) {
+	if c.cli == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if status, ok := c.statuses[id]; ok {
+			return &status, nil
+		}
+		return nil, nil
+	}
+
+	resp, err := c.cli.Get(ctx, keyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var status api.PeerStatus
+	if err := json.Unmarshal(resp.Kvs[0].Value, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Statuses returns the status of every peer by ID.
+func (c *Collector) Statuses(ctx context.Context) (map[string]api.PeerStatus, error) {
+	statuses, _, err := c.load(ctx)
+	return statuses, err
+}
+
+// collect compares the device with the recorded statuses and records what
+// changed. Replicas share the status through etcd; each one only sees the
+// handshakes of its own device, so the newest handshake wins and a
+// transition is recorded, and reported, by the replica that writes it.
+func (c *Collector) collect(ctx context.Context) error {
+	device, err := c.wg.Device(c.iface)
+	if err != nil {
+		return err
+	}
+	records, err := allocator.ListPeers(ctx, c.store)
+	if err != nil {
+		return err
+	}
+	stored, revisions, err := c.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	observed := make(map[string]*wgtypes.Peer, len(device.Peers))
+	for i := range device.Peers {
+		observed[device.Peers[i].PublicKey.String()] = &device.Peers[i]
+	}
+
+	now := time.Now().UTC()
+	online := 0
+	for i := range records {
+		record := &records[i]
+		prev, known := stored[record.ID]
+		next := c.next(record, prev, known, observed[record.PublicKey], now)
+		if next.State == api.PeerOnline {
+			online++
+		}
+		if known && !changed(prev, next) {
+			continue
+		}
+
+		saved, err := c.save(ctx, record.ID, next, revisions[record.ID])
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to save peer status", "peer", record.ID, "error", err)
+			continue
+		}
+		if saved && known && prev.State != next.State {
+			c.transition(ctx, record, next)
+		}
+	}
+
+	// Forget the status of revoked and expired peers
+	ids := make(map[string]bool, len(records))
+	for _, record := range records {
+		ids[record.ID] = true
+	}
+	for id := range stored {
+		if !ids[id] {
+			if err := c.remove(ctx, id, revisions[id]); err != nil {
+				slog.ErrorContext(ctx, "Failed to remove peer status", "peer", id, "error", err)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.online, c.total = online, len(records)
+	c.mu.Unlock()
+	return nil
+}
+
+// next returns the status of record given what was recorded and what the
+// device reports. peer is nil when the device does not know the peer.
+func (c *Collector) next(record *allocator.PeerRecord, prev api.PeerStatus, known bool, peer *wgtypes.Peer, now time.Time) api.PeerStatus {
+	next := prev
+	if !known {
+		next = api.PeerStatus{State: api.PeerOffline, Since: record.CreatedAt}
+	}
+	if peer != nil && !peer.LastHandshakeTime.IsZero() &&
+		(next.LastHandshake == nil || peer.LastHandshakeTime.After(*next.LastHandshake)) {
+		handshake := peer.LastHandshakeTime.UTC()
+		next.LastHandshake = &handshake
+		next.ReceiveBytes, next.TransmitBytes = peer.ReceiveBytes, peer.TransmitBytes
+	}
+
+	state := api.PeerOffline
+	if next.LastHandshake != nil && now.Sub(*next.LastHandshake) < c.cfg.OfflineAfter {
+		state = api.PeerOnline
+	}
+	if state != next.State {
+		// Derive the time from the handshake, so replicas agree on it
+		next.State = state
+		switch {
+		case next.LastHandshake == nil:
+			// A stored status without a handshake, e.g. written by hand
+			next.Since = record.CreatedAt
+			if next.Since.IsZero() {
+				next.Since = now
+			}
+		case state == api.PeerOffline:
+			next.Since = next.LastHandshake.Add(c.cfg.OfflineAfter)
+		default:
+			next.Since = *next.LastHandshake
+		}
+	}
+	return next
+}
+
+func changed(prev, next api.PeerStatus) bool {
+	if prev.State != next.State {
+		return true
+	}
+	if prev.LastHandshake == nil || next.LastHandshake == nil {
+		return prev.LastHandshake != next.LastHandshake
+	}
+	return !prev.LastHandshake.Equal(*next.LastHandshake)
+}
+
+// transition reports that the peer went online or offline.
+func (c *Collector) transition(ctx context.Context, record *allocator.PeerRecord, status api.PeerStatus) {
+	if transitions != nil {
+		transitions.Add(ctx, 1, stateAttribute(status.State))
+	}
+	peer := *record
+	peer.Status = &status
+	if status.State == api.PeerOffline {
+		slog.WarnContext(ctx, "Peer went offline", "peer", record.ID, "ip", record.IP, "owner", record.Owner,
+			"last_handshake", status.LastHandshake, "threshold", c.cfg.OfflineAfter)
+		events.Publish(ctx, api.EventPeerOffline, collectorActor, &peer, nil)
+		return
+	}
+	slog.InfoContext(ctx, "Peer came online", "peer", record.ID, "ip", record.IP, "owner", record.Owner)
+	events.Publish(ctx, api.EventPeerOnline, collectorActor, &peer, nil)
+}
+
+// load returns the recorded statuses by peer ID and, with etcd, the
+// revisions they were read at.
+func (c *Collector) load(ctx context.Context) (map[string]api.PeerStatus, map[string]int64, error) {
+	statuses := make(map[string]api.PeerStatus)
+	if c.cli == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for id, status := range c.statuses {
+			statuses[id] = status
+		}
+		return statuses, nil, nil
+	}
+
+	resp, err := c.cli.Get(ctx, keyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, nil, err
+	}
+	revisions := make(map[string]int64, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		id := string(kv.Key[len(keyPrefix):])
+		var status api.PeerStatus
+		if err := json.Unmarshal(kv.Value, &status); err != nil {
+			slog.WarnContext(ctx, "Ignoring invalid peer status", "peer", id, "error", err)
+			continue
+		}
+		statuses[id] = status
+		revisions[id] = kv.ModRevision
+	}
+	return statuses, revisions, nil
+}
+
+// save writes the status unless another replica changed it since revision
+// was read, and reports whether it did.
+func (c *Collector) save(ctx context.Context, id string, status api.PeerStatus, revision int64) (bool, error) {
+	if c.cli == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.statuses[id] = status
+		return true, nil
+	}
+
+	value, err := json.Marshal(status)
+	if err != nil {
+		return false, err
+	}
+	key := keyPrefix + id
+	resp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (c *Collector) remove(ctx context.Context, id string, revision int64) error {
+	if c.cli == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.statuses, id)
+		return nil
+	}
+
+	key := keyPrefix + id
+	_, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	return err
+}
+
+// counts returns the number of online peers and of all peers as of the
+// latest collection.
+func (c *Collector) counts() (online, total int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.online, c.total
+}
@@ -0,0 +1,120 @@
+package pools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const keyPrefix = "/pools/"
+
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is logged and posted to the webhook when utilization crosses a
+// threshold.
+type Alert struct {
+	Pool      string    `json:"pool"`
+	Threshold int       `json:"threshold"`
+	State     string    `json:"state"`
+	Stats     Stats     `json:"stats"`
+	Time      time.Time `json:"time"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func alertKey(pool string, threshold int) string {
+	return fmt.Sprintf("%s%s/alerts/%d", keyPrefix, pool, threshold)
+}
+
+func (m *Monitor) checkThresholds(ctx context.Context, stats Stats) {
+	for _, threshold := range m.cfg.Thresholds {
+		above := stats.Utilization >= float64(threshold)
+		changed, err := m.setFiring(ctx, threshold, above)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to update pool alert state", "pool", m.cfg.Name, "threshold", threshold, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		alert := Alert{Pool: m.cfg.Name, Threshold: threshold, State: AlertResolved, Stats: stats, Time: stats.Time}
+		if above {
+			alert.State = AlertFiring
+		}
+		m.notify(ctx, alert)
+	}
+}
+
+// setFiring records whether the alert at threshold fires and reports if that
+// changed. With etcd the state is shared, so only the replica that flips it
+// sends the alert.
+func (m *Monitor) setFiring(ctx context.Context, threshold int, firing bool) (bool, error) {
+	if m.cli == nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.firing[threshold] == firing {
+			return false, nil
+		}
+		m.firing[threshold] = firing
+		return true, nil
+	}
+
+	key := alertKey(m.cfg.Name, threshold)
+	txn := m.cli.Txn(ctx)
+	if firing {
+		txn = txn.If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, time.Now().UTC().Format(time.RFC3339)))
+	} else {
+		txn = txn.If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+			Then(clientv3.OpDelete(key))
+	}
+	resp, err := txn.Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (m *Monitor) notify(ctx context.Context, alert Alert) {
+	slog.WarnContext(ctx, "Pool utilization alert", "pool", alert.Pool, "threshold", alert.Threshold, "state", alert.State,
+		"utilization", alert.Stats.Utilization, "available", alert.Stats.Available, "total", alert.Stats.Available+alert.Stats.Taken)
+
+	if m.cfg.WebhookURL == "" {
+		return
+	}
+	if err := postAlert(ctx, m.cfg.WebhookURL, alert); err != nil {
+		slog.ErrorContext(ctx, "Failed to send pool alert webhook", "error", err)
+	}
+}
+
+func postAlert(ctx context.Context, url string, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
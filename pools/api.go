@@ -0,0 +1,34 @@
+package pools
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Get pool stats
+// @Description Returns address counts and utilization of the pool. Expiring counts taken addresses whose peer expires within POOL_EXPIRING_WINDOW. Requires the admin role.
+// @ID get-pool-stats
+// @Produce json
+// @Security BearerAuth
+// @Param name path string true "Pool name"
+// @Success 200 {object} api.PoolStats
+// @Failure 404
+// @Failure 500
+// @Router /pools/{name}/stats [get]
+func StatsHandler(c *gin.Context) {
+	m := Get()
+	if m == nil || c.Param("name") != m.cfg.Name {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pool not found"})
+		return
+	}
+
+	stats, err := m.Collect(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to collect pool stats", "pool", m.cfg.Name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to collect pool stats"})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
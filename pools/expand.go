@@ -0,0 +1,240 @@
+package pools
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// ErrSupernetExhausted is returned when every block of the supernet is in
+// use.
+var ErrSupernetExhausted = errors.New("no free block left in the supernet")
+
+func blocksPrefix(pool string) string {
+	return keyPrefix + pool + "/blocks/"
+}
+
+func expandLockKey(pool string) string {
+	return keyPrefix + pool + "/expand-lock"
+}
+
+// blockIndex returns the index of the block of the supernet ip falls in, or
+// -1.
+func (m *Monitor) blockIndex(ip net.IP) int {
+	ip4 := ip.To4()
+	if ip4 == nil || !m.cfg.Supernet.Contains(ip4) {
+		return -1
+	}
+	offset := binary.BigEndian.Uint32(ip4) - binary.BigEndian.Uint32(m.cfg.Supernet.IP.To4())
+	return int(offset >> (32 - m.cfg.ChunkPrefix))
+}
+
+func (m *Monitor) blockCount() int {
+	ones, _ := m.cfg.Supernet.Mask.Size()
+	return 1 << (m.cfg.ChunkPrefix - ones)
+}
+
+// block returns the network of block i and its first host address, which is
+// the server's address in that block.
+func (m *Monitor) block(i int) (*net.IPNet, net.IP) {
+	base := binary.BigEndian.Uint32(m.cfg.Supernet.IP.To4()) + uint32(i)<<(32-m.cfg.ChunkPrefix)
+	network := make(net.IP, 4)
+	binary.BigEndian.PutUint32(network, base)
+	server := make(net.IP, 4)
+	binary.BigEndian.PutUint32(server, base+1)
+	return &net.IPNet{IP: network, Mask: net.CIDRMask(m.cfg.ChunkPrefix, 32)}, server
+}
+
+// usedBlocks returns the blocks that are claimed in etcd or hold addresses of
+// the pool, and every address of the pool.
+func (m *Monitor) usedBlocks(ctx context.Context) (map[int]bool, map[string]bool, error) {
+	available, _, err := m.store.Available(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	taken, _, err := m.store.Taken(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	used := make(map[int]bool)
+	addresses := make(map[string]bool, len(available)+len(taken))
+	for _, ip := range available {
+		addresses[ip.String()] = true
+	}
+	for _, entry := range taken {
+		addresses[entry.IP.String()] = true
+	}
+	for address := range addresses {
+		if i := m.blockIndex(net.ParseIP(address)); i >= 0 {
+			used[i] = true
+		}
+	}
+
+	if m.cli != nil {
+		resp, err := m.cli.Get(ctx, blocksPrefix(m.cfg.Name), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, kv := range resp.Kvs {
+			_, network, err := net.ParseCIDR(strings.TrimPrefix(string(kv.Key), blocksPrefix(m.cfg.Name)))
+			if err != nil {
+				continue
+			}
+			if i := m.blockIndex(network.IP); i >= 0 {
+				used[i] = true
+			}
+		}
+	}
+	return used, addresses, nil
+}
+
+// lockExpansion makes sure only one replica expands the pool at a time. It
+// returns false if another replica holds the lock.
+func (m *Monitor) lockExpansion(ctx context.Context) (func(), bool, error) {
+	if m.cli == nil {
+		m.expandMu.Lock()
+		return m.expandMu.Unlock, true, nil
+	}
+
+	session, err := concurrency.NewSession(m.cli, concurrency.WithTTL(30), concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+	mutex := concurrency.NewMutex(session, expandLockKey(m.cfg.Name))
+	if err := mutex.TryLock(ctx); err != nil {
+		session.Close()
+		if errors.Is(err, concurrency.ErrLocked) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return func() {
+		mutex.Unlock(context.Background())
+		session.Close()
+	}, true, nil
+}
+
+// expand claims the first free block of the supernet and adds its addresses
+// to the pool. Utilization is checked again under the lock, so replicas that
+// saw the same low watermark do not expand twice.
+func (m *Monitor) expand(ctx context.Context) error {
+	unlock, locked, err := m.lockExpansion(ctx)
+	if err != nil || !locked {
+		return err
+	}
+	defer unlock()
+
+	stats, err := m.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if stats.Utilization < float64(m.cfg.ExpandThreshold) {
+		return nil
+	}
+
+	used, _, err := m.usedBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	next := -1
+	for i := 0; i < m.blockCount(); i++ {
+		if !used[i] {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		return ErrSupernetExhausted
+	}
+	network, _ := m.block(next)
+
+	if m.cli != nil {
+		key := blocksPrefix(m.cfg.Name) + network.String()
+		resp, err := m.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, time.Now().UTC().Format(time.RFC3339))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			return fmt.Errorf("block %s was claimed concurrently", network)
+		}
+	}
+
+	if err := allocator.SeedCIDR(ctx, m.store, network.String(), m.cfg.Reserved); err != nil {
+		return fmt.Errorf("failed to add block %s: %w", network, err)
+	}
+	slog.InfoContext(ctx, "Expanded pool", "pool", m.cfg.Name, "utilization", stats.Utilization, "block", network)
+	return nil
+}
+
+// syncServerAddresses gives the server interface an address in every block
+// added by expansion, which also routes the block to it. Every replica runs
+// it, so blocks added by another replica are picked up too. Blocks whose
+// first host is a pool address or already a server address were not added by
+// expansion and are left alone.
+func (m *Monitor) syncServerAddresses(ctx context.Context) error {
+	used, addresses, err := m.usedBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := m.server.ServerAddresses()
+	if err != nil {
+		return err
+	}
+	serverIPs := make(map[string]bool, len(current))
+	for _, address := range current {
+		if ip, _, err := net.ParseCIDR(address); err == nil {
+			serverIPs[ip.String()] = true
+		}
+	}
+
+	for i := range used {
+		network, server := m.block(i)
+		if m.serverBlocks[network.String()] {
+			continue
+		}
+		if addresses[server.String()] || serverIPs[server.String()] {
+			m.serverBlocks[network.String()] = true
+			continue
+		}
+
+		address := fmt.Sprintf("%s/%d", server, m.cfg.ChunkPrefix)
+		if err := addInterfaceAddress(m.server.Interface(), address); err != nil {
+			slog.ErrorContext(ctx, "Failed to add address to the server interface", "address", address, "error", err)
+			continue
+		}
+		if err := m.server.AddServerAddress(address); err != nil {
+			slog.ErrorContext(ctx, "Failed to add address to peers.conf", "address", address, "error", err)
+			continue
+		}
+		m.serverBlocks[network.String()] = true
+		slog.InfoContext(ctx, "Added server address", "address", address, "block", network)
+	}
+	return nil
+}
+
+func addInterfaceAddress(iface, address string) error {
+	cmd := exec.Command(
+		"sudo", "ip", "address", "add", address,
+		"dev", iface,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil && !strings.Contains(string(output), "File exists") {
+		return fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
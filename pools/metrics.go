@@ -0,0 +1,56 @@
+package pools
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("wireable/pools")
+
+// registerMetrics exports the stats of the latest collection, so scraping
+// does not read the store.
+func registerMetrics() {
+	addresses, err := meter.Int64ObservableGauge("wireable.pool.addresses",
+		metric.WithDescription("Addresses of the pool by state"))
+	if err != nil {
+		slog.Error("Failed to register pool metrics", "error", err)
+		return
+	}
+	utilization, err := meter.Float64ObservableGauge("wireable.pool.utilization",
+		metric.WithDescription("Percentage of allocatable pool addresses that are taken"),
+		metric.WithUnit("%"))
+	if err != nil {
+		slog.Error("Failed to register pool metrics", "error", err)
+		return
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		m := Get()
+		if m == nil {
+			return nil
+		}
+		stats := m.Last()
+		if stats == nil {
+			return nil
+		}
+
+		pool := attribute.String("pool", stats.Name)
+		for state, n := range map[string]int{
+			"available": stats.Available,
+			"taken":     stats.Taken,
+			"reserved":  stats.Reserved,
+			"expiring":  stats.Expiring,
+		} {
+			o.ObserveInt64(addresses, int64(n), metric.WithAttributes(pool, attribute.String("state", state)))
+		}
+		o.ObserveFloat64(utilization, stats.Utilization, metric.WithAttributes(pool))
+		return nil
+	}, addresses, utilization)
+	if err != nil {
+		slog.Error("Failed to register pool metrics", "error", err)
+	}
+}
@@ -0,0 +1,216 @@
+package pools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/allocator"
+	"github.com/Zacky3181V/wireable/api"
+	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/settings"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	defaultName           = "default"
+	defaultInterval       = 30 * time.Second
+	defaultExpiringWindow = 24 * time.Hour
+	defaultChunkPrefix    = 24
+	defaultExpandAt       = 80
+)
+
+// Config describes the pool and when to alert on it. Thresholds are
+// utilization percentages; an alert fires when utilization rises to one and
+// resolves when it drops below it again.
+type Config struct {
+	Name           string
+	Reserved       []net.IP
+	ExpiringWindow time.Duration
+	Interval       time.Duration
+	Thresholds     []int
+	WebhookURL     string
+
+	// Supernet, when set, is carved into blocks of ChunkPrefix that are
+	// added to the pool once utilization reaches ExpandThreshold percent.
+	Supernet        *net.IPNet
+	ChunkPrefix     int
+	ExpandThreshold int
+}
+
+// ConfigFrom reads the pool settings. The reserved addresses are those of
+// the pool store.
+func ConfigFrom(s *settings.Source, store allocator.StoreConfig) Config {
+	cfg := Config{
+		Name:            s.String("POOL_NAME", defaultName),
+		Reserved:        store.Reserved,
+		ExpiringWindow:  s.Duration("POOL_EXPIRING_WINDOW", defaultExpiringWindow),
+		Interval:        s.Duration("POOL_STATS_INTERVAL", defaultInterval),
+		Thresholds:      parseThresholds(s),
+		WebhookURL:      s.String("POOL_ALERT_WEBHOOK_URL", ""),
+		ChunkPrefix:     s.Int("POOL_CHUNK_PREFIX", defaultChunkPrefix),
+		ExpandThreshold: s.Int("POOL_EXPAND_THRESHOLD", defaultExpandAt),
+	}
+	if cfg.ExpiringWindow <= 0 {
+		s.Invalid("POOL_EXPIRING_WINDOW", cfg.ExpiringWindow.String(), errors.New("must be positive"))
+	}
+	if cfg.Interval <= 0 {
+		s.Invalid("POOL_STATS_INTERVAL", cfg.Interval.String(), errors.New("must be positive"))
+	}
+
+	if v := s.String("POOL_SUPERNET", ""); v != "" {
+		_, supernet, err := net.ParseCIDR(v)
+		switch {
+		case err != nil:
+			s.Invalid("POOL_SUPERNET", v, err)
+		case supernet.IP.To4() == nil:
+			s.Invalid("POOL_SUPERNET", v, errors.New("only IPv4 supernets are supported"))
+		default:
+			cfg.Supernet = supernet
+		}
+	}
+	if cfg.Supernet != nil {
+		ones, _ := cfg.Supernet.Mask.Size()
+		if cfg.ChunkPrefix < ones || cfg.ChunkPrefix > 30 {
+			s.Invalid("POOL_CHUNK_PREFIX", strconv.Itoa(cfg.ChunkPrefix), fmt.Errorf("must be between /%d and /30 to fit in %s", ones, cfg.Supernet))
+		}
+	}
+	return cfg
+}
+
+// parseThresholds parses "80,90,95" and returns the percentages in ascending
+// order.
+func parseThresholds(s *settings.Source) []int {
+	var thresholds []int
+	for _, entry := range s.List("POOL_ALERT_THRESHOLDS") {
+		n, err := strconv.Atoi(entry)
+		if err != nil || n <= 0 || n > 100 {
+			s.Invalid("POOL_ALERT_THRESHOLDS", entry, errors.New("expected a percentage between 1 and 100"))
+			continue
+		}
+		thresholds = append(thresholds, n)
+	}
+	sort.Ints(thresholds)
+	return thresholds
+}
+
+// Stats is a snapshot of a pool.
+type Stats = api.PoolStats
+
+// Monitor collects pool stats periodically for the metrics, raises
+// utilization alerts and expands the pool from the supernet.
+type Monitor struct {
+	server *config.Server
+	store  allocator.PoolStore
+	cli    *clientv3.Client
+	cfg    Config
+
+	mu   sync.Mutex
+	last *Stats
+	// firing holds the alert state when there is no etcd to share it
+	// through.
+	firing map[int]bool
+
+	// expandMu serializes expansion when there is no etcd to lock in.
+	expandMu sync.Mutex
+	// serverBlocks are the blocks the server interface has an address in.
+	serverBlocks map[string]bool
+}
+
+var monitor *Monitor
+
+// Init sets up the monitor of the pool of server. Without etcd every replica
+// alerts on its own.
+func Init(server *config.Server, cfg Config) *Monitor {
+	monitor = &Monitor{
+		server:       server,
+		store:        server.PoolStore(),
+		cli:          server.EtcdClient(),
+		cfg:          cfg,
+		firing:       make(map[int]bool),
+		serverBlocks: make(map[string]bool),
+	}
+	registerMetrics()
+	return monitor
+}
+
+// Get returns the monitor set up by Init, or nil.
+func Get() *Monitor {
+	return monitor
+}
+
+func (m *Monitor) Config() Config {
+	return m.cfg
+}
+
+// Collect reads fresh stats from the store.
+func (m *Monitor) Collect(ctx context.Context) (Stats, error) {
+	now := time.Now().UTC()
+	usage, err := allocator.PoolUsage(ctx, m.store, m.cfg.Reserved, now.Add(m.cfg.ExpiringWindow))
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		Name:      m.cfg.Name,
+		Total:     usage.Available + usage.Taken + usage.Reserved,
+		Available: usage.Available,
+		Taken:     usage.Taken,
+		Reserved:  usage.Reserved,
+		Expiring:  usage.Expiring,
+		Time:      now,
+	}
+	if allocatable := usage.Available + usage.Taken; allocatable > 0 {
+		stats.Utilization = float64(usage.Taken) * 100 / float64(allocatable)
+	}
+	return stats, nil
+}
+
+// Last returns the stats of the latest collection, or nil.
+func (m *Monitor) Last() *Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Run collects stats every interval, checks the alert thresholds and expands
+// the pool when it runs low until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		stats, err := m.Collect(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to collect pool stats", "pool", m.cfg.Name, "error", err)
+		} else {
+			m.mu.Lock()
+			m.last = &stats
+			m.mu.Unlock()
+			m.checkThresholds(ctx, stats)
+		}
+
+		if m.cfg.Supernet != nil {
+			if err == nil && stats.Utilization >= float64(m.cfg.ExpandThreshold) {
+				if err := m.expand(ctx); err != nil {
+					slog.ErrorContext(ctx, "Failed to expand pool", "pool", m.cfg.Name, "error", err)
+				}
+			}
+			if err := m.syncServerAddresses(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to update server addresses of pool", "pool", m.cfg.Name, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package profiles
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Handlers serves the profiles kept in etcd.
+type Handlers struct {
+	cli *clientv3.Client
+}
+
+// NewHandlers returns the profile handlers. cli may be nil, in which case
+// only the built-in default profile exists and it cannot be changed.
+func NewHandlers(cli *clientv3.Client) *Handlers {
+	return &Handlers{cli: cli}
+}
+
+// @Summary List profiles
+// @Description Lists the client profiles peers can be generated with.
+// @ID list-profiles
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} api.Profile
+// @Failure 500
+// @Router /profiles [get]
+func (h *Handlers) ListHandler(c *gin.Context) {
+	list, err := List(c.Request.Context(), h.cli)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list profiles", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list profiles"})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// @Summary Get profile
+// @Description Returns a single client profile.
+// @ID get-profile
+// @Produce json
+// @Security BearerAuth
+// @Param name path string true "Profile name"
+// @Success 200 {object} api.Profile
+// @Failure 404
+// @Router /profiles/{name} [get]
+func (h *Handlers) GetHandler(c *gin.Context) {
+	profile, err := Get(c.Request.Context(), h.cli, c.Param("name"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to load profile", "profile", c.Param("name"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// @Summary Create or update profile
+// @Description Stores a client profile. Requires the admin role.
+// @ID put-profile
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param name path string true "Profile name"
+// @Param profile body api.Profile true "Profile"
+// @Success 200 {object} api.Profile
+// @Failure 400
+// @Failure 403
+// @Failure 503
+// @Router /profiles/{name} [put]
+func (h *Handlers) PutHandler(c *gin.Context) {
+	var profile Profile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	profile.Name = c.Param("name")
+
+	if err := profile.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := Put(c.Request.Context(), h.cli, profile)
+	if errors.Is(err, ErrReadOnly) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to store profile", "profile", profile.Name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// @Summary Delete profile
+// @Description Deletes a client profile. Requires the admin role.
+// @ID delete-profile
+// @Security BearerAuth
+// @Param name path string true "Profile name"
+// @Success 204
+// @Failure 403
+// @Failure 404
+// @Failure 503
+// @Router /profiles/{name} [delete]
+func (h *Handlers) DeleteHandler(c *gin.Context) {
+	err := Delete(c.Request.Context(), h.cli, c.Param("name"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+	if errors.Is(err, ErrReadOnly) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete profile", "profile", c.Param("name"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete profile"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,134 @@
+package profiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Zacky3181V/wireable/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	profilePrefix = "/profiles/"
+	DefaultName   = "default"
+)
+
+var (
+	ErrNotFound = errors.New("profile not found")
+	// ErrReadOnly is returned when profiles are changed while the service
+	// runs without etcd, where only the built-in default exists.
+	ErrReadOnly = errors.New("profiles are read-only without etcd")
+)
+
+// Profile holds the client side settings rendered into a peer config.
+type Profile = api.Profile
+
+// Default is used when no "default" profile has been stored in etcd.
+func Default() Profile {
+	return Profile{
+		Name:                DefaultName,
+		DNS:                 "1.1.1.1",
+		Endpoint:            "192.168.100.9:51820",
+		AllowedIPs:          "0.0.0.0/0, ::/0",
+		PersistentKeepalive: 25,
+	}
+}
+
+func profileKey(name string) string {
+	return profilePrefix + name
+}
+
+// Get returns the named profile. An empty name selects the default profile.
+func Get(ctx context.Context, cli *clientv3.Client, name string) (*Profile, error) {
+	if name == "" {
+		name = DefaultName
+	}
+	if cli == nil {
+		if name == DefaultName {
+			profile := Default()
+			return &profile, nil
+		}
+		return nil, ErrNotFound
+	}
+
+	resp, err := cli.Get(ctx, profileKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		if name == DefaultName {
+			profile := Default()
+			return &profile, nil
+		}
+		return nil, ErrNotFound
+	}
+
+	var profile Profile
+	if err := json.Unmarshal(resp.Kvs[0].Value, &profile); err != nil {
+		return nil, fmt.Errorf("corrupt profile %s: %w", name, err)
+	}
+	return &profile, nil
+}
+
+// List returns every stored profile plus the built-in default if it was not
+// overridden.
+func List(ctx context.Context, cli *clientv3.Client) ([]Profile, error) {
+	if cli == nil {
+		return []Profile{Default()}, nil
+	}
+	resp, err := cli.Get(ctx, profilePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Profile, 0, len(resp.Kvs)+1)
+	hasDefault := false
+	for _, kv := range resp.Kvs {
+		var profile Profile
+		if err := json.Unmarshal(kv.Value, &profile); err != nil {
+			continue
+		}
+		hasDefault = hasDefault || profile.Name == DefaultName
+		list = append(list, profile)
+	}
+	if !hasDefault {
+		list = append(list, Default())
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func Put(ctx context.Context, cli *clientv3.Client, profile Profile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	if cli == nil {
+		return ErrReadOnly
+	}
+	value, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	_, err = cli.Put(ctx, profileKey(profile.Name), string(value))
+	return err
+}
+
+// Delete removes a stored profile. Deleting "default" restores the built-in
+// default.
+func Delete(ctx context.Context, cli *clientv3.Client, name string) error {
+	if cli == nil {
+		return ErrReadOnly
+	}
+	resp, err := cli.Delete(ctx, profileKey(name))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type loginFailures struct {
+	Failures    int   `json:"failures"`
+	LockedUntil int64 `json:"locked_until"`
+}
+
+// loginKey tracks the failures of one username from one IP. Keying on the
+// username alone would let anybody lock its owner out.
+func loginKey(ip, username string) string {
+	return keyPrefix + "login/pair/" + url.PathEscape(ip) + "/" + url.PathEscape(username)
+}
+
+// loginIPKey tracks every failure from ip.
+func loginIPKey(ip string) string {
+	return keyPrefix + "login/ip/" + url.PathEscape(ip)
+}
+
+// loginLimits returns the failure counters of an attempt and the failures
+// each allows before locking.
+func (l *Limiter) loginLimits(ip, username string) map[string]int {
+	limits := map[string]int{loginKey(ip, username): l.cfg.LoginMaxFailures}
+	if l.cfg.LoginIPMaxFailures > 0 {
+		limits[loginIPKey(ip)] = l.cfg.LoginIPMaxFailures
+	}
+	return limits
+}
+
+// LoginLocked returns how long logins for username from ip stay locked.
+func (l *Limiter) LoginLocked(ctx context.Context, ip, username string) (time.Duration, error) {
+	if l == nil || l.cfg.LoginMaxFailures <= 0 {
+		return 0, nil
+	}
+
+	var remaining time.Duration
+	for key := range l.loginLimits(ip, username) {
+		state, _, _, err := l.loadFailures(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if left := time.Until(time.Unix(state.LockedUntil, 0)); left > remaining {
+			remaining = left
+		}
+	}
+	return remaining, nil
+}
+
+// LoginFailed records a failed attempt for username from ip, and for ip. Once
+// a counter reaches its limit every further failure doubles the lockout, up
+// to LoginLockoutMax.
+func (l *Limiter) LoginFailed(ctx context.Context, ip, username string) (time.Duration, error) {
+	if l == nil || l.cfg.LoginMaxFailures <= 0 {
+		return 0, nil
+	}
+
+	var lockout time.Duration
+	for key, maxFailures := range l.loginLimits(ip, username) {
+		d, err := l.recordFailure(ctx, key, maxFailures)
+		if err != nil {
+			return 0, err
+		}
+		if d > lockout {
+			lockout = d
+		}
+	}
+	return lockout, nil
+}
+
+// LoginSucceeded clears the failures of username from ip. The failures of ip
+// are kept, or one valid account would reset a spraying client.
+func (l *Limiter) LoginSucceeded(ctx context.Context, ip, username string) error {
+	if l == nil || l.cfg.LoginMaxFailures <= 0 {
+		return nil
+	}
+	_, err := l.cli.Delete(ctx, loginKey(ip, username))
+	return err
+}
+
+// loadFailures returns the failures recorded under key, with the revision and
+// the lease of the record.
+func (l *Limiter) loadFailures(ctx context.Context, key string) (loginFailures, int64, clientv3.LeaseID, error) {
+	var state loginFailures
+	resp, err := l.cli.Get(ctx, key)
+	if err != nil {
+		return state, 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return state, 0, 0, nil
+	}
+	kv := resp.Kvs[0]
+	if err := json.Unmarshal(kv.Value, &state); err != nil {
+		return loginFailures{}, kv.ModRevision, clientv3.LeaseID(kv.Lease), nil
+	}
+	return state, kv.ModRevision, clientv3.LeaseID(kv.Lease), nil
+}
+
+func (l *Limiter) recordFailure(ctx context.Context, key string, maxFailures int) (time.Duration, error) {
+	for attempt := 0; attempt < maxTxnRetries; attempt++ {
+		state, modRevision, prevLease, err := l.loadFailures(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		state.Failures++
+		var lockout time.Duration
+		if over := state.Failures - maxFailures; over >= 0 {
+			lockout = l.cfg.LoginLockoutMax
+			if over < 32 {
+				if d := l.cfg.LoginLockoutBase << over; d > 0 && d < lockout {
+					lockout = d
+				}
+			}
+			state.LockedUntil = time.Now().Add(lockout).Unix()
+		}
+
+		value, err := json.Marshal(state)
+		if err != nil {
+			return 0, err
+		}
+
+		// The record outlives the lockout so repeated offenders keep
+		// escalating. Its TTL grows, so it moves to a new lease and the
+		// previous one is revoked.
+		ttl := l.cfg.LoginFailureTTL
+		if lockout > ttl {
+			ttl = lockout
+		}
+		lease, err := l.cli.Grant(ctx, int64(ttl.Seconds()))
+		if err != nil {
+			return 0, err
+		}
+
+		txnResp, err := l.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(clientv3.OpPut(key, string(value), clientv3.WithLease(lease.ID))).
+			Commit()
+		if err == nil && txnResp.Succeeded {
+			l.revokeLease(ctx, prevLease)
+			return lockout, nil
+		}
+		l.revokeLease(ctx, lease.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("too much contention on %s", key)
+}
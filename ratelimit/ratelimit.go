@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	keyPrefix     = "/ratelimit/"
+	maxTxnRetries = 5
+)
+
+// Config holds the limits. A limit of zero disables that check.
+type Config struct {
+	IPPerMinute      int
+	UserPerMinute    int
+	EnrollPerDay     int
+	LoginMaxFailures int
+	// LoginIPMaxFailures applies to all failures from one IP, whatever the
+	// username, which catches password spraying.
+	LoginIPMaxFailures int
+	LoginLockoutBase   time.Duration
+	LoginLockoutMax    time.Duration
+	LoginFailureTTL    time.Duration
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	return Config{
+		IPPerMinute:        s.Int("RATE_LIMIT_IP_PER_MINUTE", 120),
+		UserPerMinute:      s.Int("RATE_LIMIT_USER_PER_MINUTE", 60),
+		EnrollPerDay:       s.Int("ENROLL_QUOTA_PER_DAY", 100),
+		LoginMaxFailures:   s.Int("LOGIN_MAX_FAILURES", 5),
+		LoginIPMaxFailures: s.Int("LOGIN_IP_MAX_FAILURES", 20),
+		LoginLockoutBase:   s.Duration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+		LoginLockoutMax:    s.Duration("LOGIN_LOCKOUT_MAX", 15*time.Minute),
+		LoginFailureTTL:    s.Duration("LOGIN_FAILURE_TTL", time.Hour),
+	}
+}
+
+// Limiter keeps its counters in etcd so every replica enforces the same
+// limits. When etcd cannot be reached requests are let through rather than
+// locking everybody out.
+type Limiter struct {
+	cli *clientv3.Client
+	cfg Config
+}
+
+var limiter *Limiter
+
+func Init(cli *clientv3.Client, cfg Config) *Limiter {
+	limiter = &Limiter{cli: cli, cfg: cfg}
+	return limiter
+}
+
+// Get returns the limiter set up by Init. A nil limiter allows everything.
+func Get() *Limiter {
+	return limiter
+}
+
+// allow counts one hit against key in the current fixed window and reports
+// whether the hit is within limit. When it is not, the time until the window
+// resets is returned.
+func (l *Limiter) allow(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	if l == nil || limit <= 0 {
+		return true, 0, nil
+	}
+
+	now := time.Now().UTC()
+	windowStart := now.Truncate(window)
+	retryAfter := windowStart.Add(window).Sub(now)
+	counterKey := fmt.Sprintf("%s%s/%d", keyPrefix, key, windowStart.Unix())
+
+	for attempt := 0; attempt < maxTxnRetries; attempt++ {
+		resp, err := l.cli.Get(ctx, counterKey)
+		if err != nil {
+			return true, 0, err
+		}
+
+		if len(resp.Kvs) == 0 {
+			lease, err := l.cli.Grant(ctx, int64(window.Seconds())+1)
+			if err != nil {
+				return true, 0, err
+			}
+			txnResp, err := l.cli.Txn(ctx).
+				If(clientv3.Compare(clientv3.CreateRevision(counterKey), "=", 0)).
+				Then(clientv3.OpPut(counterKey, "1", clientv3.WithLease(lease.ID))).
+				Commit()
+			if err == nil && txnResp.Succeeded {
+				return true, 0, nil
+			}
+			// Another request created the counter with its own lease
+			l.revokeLease(ctx, lease.ID)
+			if err != nil {
+				return true, 0, err
+			}
+			continue
+		}
+
+		kv := resp.Kvs[0]
+		count, _ := strconv.Atoi(string(kv.Value))
+		if count >= limit {
+			return false, retryAfter, nil
+		}
+
+		txnResp, err := l.cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(counterKey), "=", kv.ModRevision)).
+			Then(clientv3.OpPut(counterKey, strconv.Itoa(count+1), clientv3.WithIgnoreLease())).
+			Commit()
+		if err != nil {
+			return true, 0, err
+		}
+		if txnResp.Succeeded {
+			return true, 0, nil
+		}
+	}
+
+	return true, 0, fmt.Errorf("too much contention on %s", counterKey)
+}
+
+// revokeLease drops a lease that is no longer attached to anything, rather
+// than leaving it in etcd until it expires.
+func (l *Limiter) revokeLease(ctx context.Context, id clientv3.LeaseID) {
+	if id == clientv3.NoLease {
+		return
+	}
+	if _, err := l.cli.Revoke(context.WithoutCancel(ctx), id); err != nil {
+		slog.WarnContext(ctx, "Failed to revoke rate limit lease", "error", err)
+	}
+}
+
+func (l *Limiter) limit(c *gin.Context, key string, limit int, window time.Duration, message string) {
+	allowed, retryAfter, err := l.allow(c.Request.Context(), key, limit, window)
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "Rate limit check failed, allowing request", "key", key, "error", err)
+	}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": message})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// PerIP limits requests per client IP per minute.
+func (l *Limiter) PerIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			c.Next()
+			return
+		}
+		l.limit(c, "ip/"+c.ClientIP(), l.cfg.IPPerMinute, time.Minute, "Too many requests")
+	}
+}
+
+// PerUser limits requests per authenticated user per minute. It must run
+// after the middleware that sets the username.
+func (l *Limiter) PerUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, _ := c.Get("username")
+		if l == nil || username == nil {
+			c.Next()
+			return
+		}
+		l.limit(c, fmt.Sprintf("user/%v", username), l.cfg.UserPerMinute, time.Minute, "Too many requests")
+	}
+}
+
+// EnrollQuota limits how many peers a user can enroll per UTC day.
+func (l *Limiter) EnrollQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, _ := c.Get("username")
+		if l == nil || username == nil {
+			c.Next()
+			return
+		}
+		l.limit(c, fmt.Sprintf("enroll/%v", username), l.cfg.EnrollPerDay, 24*time.Hour, "Daily enrollment quota exceeded")
+	}
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zacky3181V/wireable/internal/etcdtest"
+)
+
+func newLimiter(t *testing.T, cfg Config) *Limiter {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts an etcd server")
+	}
+	return &Limiter{cli: etcdtest.New(t), cfg: cfg}
+}
+
+// leaseCount returns how many leases etcd holds, to catch leaked ones.
+func leaseCount(t *testing.T, l *Limiter) int {
+	t.Helper()
+	resp, err := l.cli.Leases(context.Background())
+	if err != nil {
+		t.Fatalf("Leases: %v", err)
+	}
+	return len(resp.Leases)
+}
+
+func TestAllowDisabled(t *testing.T) {
+	var nilLimiter *Limiter
+	if ok, _, err := nilLimiter.allow(context.Background(), "ip/a", 1, time.Minute); !ok || err != nil {
+		t.Fatalf("allow on a nil limiter = %v, %v, want true", ok, err)
+	}
+	// A limit of zero never reaches etcd
+	l := &Limiter{}
+	if ok, _, err := l.allow(context.Background(), "ip/a", 0, time.Minute); !ok || err != nil {
+		t.Fatalf("allow with no limit = %v, %v, want true", ok, err)
+	}
+}
+
+func TestAllowWindowLimit(t *testing.T) {
+	const limit = 3
+	// A day long window, so the test does not straddle two windows
+	const window = 24 * time.Hour
+	l := newLimiter(t, Config{})
+	ctx := context.Background()
+
+	for i := 0; i < limit; i++ {
+		if ok, _, err := l.allow(ctx, "ip/a", limit, window); !ok || err != nil {
+			t.Fatalf("hit %d = %v, %v, want allowed", i+1, ok, err)
+		}
+	}
+	ok, retryAfter, err := l.allow(ctx, "ip/a", limit, window)
+	if ok || err != nil {
+		t.Fatalf("hit %d = %v, %v, want denied", limit+1, ok, err)
+	}
+	if retryAfter <= 0 || retryAfter > window {
+		t.Fatalf("retry after = %v, want within the window of %v", retryAfter, window)
+	}
+	// Other keys are counted on their own
+	if ok, _, err := l.allow(ctx, "ip/b", limit, window); !ok || err != nil {
+		t.Fatalf("hit for another key = %v, %v, want allowed", ok, err)
+	}
+	if got, want := leaseCount(t, l), 2; got != want {
+		t.Fatalf("%d leases, want %d, one per counter", got, want)
+	}
+}
+
+func TestAllowConcurrentHits(t *testing.T) {
+	const limit, racers = 3, 5
+	l := newLimiter(t, Config{})
+	ctx := context.Background()
+
+	allowed := make([]bool, racers)
+	errs := make([]error, racers)
+	var wg sync.WaitGroup
+	for i := range racers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allowed[i], _, errs[i] = l.allow(ctx, "user/alice", limit, 24*time.Hour)
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	for i := range racers {
+		if errs[i] != nil {
+			t.Fatalf("hit %d: %v", i, errs[i])
+		}
+		if allowed[i] {
+			count++
+		}
+	}
+	if count != limit {
+		t.Fatalf("%d hits allowed, want %d", count, limit)
+	}
+	// The leases of the hits that lost the race to create the counter are
+	// revoked
+	if got := leaseCount(t, l); got != 1 {
+		t.Fatalf("%d leases, want 1", got)
+	}
+}
+
+// assertLocked checks that logins of username from ip are locked for about
+// want. Lockouts are kept in whole seconds.
+func assertLocked(t *testing.T, l *Limiter, ip, username string, want time.Duration) {
+	t.Helper()
+	got, err := l.LoginLocked(context.Background(), ip, username)
+	if err != nil {
+		t.Fatalf("LoginLocked(%s, %s): %v", ip, username, err)
+	}
+	if got > want || got < want-2*time.Second {
+		t.Fatalf("LoginLocked(%s, %s) = %v, want about %v", ip, username, got, want)
+	}
+}
+
+func TestLoginLockoutEscalates(t *testing.T) {
+	l := newLimiter(t, Config{
+		LoginMaxFailures: 3,
+		LoginLockoutBase: 30 * time.Second,
+		LoginLockoutMax:  2 * time.Minute,
+		LoginFailureTTL:  time.Hour,
+	})
+	ctx := context.Background()
+
+	// The lockout starts at the limit and doubles up to the maximum
+	wants := []time.Duration{0, 0, 30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute}
+	for i, want := range wants {
+		lockout, err := l.LoginFailed(ctx, "192.0.2.1", "alice")
+		if err != nil {
+			t.Fatalf("failure %d: %v", i+1, err)
+		}
+		if lockout != want {
+			t.Fatalf("lockout after failure %d = %v, want %v", i+1, lockout, want)
+		}
+		assertLocked(t, l, "192.0.2.1", "alice", want)
+	}
+	// Every failure moves the record to a new lease and revokes the old one
+	if got := leaseCount(t, l); got != 1 {
+		t.Fatalf("%d leases, want 1", got)
+	}
+
+	// Neither another IP nor another user is locked out
+	assertLocked(t, l, "192.0.2.2", "alice", 0)
+	assertLocked(t, l, "192.0.2.1", "bob", 0)
+
+	if err := l.LoginSucceeded(ctx, "192.0.2.1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	assertLocked(t, l, "192.0.2.1", "alice", 0)
+	if lockout, err := l.LoginFailed(ctx, "192.0.2.1", "alice"); err != nil || lockout != 0 {
+		t.Fatalf("lockout after a success and a failure = %v, %v, want none", lockout, err)
+	}
+}
+
+func TestLoginIPLimit(t *testing.T) {
+	l := newLimiter(t, Config{
+		LoginMaxFailures:   10,
+		LoginIPMaxFailures: 3,
+		LoginLockoutBase:   30 * time.Second,
+		LoginLockoutMax:    time.Hour,
+		LoginFailureTTL:    time.Hour,
+	})
+	ctx := context.Background()
+
+	// A client spraying one password over many users
+	for i, username := range []string{"alice", "bob", "carol"} {
+		lockout, err := l.LoginFailed(ctx, "192.0.2.1", username)
+		if err != nil {
+			t.Fatalf("failure %d: %v", i+1, err)
+		}
+		var want time.Duration
+		if i == 2 {
+			want = 30 * time.Second
+		}
+		if lockout != want {
+			t.Fatalf("lockout after failure %d = %v, want %v", i+1, lockout, want)
+		}
+	}
+	assertLocked(t, l, "192.0.2.1", "dave", 30*time.Second)
+	assertLocked(t, l, "192.0.2.2", "alice", 0)
+
+	// A valid account does not reset the IP
+	if err := l.LoginSucceeded(ctx, "192.0.2.1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	assertLocked(t, l, "192.0.2.1", "alice", 30*time.Second)
+}
@@ -0,0 +1,285 @@
+// Package settings reads configuration from, in increasing priority, the
+// defaults of each setting, a YAML config file, the environment (including
+// .env) and command-line flags.
+//
+// Every setting has a single name: POOL_SEED_CIDR in the environment,
+// pool_seed_cidr in the config file and --pool-seed-cidr on the command line.
+// Secrets can only come from the environment.
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the config file when --config is not given.
+const ConfigFileEnv = "WIREABLE_CONFIG"
+
+// secretKeys are never read from the config file or flags, which tend to end
+// up in version control and process listings.
+var secretKeys = []string{"VAULT_TOKEN", "VAULT_SECRET_ID", "METRICS_TOKEN", "WIREABLE_PASSWORD", "EVENT_WEBHOOK_SECRET", "AUDIT_HMAC_KEY"}
+
+// Source looks up settings and collects every invalid value, so startup can
+// report them all at once.
+type Source struct {
+	file      map[string]string
+	flags     map[string]string
+	lookupEnv func(string) (string, bool)
+	used      map[string]bool
+	errs      []error
+}
+
+// Load parses args, loads .env when it exists and reads the config file named
+// by --config or WIREABLE_CONFIG.
+func Load(args []string) (*Source, error) {
+	s := FromEnv()
+	path, flags, err := parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+	s.flags = flags
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	if path == "" {
+		path = os.Getenv(ConfigFileEnv)
+	}
+	if path != "" {
+		if s.file, err = readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range secretKeys {
+		if _, ok := s.file[key]; ok {
+			return nil, fmt.Errorf("%s is a secret and can only be set in the environment", key)
+		}
+		if _, ok := s.flags[key]; ok {
+			return nil, fmt.Errorf("%s is a secret and can only be set in the environment", key)
+		}
+	}
+	return s, nil
+}
+
+// FromEnv returns a source that only reads the environment.
+func FromEnv() *Source {
+	return &Source{lookupEnv: os.LookupEnv, used: make(map[string]bool)}
+}
+
+// parseFlags accepts --name=value, --name value and --name alone for true.
+// A value starting with "-" has to be given as --name=value.
+func parseFlags(args []string) (string, map[string]string, error) {
+	var path string
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			return "", nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !hasValue {
+			value = "true"
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				value = args[i+1]
+				i++
+			}
+		}
+		if name == "config" {
+			path = value
+			continue
+		}
+		flags[keyOf(name)] = value
+	}
+	return path, flags, nil
+}
+
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+			values[keyOf(name)] = ""
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[keyOf(name)] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config file %s: %s must be a value or a list", path, name)
+		default:
+			values[keyOf(name)] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func keyOf(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// lookup returns the value of key from the flags, the environment or the
+// config file, in that order, and where it came from.
+func (s *Source) lookup(key string) (string, string, bool) {
+	s.used[key] = true
+	if v, ok := s.flags[key]; ok {
+		return v, "flag", true
+	}
+	if v, ok := s.lookupEnv(key); ok && v != "" {
+		return v, "environment", true
+	}
+	if v, ok := s.file[key]; ok {
+		return v, "config file", true
+	}
+	return "", "", false
+}
+
+// Invalid records that the value of key cannot be used.
+func (s *Source) Invalid(key, value string, err error) {
+	s.errs = append(s.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+}
+
+// Fail records an error that involves more than one setting.
+func (s *Source) Fail(err error) {
+	s.errs = append(s.errs, err)
+}
+
+// Secret is the value of a secret setting. It is printed redacted, so a
+// config holding it can be logged.
+type Secret string
+
+func (Secret) String() string {
+	return "<redacted>"
+}
+
+func (Secret) GoString() string {
+	return "<redacted>"
+}
+
+func (Secret) MarshalText() ([]byte, error) {
+	return []byte("<redacted>"), nil
+}
+
+// Reveal returns the value of the secret.
+func (v Secret) Reveal() string {
+	return string(v)
+}
+
+// Secret returns the value of key, which must be one of the secrets, from
+// the environment. It is empty when key is not set.
+func (s *Source) Secret(key string) Secret {
+	if !slices.Contains(secretKeys, key) {
+		s.Fail(fmt.Errorf("%s is not declared as a secret", key))
+		return ""
+	}
+	s.used[key] = true
+	v, _ := s.lookupEnv(key)
+	return Secret(v)
+}
+
+// String returns the value of key, or def when it is not set.
+func (s *Source) String(key, def string) string {
+	if v, _, ok := s.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// Bool accepts the values of strconv.ParseBool.
+func (s *Source) Bool(key string, def bool) bool {
+	v, from, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		s.Invalid(key, v, fmt.Errorf("%s: expected true or false", from))
+		return def
+	}
+	return b
+}
+
+func (s *Source) Int(key string, def int) int {
+	v, from, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		s.Invalid(key, v, fmt.Errorf("%s: expected an integer", from))
+		return def
+	}
+	return n
+}
+
+// Duration accepts the values of time.ParseDuration, e.g. 30s or 24h.
+func (s *Source) Duration(key string, def time.Duration) time.Duration {
+	v, from, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		s.Invalid(key, v, fmt.Errorf("%s: expected a duration such as 30s", from))
+		return def
+	}
+	return d
+}
+
+// List splits a comma separated value, dropping empty entries.
+func (s *Source) List(key string) []string {
+	v, _, _ := s.lookup(key)
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ValueErr reports every invalid value. Tools that read only part of the
+// server's configuration use it instead of Err.
+func (s *Source) ValueErr() error {
+	return errors.Join(s.errs...)
+}
+
+// Err reports every invalid value, and every setting in the config file or
+// flags that nothing read, which is most likely a typo.
+func (s *Source) Err() error {
+	errs := slices.Clone(s.errs)
+	var unknown []string
+	for _, layer := range []map[string]string{s.flags, s.file} {
+		for key := range layer {
+			if !s.used[key] && !slices.Contains(unknown, key) {
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("unknown setting %s", key))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Zacky3181V/wireable/config"
+	"github.com/Zacky3181V/wireable/health"
+	"github.com/Zacky3181V/wireable/vaultclient"
+)
+
+// workers runs the background loops of the service on a context of their
+// own, so they keep running while requests drain and are stopped after that.
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+func (w *workers) Go(run func(context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx)
+	}()
+}
+
+// Stop cancels the workers and waits until they return or ctx is done.
+func (w *workers) Stop(ctx context.Context) error {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops accepting requests and waits for the in-flight ones, such as
+// allocations in /generate, to finish. Only then are the workers stopped and
+// the clients closed, so no request loses its store halfway. Telemetry is
+// flushed last to export everything logged on the way. All of it shares
+// timeout.
+func shutdown(srv *http.Server, bg *workers, server *config.Server, shutdownTelemetry func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	slog.Info("Shutting down", "timeout", timeout)
+	health.SetShuttingDown()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Requests did not finish in time", "error", err)
+	}
+	if err := bg.Stop(ctx); err != nil {
+		slog.Error("Background workers did not stop in time", "error", err)
+	}
+	if err := vaultclient.Close(ctx); err != nil {
+		slog.Error("Failed to close the Vault client", "error", err)
+	}
+	if err := server.Close(); err != nil {
+		slog.Error("Failed to close the pool store", "error", err)
+	}
+	slog.Info("Shutdown complete")
+	if err := shutdownTelemetry(ctx); err != nil {
+		slog.Error("Failed to flush telemetry", "error", err)
+	}
+}
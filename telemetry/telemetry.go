@@ -0,0 +1,186 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// Config selects where traces, metrics and logs are exported. Nothing is
+// exported unless Enabled is set; Prometheus readers passed to Init work
+// either way.
+type Config struct {
+	Enabled     bool
+	Exporter    string
+	ServiceName string
+	Endpoint    string
+	Insecure    bool
+}
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Enabled:     s.Bool("ENABLE_TRACING", false),
+		Exporter:    s.String("OTEL_EXPORTER", ExporterOTLP),
+		ServiceName: s.String("SERVICE_NAME", "wireable"),
+		Endpoint:    s.String("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		Insecure:    s.Bool("INSECURE_MODE", false),
+	}
+	if cfg.Exporter != ExporterOTLP && cfg.Exporter != ExporterStdout {
+		s.Invalid("OTEL_EXPORTER", cfg.Exporter, errors.New("expected otlp or stdout"))
+	}
+	return cfg
+}
+
+type exporters struct {
+	span   sdktrace.SpanExporter
+	metric sdkmetric.Exporter
+	log    sdklog.Exporter
+}
+
+func newExporters(ctx context.Context, cfg Config) (*exporters, error) {
+	switch cfg.Exporter {
+	case ExporterStdout:
+		span, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		metric, err := stdoutmetric.New()
+		if err != nil {
+			return nil, err
+		}
+		logs, err := stdoutlog.New()
+		if err != nil {
+			return nil, err
+		}
+		return &exporters{span: span, metric: metric, log: logs}, nil
+
+	case ExporterOTLP:
+		if cfg.ServiceName == "" {
+			return nil, errors.New("SERVICE_NAME is not set")
+		}
+		if cfg.Endpoint == "" {
+			return nil, errors.New("OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+		}
+
+		creds := credentials.NewClientTLSFromCert(nil, "")
+		traceSecurity := otlptracegrpc.WithTLSCredentials(creds)
+		metricSecurity := otlpmetricgrpc.WithTLSCredentials(creds)
+		logSecurity := otlploggrpc.WithTLSCredentials(creds)
+		if cfg.Insecure {
+			traceSecurity = otlptracegrpc.WithInsecure()
+			metricSecurity = otlpmetricgrpc.WithInsecure()
+			logSecurity = otlploggrpc.WithInsecure()
+		}
+
+		span, err := otlptracegrpc.New(ctx, traceSecurity, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		if err != nil {
+			return nil, err
+		}
+		metric, err := otlpmetricgrpc.New(ctx, metricSecurity, otlpmetricgrpc.WithEndpoint(cfg.Endpoint))
+		if err != nil {
+			return nil, err
+		}
+		logs, err := otlploggrpc.New(ctx, logSecurity, otlploggrpc.WithEndpoint(cfg.Endpoint))
+		if err != nil {
+			return nil, err
+		}
+		return &exporters{span: span, metric: metric, log: logs}, nil
+	}
+	return nil, fmt.Errorf("unknown OTEL_EXPORTER %q", cfg.Exporter)
+}
+
+var logHandler slog.Handler
+
+// Init installs the trace, meter and logger providers. readers are added to
+// the meter provider whether or not exporting is enabled. The returned
+// function flushes and shuts everything down.
+func Init(ctx context.Context, cfg Config, readers ...sdkmetric.Reader) (func(context.Context) error, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", cfg.ServiceName),
+			attribute.String("library.language", "go"),
+		),
+	)
+	if err != nil {
+		slog.Warn("Could not set resources", "error", err)
+	}
+
+	var shutdowns []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	var exp *exporters
+	if cfg.Enabled {
+		if exp, err = newExporters(ctx, cfg); err != nil {
+			return nil, err
+		}
+		readers = append(readers, sdkmetric.NewPeriodicReader(exp.metric))
+	}
+
+	if len(readers) > 0 {
+		opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+		for _, reader := range readers {
+			opts = append(opts, sdkmetric.WithReader(reader))
+		}
+		meterProvider := sdkmetric.NewMeterProvider(opts...)
+		otel.SetMeterProvider(meterProvider)
+		shutdowns = append(shutdowns, meterProvider.Shutdown)
+	}
+	if exp == nil {
+		return shutdown, nil
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(exp.span),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	shutdowns = append(shutdowns, tracerProvider.Shutdown)
+
+	loggerProvider := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exp.log)),
+		sdklog.WithResource(res),
+	)
+	global.SetLoggerProvider(loggerProvider)
+	shutdowns = append(shutdowns, loggerProvider.Shutdown)
+
+	logHandler = otelslog.NewHandler(cfg.ServiceName, otelslog.WithLoggerProvider(loggerProvider))
+	return shutdown, nil
+}
+
+// LogHandler returns the handler that exports slog records, or nil when
+// exporting is disabled.
+func LogHandler() slog.Handler {
+	return logHandler
+}
@@ -0,0 +1,119 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Zacky3181V/wireable/vaultclient"
+)
+
+type certMaterial struct {
+	certPEM     []byte
+	keyPEM      []byte
+	clientCAPEM []byte
+}
+
+// certSource returns new certificate material, or nil when the current
+// certificate is still up to date.
+type certSource interface {
+	load(ctx context.Context, current *tls.Certificate) (*certMaterial, error)
+}
+
+type fileSource struct {
+	cfg     Config
+	modTime time.Time
+}
+
+func (s *fileSource) load(_ context.Context, current *tls.Certificate) (*certMaterial, error) {
+	latest, err := latestModTime(s.cfg.CertFile, s.cfg.KeyFile, s.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && !latest.After(s.modTime) {
+		return nil, nil
+	}
+
+	certPEM, err := os.ReadFile(s.cfg.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(s.cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var caPEM []byte
+	if s.cfg.ClientCAFile != "" {
+		caPEM, err = os.ReadFile(s.cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.modTime = latest
+	return &certMaterial{certPEM: certPEM, keyPEM: keyPEM, clientCAPEM: caPEM}, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+type vaultSource struct {
+	cfg Config
+}
+
+func (s *vaultSource) load(ctx context.Context, current *tls.Certificate) (*certMaterial, error) {
+	// Renew once two thirds of the certificate lifetime have passed
+	if current != nil && current.Leaf != nil {
+		lifetime := current.Leaf.NotAfter.Sub(current.Leaf.NotBefore)
+		renewAt := current.Leaf.NotBefore.Add(lifetime * 2 / 3)
+		if time.Now().Before(renewAt) {
+			return nil, nil
+		}
+	}
+
+	vc, err := vaultclient.Client()
+	if err != nil {
+		return nil, err
+	}
+	issued, err := vaultclient.IssueCertificate(ctx, vc, s.cfg.VaultPKIMount, s.cfg.VaultPKIRole,
+		s.cfg.CommonName, s.cfg.AltNames, s.cfg.CertTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate from Vault PKI: %w", err)
+	}
+
+	certPEM := issued.Certificate
+	for _, ca := range issued.CAChain {
+		certPEM += "\n" + ca
+	}
+
+	caPEM := []byte(issued.IssuingCA)
+	if s.cfg.ClientCAFile != "" {
+		caPEM, err = os.ReadFile(s.cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &certMaterial{
+		certPEM:     []byte(strings.TrimSpace(certPEM)),
+		keyPEM:      []byte(issued.PrivateKey),
+		clientCAPEM: caPEM,
+	}, nil
+}
@@ -0,0 +1,219 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Zacky3181V/wireable/settings"
+)
+
+// Config describes how the HTTPS listener obtains its certificate and
+// whether clients must present one.
+type Config struct {
+	Enabled        bool
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	ClientAuth     string // none, request or require
+	IdentityField  string // cn, email, dns or uri
+	ReloadInterval time.Duration
+
+	// When VaultPKIMount is set the certificate is issued by Vault PKI
+	// instead of being read from CertFile/KeyFile.
+	VaultPKIMount string
+	VaultPKIRole  string
+	CommonName    string
+	AltNames      string
+	CertTTL       string
+}
+
+var identityField atomic.Value
+
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Enabled:        s.Bool("TLS_ENABLED", false),
+		CertFile:       s.String("TLS_CERT_FILE", ""),
+		KeyFile:        s.String("TLS_KEY_FILE", ""),
+		ClientCAFile:   s.String("TLS_CLIENT_CA_FILE", ""),
+		ClientAuth:     s.String("TLS_CLIENT_AUTH", "none"),
+		IdentityField:  s.String("TLS_IDENTITY_FIELD", "cn"),
+		ReloadInterval: s.Duration("TLS_RELOAD_INTERVAL", time.Minute),
+		VaultPKIMount:  s.String("TLS_VAULT_PKI_MOUNT", ""),
+		VaultPKIRole:   s.String("TLS_VAULT_PKI_ROLE", ""),
+		CommonName:     s.String("TLS_COMMON_NAME", ""),
+		AltNames:       s.String("TLS_ALT_NAMES", ""),
+		CertTTL:        s.String("TLS_CERT_TTL", ""),
+	}
+	if cfg.Enabled {
+		if err := cfg.validate(); err != nil {
+			s.Fail(err)
+		}
+	}
+	return cfg
+}
+
+func (cfg Config) validate() error {
+	switch cfg.ClientAuth {
+	case "none", "request", "require":
+	default:
+		return fmt.Errorf("invalid TLS client auth mode %q", cfg.ClientAuth)
+	}
+	switch cfg.IdentityField {
+	case "cn", "email", "dns", "uri":
+	default:
+		return fmt.Errorf("invalid TLS identity field %q", cfg.IdentityField)
+	}
+	if cfg.ReloadInterval <= 0 {
+		return fmt.Errorf("TLS_RELOAD_INTERVAL must be positive")
+	}
+
+	if cfg.VaultPKIMount != "" {
+		if cfg.VaultPKIRole == "" || cfg.CommonName == "" {
+			return fmt.Errorf("TLS_VAULT_PKI_ROLE and TLS_COMMON_NAME are required for Vault PKI certificates")
+		}
+	} else if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE are required when TLS is enabled")
+	}
+	if cfg.ClientAuth != "none" && cfg.ClientCAFile == "" && cfg.VaultPKIMount == "" {
+		return fmt.Errorf("TLS_CLIENT_CA_FILE is required to verify client certificates")
+	}
+	return nil
+}
+
+// Reloader keeps the serving certificate and client CA pool current and
+// hands them out to every new TLS handshake.
+type Reloader struct {
+	cfg       Config
+	source    certSource
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+func NewReloader(cfg Config) (*Reloader, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	var source certSource = &fileSource{cfg: cfg}
+	if cfg.VaultPKIMount != "" {
+		source = &vaultSource{cfg: cfg}
+	}
+
+	r := &Reloader{cfg: cfg, source: source}
+	if _, err := r.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	identityField.Store(cfg.IdentityField)
+	return r, nil
+}
+
+// Run re-checks the certificate source every ReloadInterval until ctx is done.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.reload(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to reload TLS certificate, keeping the current one", "error", err)
+				continue
+			}
+			if changed {
+				slog.InfoContext(ctx, "TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(ctx context.Context) (bool, error) {
+	material, err := r.source.load(ctx, r.cert.Load())
+	if err != nil || material == nil {
+		return false, err
+	}
+
+	cert, err := tls.X509KeyPair(material.certPEM, material.keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse TLS key pair: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false, fmt.Errorf("failed to parse TLS certificate: %w", err)
+		}
+	}
+
+	if len(material.clientCAPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(material.clientCAPEM) {
+			return false, fmt.Errorf("no valid certificates in client CA bundle")
+		}
+		r.clientCAs.Store(pool)
+	}
+	r.cert.Store(&cert)
+	return true, nil
+}
+
+// TLSConfig returns a server configuration that always serves the most
+// recently loaded certificate and client CA pool.
+func (r *Reloader) TLSConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch r.cfg.ClientAuth {
+	case "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert.Load()},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs.Load(),
+			}, nil
+		},
+	}
+}
+
+// ClientIdentity maps a verified client certificate to a user identity using
+// the configured TLS_IDENTITY_FIELD. Unverified connections have no identity.
+func ClientIdentity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := state.VerifiedChains[0][0]
+
+	field, _ := identityField.Load().(string)
+	var identity string
+	switch field {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	default:
+		identity = cert.Subject.CommonName
+	}
+
+	identity = strings.TrimSpace(identity)
+	return identity, identity != ""
+}
@@ -0,0 +1,259 @@
+package vaultclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const defaultK8sTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// SessionStatus describes the state of the Vault token used by the service.
+type SessionStatus struct {
+	Method        string     `json:"method"`
+	Authenticated bool       `json:"authenticated"`
+	Renewable     bool       `json:"renewable"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	LastRenewal   *time.Time `json:"last_renewal,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+var (
+	sessionMu  sync.RWMutex
+	session    SessionStatus
+	authSecret *api.Secret
+)
+
+// login authenticates vc with the configured method and returns the auth
+// secret, which is nil for a static token.
+func login(ctx context.Context, vc *api.Client) (*api.Secret, error) {
+	method := clientConfig.AuthMethod
+	mount := clientConfig.AuthMount
+	if mount == "" {
+		mount = method
+	}
+
+	var data map[string]interface{}
+	switch method {
+	case "token":
+		token := clientConfig.Token.Reveal()
+		if token == "" {
+			return nil, errors.New("VAULT_TOKEN is not set")
+		}
+		vc.SetToken(token)
+		return nil, nil
+	case "approle":
+		secretID := clientConfig.SecretID.Reveal()
+		if path := clientConfig.SecretIDFile; path != "" {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read VAULT_SECRET_ID_FILE: %w", err)
+			}
+			secretID = strings.TrimSpace(string(raw))
+		}
+		data = map[string]interface{}{
+			"role_id":   clientConfig.RoleID,
+			"secret_id": secretID,
+		}
+	case "kubernetes":
+		jwt, err := os.ReadFile(clientConfig.K8sTokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account token: %w", err)
+		}
+		data = map[string]interface{}{
+			"role": clientConfig.K8sRole,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported VAULT_AUTH_METHOD %q", method)
+	}
+
+	secret, err := vc.Logical().WriteWithContext(ctx, "auth/"+mount+"/login", data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("%s login returned no token", method)
+	}
+	vc.SetToken(secret.Auth.ClientToken)
+	return secret, nil
+}
+
+// authenticate logs in and records the result in the session status.
+func authenticate(ctx context.Context, vc *api.Client) error {
+	secret, err := login(ctx, vc)
+	if err != nil {
+		setSessionError(err)
+		return err
+	}
+
+	if secret == nil {
+		// Static token: find out whether it expires and can be renewed
+		secret, err = vc.Auth().Token().LookupSelfWithContext(ctx)
+		if err != nil {
+			setSessionError(err)
+			return err
+		}
+		ttl, _ := secret.TokenTTL()
+		renewable, _ := secret.TokenIsRenewable()
+		updateSession(ttl, renewable, false)
+		if renewable && ttl > 0 {
+			// The lifetime watcher needs the Auth block that a renewal returns
+			secret, err = vc.Auth().Token().RenewSelfWithContext(ctx, 0)
+			if err != nil {
+				setSessionError(err)
+				return err
+			}
+		} else {
+			secret = nil
+		}
+	} else {
+		updateSession(time.Duration(secret.Auth.LeaseDuration)*time.Second, secret.Auth.Renewable, false)
+	}
+
+	sessionMu.Lock()
+	authSecret = secret
+	sessionMu.Unlock()
+	return nil
+}
+
+// WatchToken keeps the Vault token alive until ctx is done. Renewable tokens
+// are renewed by a lifetime watcher. When a token can no longer be renewed
+// the client logs in again, which for a static token is not possible and
+// leaves the session unauthenticated.
+func WatchToken(ctx context.Context) {
+	vc, err := Client()
+	if err != nil {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		sessionMu.RLock()
+		secret := authSecret
+		sessionMu.RUnlock()
+
+		if secret != nil {
+			err = watchLifetime(ctx, vc, secret)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger.WarnContext(ctx, "Vault token renewal stopped", "error", err)
+			} else {
+				logger.InfoContext(ctx, "Vault token reached its maximum TTL")
+			}
+		} else if clientConfig.AuthMethod == "token" {
+			// Non renewable static token, nothing to watch
+			return
+		}
+
+		if clientConfig.AuthMethod == "token" {
+			setSessionError(errors.New("static Vault token can no longer be renewed"))
+			return
+		}
+
+		if err := authenticate(ctx, vc); err != nil {
+			logger.ErrorContext(ctx, "Vault login failed, retrying", "backoff", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		logger.InfoContext(ctx, "Logged in to Vault again")
+		backoff = time.Second
+	}
+}
+
+func watchLifetime(ctx context.Context, vc *api.Client, secret *api.Secret) error {
+	watcher, err := vc.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		return err
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.DoneCh():
+			return err
+		case renewal := <-watcher.RenewCh():
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				updateSession(time.Duration(renewal.Secret.Auth.LeaseDuration)*time.Second, renewal.Secret.Auth.Renewable, true)
+			}
+		}
+	}
+}
+
+func updateSession(ttl time.Duration, renewable, renewed bool) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	now := time.Now().UTC()
+	session.Method = clientConfig.AuthMethod
+	session.Authenticated = true
+	session.Renewable = renewable
+	session.LastError = ""
+	session.ExpiresAt = nil
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		session.ExpiresAt = &expires
+	}
+	if renewed {
+		session.LastRenewal = &now
+	}
+}
+
+func setSessionError(err error) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	session.Method = clientConfig.AuthMethod
+	session.Authenticated = false
+	session.LastError = err.Error()
+}
+
+// Session returns the current state of the Vault token. A token past its
+// expiry is reported as unauthenticated even before the watcher notices.
+func Session() SessionStatus {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+
+	status := session
+	if status.ExpiresAt != nil && time.Now().After(*status.ExpiresAt) {
+		status.Authenticated = false
+		if status.LastError == "" {
+			status.LastError = "token expired"
+		}
+	}
+	return status
+}
+
+// Close revokes a token obtained by logging in, so it does not outlive the
+// process, and drops the idle connections to Vault. A static token is left
+// alone since it is managed outside the service.
+func Close(ctx context.Context) error {
+	if client == nil {
+		return nil
+	}
+	defer client.CloneConfig().HttpClient.CloseIdleConnections()
+
+	if clientConfig.AuthMethod == "token" {
+		return nil
+	}
+	if err := client.Auth().Token().RevokeSelfWithContext(ctx, ""); err != nil {
+		return err
+	}
+	setSessionError(errors.New("token revoked on shutdown"))
+	return nil
+}
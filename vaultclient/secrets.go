@@ -0,0 +1,184 @@
+package vaultclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Zacky3181V/wireable/settings"
+	"github.com/hashicorp/vault/api"
+)
+
+// Secrets are the values Wireable reads from Vault KV.
+type Secrets struct {
+	JWTSecret string
+	Username  string
+	Password  string
+}
+
+// SecretPaths locates the secrets in Vault and controls how they are reloaded.
+type SecretPaths struct {
+	MountPath       string
+	JWTSecretPath   string
+	JWTSecretKey    string
+	CredsSecretPath string
+	UsernameKey     string
+	PasswordKey     string
+	RefreshInterval time.Duration
+	JWTGracePeriod  time.Duration
+}
+
+func SecretPathsFrom(s *settings.Source) SecretPaths {
+	paths := SecretPaths{
+		MountPath:       s.String("MOUNT_PATH", ""),
+		JWTSecretPath:   s.String("JWT_SECRET", ""),
+		JWTSecretKey:    s.String("JWT_SECRET_KEY", ""),
+		CredsSecretPath: s.String("CREDS_SECRET", ""),
+		UsernameKey:     s.String("USERNAME_SECRET_KEY", ""),
+		PasswordKey:     s.String("PASSWORD_SECRET_KEY", ""),
+		RefreshInterval: s.Duration("SECRETS_REFRESH_INTERVAL", time.Minute),
+		JWTGracePeriod:  s.Duration("JWT_SECRET_GRACE_PERIOD", time.Hour),
+	}
+	if paths.RefreshInterval <= 0 {
+		s.Invalid("SECRETS_REFRESH_INTERVAL", paths.RefreshInterval.String(), errors.New("must be positive"))
+	}
+	return paths
+}
+
+type secretsSnapshot struct {
+	current      Secrets
+	jwtVersion   int
+	credsVersion int
+
+	// The JWT secret that was replaced last, accepted until previousUntil
+	previousJWTSecret string
+	previousUntil     time.Time
+}
+
+var (
+	secretPaths SecretPaths
+	secrets     atomic.Pointer[secretsSnapshot]
+)
+
+// InitSecrets loads the secrets at p for the first time.
+func InitSecrets(p SecretPaths) error {
+	if p.MountPath == "" || p.JWTSecretPath == "" || p.JWTSecretKey == "" ||
+		p.CredsSecretPath == "" || p.UsernameKey == "" || p.PasswordKey == "" {
+		return logError("One or more required secret paths are empty")
+	}
+	secretPaths = p
+
+	_, err := reloadSecrets(context.Background())
+	return err
+}
+
+// CurrentSecrets returns the latest secrets read from Vault.
+func CurrentSecrets() Secrets {
+	snapshot := secrets.Load()
+	if snapshot == nil {
+		return Secrets{}
+	}
+	return snapshot.current
+}
+
+// JWTVerificationSecrets returns the secrets a HS256 token may be signed
+// with: the current one and, during the grace period after a rotation, the
+// previous one.
+func JWTVerificationSecrets() [][]byte {
+	snapshot := secrets.Load()
+	if snapshot == nil || snapshot.current.JWTSecret == "" {
+		return nil
+	}
+
+	keys := [][]byte{[]byte(snapshot.current.JWTSecret)}
+	if snapshot.previousJWTSecret != "" && time.Now().Before(snapshot.previousUntil) {
+		keys = append(keys, []byte(snapshot.previousJWTSecret))
+	}
+	return keys
+}
+
+// WatchSecrets polls the KV v2 versions of the secrets and swaps in new
+// values when a version changes.
+func WatchSecrets(ctx context.Context) {
+	ticker := time.NewTicker(secretPaths.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := reloadSecrets(ctx)
+			if err != nil {
+				logger.ErrorContext(ctx, "Failed to reload secrets, keeping the current ones", "error", err)
+				continue
+			}
+			if changed {
+				logger.InfoContext(ctx, "Secrets reloaded from Vault")
+			}
+		}
+	}
+}
+
+func reloadSecrets(ctx context.Context) (bool, error) {
+	vc, err := Client()
+	if err != nil {
+		return false, err
+	}
+	p := secretPaths
+	old := secrets.Load()
+
+	jwtData, jwtVersion, err := readVersioned(ctx, vc, p.MountPath, p.JWTSecretPath)
+	if err != nil {
+		return false, err
+	}
+	credsData, credsVersion, err := readVersioned(ctx, vc, p.MountPath, p.CredsSecretPath)
+	if err != nil {
+		return false, err
+	}
+	if old != nil && old.jwtVersion == jwtVersion && old.credsVersion == credsVersion {
+		return false, nil
+	}
+
+	next := &secretsSnapshot{jwtVersion: jwtVersion, credsVersion: credsVersion}
+	next.current.JWTSecret, _ = jwtData[p.JWTSecretKey].(string)
+	next.current.Username, _ = credsData[p.UsernameKey].(string)
+	next.current.Password, _ = credsData[p.PasswordKey].(string)
+	if next.current.JWTSecret == "" || next.current.Username == "" || next.current.Password == "" {
+		return false, logError("Failed to load one or more secrets from Vault")
+	}
+
+	if old != nil {
+		next.previousJWTSecret = old.previousJWTSecret
+		next.previousUntil = old.previousUntil
+		if old.current.JWTSecret != next.current.JWTSecret {
+			next.previousJWTSecret = old.current.JWTSecret
+			next.previousUntil = time.Now().Add(p.JWTGracePeriod)
+		}
+	}
+
+	secrets.Store(next)
+	return true, nil
+}
+
+func readVersioned(ctx context.Context, vc *api.Client, mountPath, secretName string) (map[string]interface{}, int, error) {
+	if vc == nil {
+		return nil, 0, logError("Vault client is nil")
+	}
+
+	ctx, span := startSpan(ctx, "vault.ReadSecret", mountPath+"/"+secretName)
+	defer span.End()
+
+	secret, err := vc.KVv2(mountPath).Get(ctx, secretName)
+	if err != nil {
+		return nil, 0, spanError(span, fmt.Errorf("error reading secret %s/%s: %w", mountPath, secretName, err))
+	}
+
+	version := 0
+	if secret.VersionMetadata != nil {
+		version = secret.VersionMetadata.Version
+	}
+	return secret.Data, version, nil
+}
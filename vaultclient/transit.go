@@ -0,0 +1,112 @@
+package vaultclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// TransitEncrypt encrypts plaintext with the latest version of a transit key.
+// The returned ciphertext has the form vault:v<version>:<base64>.
+func TransitEncrypt(ctx context.Context, vc *api.Client, mountPath, keyName string, plaintext []byte) (string, error) {
+	if vc == nil {
+		return "", logError("Vault client is nil")
+	}
+
+	secret, err := vc.Logical().WriteWithContext(ctx, mountPath+"/encrypt/"+keyName, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", logError("Empty response from Vault transit")
+	}
+	ciphertext, _ := secret.Data["ciphertext"].(string)
+	if ciphertext == "" {
+		return "", fmt.Errorf("transit returned no ciphertext")
+	}
+	return ciphertext, nil
+}
+
+// TransitDecrypt decrypts a batch of ciphertexts in a single request.
+func TransitDecrypt(ctx context.Context, vc *api.Client, mountPath, keyName string, ciphertexts []string) ([][]byte, error) {
+	results, err := transitBatch(ctx, vc, mountPath+"/decrypt/"+keyName, ciphertexts)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintexts := make([][]byte, len(results))
+	for i, result := range results {
+		encoded, _ := result["plaintext"].(string)
+		plaintexts[i], err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("transit returned invalid plaintext: %w", err)
+		}
+	}
+	return plaintexts, nil
+}
+
+// TransitRewrap re-encrypts a batch of ciphertexts with the latest version of
+// the key without exposing the plaintext.
+func TransitRewrap(ctx context.Context, vc *api.Client, mountPath, keyName string, ciphertexts []string) ([]string, error) {
+	results, err := transitBatch(ctx, vc, mountPath+"/rewrap/"+keyName, ciphertexts)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := make([]string, len(results))
+	for i, result := range results {
+		rewrapped[i], _ = result["ciphertext"].(string)
+		if rewrapped[i] == "" {
+			return nil, fmt.Errorf("transit returned no ciphertext")
+		}
+	}
+	return rewrapped, nil
+}
+
+func transitBatch(ctx context.Context, vc *api.Client, path string, ciphertexts []string) ([]map[string]interface{}, error) {
+	if vc == nil {
+		return nil, logError("Vault client is nil")
+	}
+	if len(ciphertexts) == 0 {
+		return nil, nil
+	}
+
+	ctx, span := startSpan(ctx, "vault.TransitBatch", path)
+	defer span.End()
+	span.SetAttributes(attribute.Int("vault.batch_size", len(ciphertexts)))
+
+	batch := make([]map[string]interface{}, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		batch[i] = map[string]interface{}{"ciphertext": ciphertext}
+	}
+
+	secret, err := vc.Logical().WriteWithContext(ctx, path, map[string]interface{}{"batch_input": batch})
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, logError("Empty response from Vault transit")
+	}
+
+	raw, _ := secret.Data["batch_results"].([]interface{})
+	if len(raw) != len(ciphertexts) {
+		return nil, fmt.Errorf("transit returned %d results for %d inputs", len(raw), len(ciphertexts))
+	}
+	results := make([]map[string]interface{}, len(raw))
+	for i, item := range raw {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected transit batch result")
+		}
+		if msg, _ := result["error"].(string); msg != "" {
+			return nil, fmt.Errorf("transit batch item %d: %s", i, msg)
+		}
+		results[i] = result
+	}
+	return results, nil
+}
@@ -2,43 +2,108 @@ package vaultclient
 
 import (
 	"context"
-	"log"
-	"os"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/Zacky3181V/wireable/settings"
 	"github.com/hashicorp/vault/api"
 )
 
-var (
-	client     *api.Client
-	clientOnce sync.Once
+// Config selects the Vault server and how the service logs in to it.
+type Config struct {
+	Endpoint     string
+	AuthMethod   string
+	AuthMount    string
+	Token        settings.Secret
+	RoleID       string
+	SecretID     settings.Secret
+	SecretIDFile string
+	K8sTokenPath string
+	K8sRole      string
+}
 
-	JWTSecret string
-	Username  string
-	Password  string
+func ConfigFrom(s *settings.Source) Config {
+	cfg := Config{
+		Endpoint:     s.String("VAULT_ENDPOINT", ""),
+		AuthMethod:   s.String("VAULT_AUTH_METHOD", "token"),
+		AuthMount:    s.String("VAULT_AUTH_MOUNT", ""),
+		Token:        s.Secret("VAULT_TOKEN"),
+		RoleID:       s.String("VAULT_ROLE_ID", ""),
+		SecretID:     s.Secret("VAULT_SECRET_ID"),
+		SecretIDFile: s.String("VAULT_SECRET_ID_FILE", ""),
+		K8sTokenPath: s.String("VAULT_K8S_TOKEN_PATH", defaultK8sTokenPath),
+		K8sRole:      s.String("VAULT_K8S_ROLE", ""),
+	}
+	switch cfg.AuthMethod {
+	case "token":
+	case "approle":
+		if cfg.RoleID == "" {
+			s.Fail(errors.New("VAULT_ROLE_ID is required with VAULT_AUTH_METHOD=approle"))
+		}
+	case "kubernetes":
+		if cfg.K8sRole == "" {
+			s.Fail(errors.New("VAULT_K8S_ROLE is required with VAULT_AUTH_METHOD=kubernetes"))
+		}
+	default:
+		s.Invalid("VAULT_AUTH_METHOD", cfg.AuthMethod, errors.New("expected token, approle or kubernetes"))
+	}
+	return cfg
+}
 
-	secretsOnce sync.Once
+var (
+	clientConfig Config
+	client       *api.Client
+	// clientMu serializes InitClient, so a failed login can be retried.
+	clientMu sync.Mutex
 )
 
-func InitClient() (*api.Client, error) {
-	var err error
-	clientOnce.Do(func() {
-		config := &api.Config{
-			Address: os.Getenv("VAULT_ENDPOINT"),
-		}
-		client, err = api.NewClient(config)
-		if err != nil {
-			log.Printf("Error initializing Vault client: %v", err)
-			return
-		}
-		client.SetToken(os.Getenv("VAULT_TOKEN"))
-	})
-	return client, err
+// InitClient logs in to Vault as configured by cfg once and returns the
+// client. After a failure the next call tries again. cfg is kept for logging
+// in again when the token expires.
+func InitClient(cfg Config) (*api.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	clientConfig = cfg
+	return connect()
+}
+
+// Client returns the client, logging in with the configuration given to
+// InitClient if that has not succeeded yet.
+func Client() (*api.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return connect()
+}
+
+// connect must be called with clientMu held.
+func connect() (*api.Client, error) {
+	if client != nil {
+		return client, nil
+	}
+
+	config := &api.Config{
+		Address: clientConfig.Endpoint,
+	}
+	vc, err := api.NewClient(config)
+	if err != nil {
+		logger.Error("Error initializing Vault client", "error", err)
+		return nil, err
+	}
+	if err := authenticate(context.Background(), vc); err != nil {
+		logger.Error("Error authenticating to Vault", "method", clientConfig.AuthMethod, "error", err)
+		return nil, err
+	}
+	client = vc
+	return client, nil
 }
 
 func GetClient() *api.Client {
 	if client == nil {
-		log.Fatal("Vault client not initialized. Call InitClient first.")
+		logger.Error("Vault client not initialized. Call InitClient first.")
 		return nil
 	}
 	return client
@@ -47,7 +112,7 @@ func GetClient() *api.Client {
 func ProcessSecret(vc *api.Client, mountPath string, secretName string, key string) string {
 	
 	if vc == nil {
-        log.Println("Vault client is nil")
+        logger.Error("Vault client is nil")
         return ""
     }
 
@@ -56,7 +121,7 @@ func ProcessSecret(vc *api.Client, mountPath string, secretName string, key stri
 	secret, err := vc.KVv2(mountPath).Get(ctx, secretName)
 
 	if err!=nil{
-		log.Printf("Error reading secret %s/%s: %v", mountPath, secretName, err)
+		logger.Error("Error reading secret", "mount", mountPath, "secret", secretName, "error", err)
 		return ""
 	}
 	
@@ -64,51 +129,17 @@ func ProcessSecret(vc *api.Client, mountPath string, secretName string, key stri
         if strVal, ok := val.(string); ok {
             return strVal
         } else {
-            log.Printf("Value for key '%s' is not a string", key)
+            logger.Warn("Secret value is not a string", "key", key)
         }
     } else {
-        log.Printf("Key '%s' not found in secret data", key)
+        logger.Warn("Key not found in secret data", "key", key)
     }
 
     return ""
 }
 
-func InitSecrets() error {
-	var err error
-	secretsOnce.Do(func() {
-		vc, e := InitClient()
-		if e != nil {
-			err = e
-			return
-		}
-
-		mountPath := os.Getenv("MOUNT_PATH")
-		jwtSecretPath := os.Getenv("JWT_SECRET")
-		jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-		credsSecretPath := os.Getenv("CREDS_SECRET")
-		usernameKey := os.Getenv("USERNAME_SECRET_KEY")
-		passwordKey := os.Getenv("PASSWORD_SECRET_KEY")
-
-		if mountPath == "" || jwtSecretPath == "" || jwtSecretKey == "" ||
-			credsSecretPath == "" || usernameKey == "" || passwordKey == "" {
-			err =  logError("One or more required environment variables are empty")
-			return
-		}
-
-		JWTSecret = ProcessSecret(vc, mountPath, jwtSecretPath, jwtSecretKey)
-		Username = ProcessSecret(vc, mountPath, credsSecretPath, usernameKey)
-		Password = ProcessSecret(vc, mountPath, credsSecretPath, passwordKey)
-
-		if JWTSecret == "" || Username == "" || Password == "" {
-			err = logError("Failed to load one or more secrets from Vault")
-			return
-		}
-	})
-	return err
-}
-
 func logError(msg string) error {
-	log.Println(msg)
+	logger.Error(msg)
 	return &customError{msg}
 }
 
@@ -119,3 +150,158 @@ type customError struct {
 func (e *customError) Error() string {
 	return e.msg
 }
+
+// IssuedCertificate is the PEM encoded material returned by a Vault PKI issue call.
+type IssuedCertificate struct {
+	Certificate string
+	PrivateKey  string
+	IssuingCA   string
+	CAChain     []string
+}
+
+func IssueCertificate(ctx context.Context, vc *api.Client, mountPath, role, commonName, altNames, ttl string) (*IssuedCertificate, error) {
+	if vc == nil {
+		return nil, logError("Vault client is nil")
+	}
+
+	data := map[string]interface{}{
+		"common_name": commonName,
+	}
+	if altNames != "" {
+		data["alt_names"] = altNames
+	}
+	if ttl != "" {
+		data["ttl"] = ttl
+	}
+
+	secret, err := vc.Logical().WriteWithContext(ctx, mountPath+"/issue/"+role, data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, logError("Empty response from Vault PKI")
+	}
+
+	issued := &IssuedCertificate{}
+	issued.Certificate, _ = secret.Data["certificate"].(string)
+	issued.PrivateKey, _ = secret.Data["private_key"].(string)
+	issued.IssuingCA, _ = secret.Data["issuing_ca"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok {
+		for _, c := range chain {
+			if s, ok := c.(string); ok {
+				issued.CAChain = append(issued.CAChain, s)
+			}
+		}
+	}
+
+	if issued.Certificate == "" || issued.PrivateKey == "" {
+		return nil, logError("Vault PKI response is missing the certificate or private key")
+	}
+	return issued, nil
+}
+
+// ReadSecretData returns every key stored in a KV v2 secret.
+func ReadSecretData(ctx context.Context, vc *api.Client, mountPath, secretName string) (map[string]interface{}, error) {
+	if vc == nil {
+		return nil, logError("Vault client is nil")
+	}
+
+	ctx, span := startSpan(ctx, "vault.ReadSecret", mountPath+"/"+secretName)
+	defer span.End()
+
+	secret, err := vc.KVv2(mountPath).Get(ctx, secretName)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	return secret.Data, nil
+}
+
+// TransitSign signs input with the given version of a transit key and
+// returns the raw signature.
+func TransitSign(ctx context.Context, vc *api.Client, mountPath, keyName string, version int, input []byte, rsa bool) ([]byte, error) {
+	if vc == nil {
+		return nil, logError("Vault client is nil")
+	}
+
+	data := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(input),
+		"key_version": version,
+	}
+	if rsa {
+		data["hash_algorithm"] = "sha2-256"
+		data["signature_algorithm"] = "pkcs1v15"
+	}
+
+	secret, err := vc.Logical().WriteWithContext(ctx, mountPath+"/sign/"+keyName, data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, logError("Empty response from Vault transit")
+	}
+
+	// Signatures look like vault:v<version>:<base64>
+	signature, _ := secret.Data["signature"].(string)
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unexpected transit signature format")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// TransitPublicKeys returns the public key of every available version of a
+// transit key, indexed by version.
+func TransitPublicKeys(ctx context.Context, vc *api.Client, mountPath, keyName string) (map[int]string, error) {
+	if vc == nil {
+		return nil, logError("Vault client is nil")
+	}
+
+	ctx, span := startSpan(ctx, "vault.TransitPublicKeys", mountPath+"/keys/"+keyName)
+	defer span.End()
+
+	secret, err := vc.Logical().ReadWithContext(ctx, mountPath+"/keys/"+keyName)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("transit key %s not found", keyName)
+	}
+
+	versions, ok := secret.Data["keys"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("transit key %s has no public keys", keyName)
+	}
+
+	keys := make(map[int]string, len(versions))
+	for v, raw := range versions {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		entry, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if pub, ok := entry["public_key"].(string); ok && pub != "" {
+			keys[version] = pub
+		}
+	}
+	return keys, nil
+}
+
+// WriteSecretData stores data as a new version of a KV v2 secret.
+func WriteSecretData(ctx context.Context, vc *api.Client, mountPath, secretName string, data map[string]interface{}) error {
+	if vc == nil {
+		return logError("Vault client is nil")
+	}
+	_, err := vc.KVv2(mountPath).Put(ctx, secretName, data)
+	return err
+}
+
+// DeleteSecret permanently removes every version of a KV v2 secret.
+func DeleteSecret(ctx context.Context, vc *api.Client, mountPath, secretName string) error {
+	if vc == nil {
+		return logError("Vault client is nil")
+	}
+	return vc.KVv2(mountPath).DeleteMetadata(ctx, secretName)
+}